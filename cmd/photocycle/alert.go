@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+//alertCmd lists groups stuck in state longer than SLA
+func alertCmd(args []string) error {
+	if _, _, err := subcommand(args, "list"); err != nil {
+		return err
+	}
+	rep, err := openRepo()
+	if err != nil {
+		return err
+	}
+	defer rep.Close()
+	alerts, err := rep.GetActiveAlerts(context.Background())
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tGROUP\tSTATE\tSTATE DATE\tIN STATE\tALERT")
+	for _, a := range alerts {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%s\t%s\n", a.Source, a.GroupID, a.State, a.StateDate.Format("2006-01-02 15:04"), time.Since(a.StateDate).Round(time.Minute), a.Created.Format("2006-01-02 15:04"))
+	}
+	return w.Flush()
+}
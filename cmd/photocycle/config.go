@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/egorka-gh/photocycle"
+	"github.com/egorka-gh/photocycle/infrastructure/repo"
+	"github.com/egorka-gh/photocycle/logging"
+	"github.com/egorka-gh/photocycle/notify"
+	"github.com/egorka-gh/photocycle/tracing"
+	log "github.com/go-kit/kit/log"
+	"github.com/kardianos/osext"
+	"github.com/spf13/viper"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+//configFile config file path from command line
+var configFile string
+
+func readConfig() error {
+	initEnv()
+	viper.SetDefault("mysql", "")                                         //MySQL connection string, no default credentials, use mysql_file or PHOTOCYCLE_MYSQL
+	viper.SetDefault("mysql_file", "")                                    //file with MySQL connection string
+	viper.SetDefault("api.groupKey", "")                                  //site group api key
+	viper.SetDefault("api.groupKey_file", "")                             //file with site group api key
+	viper.SetDefault("repo.timeout", 60)                                  //database call timeout in seconds, 0 - no limit
+	viper.SetDefault("repo.retries", 3)                                   //max attempts of call failed by deadlock or lock wait timeout
+	viper.SetDefault("repo.retryDelay", 100)                              //first retry delay in milliseconds, doubles on each retry
+	viper.SetDefault("repo.stats", 60)                                    //database calls stats log interval in minutes, 0 - off
+	viper.SetDefault("folders.log", "log")                                //Log folder, relative to executable folder
+	viper.SetDefault("log.format", "logfmt")                              //log format logfmt or json
+	viper.SetDefault("log.level", "info")                                 //default log level debug, info, warn or error
+	viper.SetDefault("log.levels", map[string]string{})                   //log level by job or component (runner, notify)
+	viper.SetDefault("run.interval", 3)                                   //run interval in mimutes
+	viper.SetDefault("run.lock", true)                                    //run jobs under database lock, several instances can share database
+	viper.SetDefault("run.backoffMax", 60)                                //max skip of failing job in minutes
+	viper.SetDefault("run.watchdog", 120)                                 //runner stall limit in minutes, 0 - watchdog off
+	viper.SetDefault("run.heartbeatFile", "")                             //heartbeat file for external monitoring, updated by watchdog
+	viper.SetDefault("fillBox.strictDelivery", false)                     //keep packages with unmapped delivery in package_new
+	viper.SetDefault("fillBox.mapsReload", 10)                            //json and delivery maps reload interval in minutes, 0 - reload on SIGHUP only
+	viper.SetDefault("import.off", true)                                  //orders import is off till sites json maps are set
+	viper.SetDefault("import.batch", 10)                                  //max groups to import per source per run
+	viper.SetDefault("webSync.off", true)                                 //web status sync is off till site canceled statuses are set
+	viper.SetDefault("webSync.interval", 30)                              //web status sync interval in minutes
+	viper.SetDefault("statusPush.off", true)                              //status push is off till status_push_map is set
+	viper.SetDefault("statusPush.batch", 100)                             //max statuses to push per run
+	viper.SetDefault("stale.interval", 10)                                //stuck groups check interval in minutes
+	viper.SetDefault("stale.sla", map[string]int{"105": 30, "250": 2880}) //max minutes in state by state
+	viper.SetDefault("trace.exporter", "")                                //spans exporter: empty - off, file or collector
+	viper.SetDefault("trace.file", "trace.json")                          //spans file, relative to log folder
+	viper.SetDefault("trace.url", "")                                     //collector url, spans are posted as json array
+	viper.SetDefault("notify.interval", 10)                               //min interval between messages of one notify channel in minutes
+	viper.SetDefault("netprint.interval", 20)                             //netprint sync interval in mimutes
+	viper.SetDefault("netprint.offset", 3)                                //netprint sync offset in hours
+	viper.SetDefault("efi.url", "")                                       //EFI Fiery api url
+	viper.SetDefault("efi.key", "")                                       //EFI api key
+	viper.SetDefault("efi.user", "")                                      //EFI user
+	viper.SetDefault("efi.pass", "")                                      //EFI password
+	viper.SetDefault("efi.pass_file", "")                                 //file with EFI password
+	viper.SetDefault("efi.debug", false)                                  //EFI dry run: log efi list, don't mark printgroups printed
+
+	if configFile != "" {
+		viper.SetConfigFile(configFile)
+	} else {
+		folder, err := osext.ExecutableFolder()
+		if err != nil {
+			folder = "."
+		}
+		viper.AddConfigPath(folder)
+		viper.SetConfigName("config")
+	}
+	err := viper.ReadInConfig()
+	if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+		// Config file not found; use defaults
+		fmt.Fprintln(os.Stderr, "Start using default setings")
+		err = nil
+	}
+	return err
+}
+
+//openRepo opens database
+func openRepo() (photocycle.Repository, error) {
+	return openLoggedRepo(log.NewNopLogger(), nil)
+}
+
+//openLoggedRepo opens database, calls are limited by repo.timeout, retried on deadlocks, errors are logged, stats are collected if not nil
+func openLoggedRepo(logger log.Logger, stats *repo.Stats) (photocycle.Repository, error) {
+	dsn, err := mysqlDSN()
+	if err != nil {
+		return nil, err
+	}
+	rep, err := repo.New(dsn, false)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка подключения к базе данных %s", err.Error())
+	}
+	mw := []repo.Middleware{
+		repo.Logging(logger),
+		repo.Retry(viper.GetInt("repo.retries"), time.Millisecond*time.Duration(viper.GetInt("repo.retryDelay")), logger),
+		repo.Timeout(time.Second * time.Duration(viper.GetInt("repo.timeout"))),
+	}
+	if stats != nil {
+		mw = append([]repo.Middleware{repo.Metrics(stats)}, mw...)
+	}
+	return repo.Chain(mw[0], mw[1:]...)(rep), nil
+}
+
+//openNotify creates notify dispatcher, returns nil if channels not set
+func openNotify(logger log.Logger) (*notify.Dispatcher, error) {
+	cfg, err := notifyChannels()
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+	var rules []notify.Rule
+	if err := viper.UnmarshalKey("notify.rules", &rules); err != nil {
+		return nil, fmt.Errorf("ошибка настройки notify.rules %s", err.Error())
+	}
+	channels := make(map[string]notify.Notifier, len(cfg))
+	for name, c := range cfg {
+		n, err := notify.NewChannel(c)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка настройки канала %s: %s", name, err.Error())
+		}
+		channels[name] = n
+	}
+	return notify.NewDispatcher(channels, rules, time.Minute*time.Duration(viper.GetInt("notify.interval")), logger)
+}
+
+//openTracing creates spans exporter, returns nil if tracing is off
+func openTracing() (tracing.Exporter, error) {
+	switch viper.GetString("trace.exporter") {
+	case "":
+		return nil, nil
+	case "file":
+		p := viper.GetString("trace.file")
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(logFolder(viper.GetString("folders.log")), p)
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return nil, fmt.Errorf("ошибка создания папки trace.file %s", err.Error())
+		}
+		e, err := tracing.NewFileExporter(p)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка открытия trace.file %s", err.Error())
+		}
+		return e, nil
+	case "collector":
+		if viper.GetString("trace.url") == "" {
+			return nil, fmt.Errorf("не задан trace.url")
+		}
+		return tracing.NewCollectorExporter(viper.GetString("trace.url"), nil), nil
+	}
+	return nil, fmt.Errorf("неизвестный trace.exporter %s", viper.GetString("trace.exporter"))
+}
+
+//logFolder resolves relative log folder from executable folder
+func logFolder(logPath string) string {
+	if !filepath.IsAbs(logPath) {
+		if folder, err := osext.ExecutableFolder(); err == nil {
+			logPath = filepath.Join(folder, logPath)
+		}
+	}
+	return logPath
+}
+
+//initLoger creates file logger, or console logger if logPath is empty,
+//relative logPath is resolved from executable folder
+func initLoger(logPath, fileName string) log.Logger {
+	var w io.Writer
+	if logPath == "" {
+		w = os.Stderr
+	} else {
+		w = &lumberjack.Logger{
+			Filename:   filepath.Join(logFolder(logPath), fileName),
+			MaxSize:    5, // megabytes
+			MaxBackups: 5,
+			MaxAge:     60, //days
+		}
+	}
+	cfg := logging.Config{
+		Format: viper.GetString("log.format"),
+		Level:  viper.GetString("log.level"),
+		Levels: viper.GetStringMapString("log.levels"),
+	}
+	if cfg.Levels == nil {
+		cfg.Levels = make(map[string]string)
+	}
+	if viper.GetBool("efi.debug") {
+		//dry run of PrintedEFI job, also logs efi list (same as log.levels printedefi debug)
+		cfg.Levels["printedefi"] = "debug"
+	}
+	logger, err := logging.New(w, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Ошибка настройки логирования %s, используются настройки по умолчанию\n", err.Error())
+		logger, _ = logging.New(w, logging.Config{})
+	}
+	return logger
+}
+
+func configCmd(args []string) error {
+	cmd, _, err := subcommand(args, "show", "validate")
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case "show":
+		if f := viper.ConfigFileUsed(); f != "" {
+			fmt.Printf("# %s\n", f)
+		}
+		keys := viper.AllKeys()
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf("%s = %v\n", k, maskSecret(k, viper.Get(k)))
+		}
+	case "validate":
+		if _, err := loadCycleConfig(); err != nil {
+			return err
+		}
+		rep, err := openRepo()
+		if err != nil {
+			return err
+		}
+		rep.Close()
+		fmt.Println("Настройки в порядке")
+	}
+	return nil
+}
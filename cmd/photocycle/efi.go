@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/egorka-gh/photocycle/infrastructure/api"
+)
+
+func efiCmd(args []string) error {
+	_, args, err := subcommand(args, "check")
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("укажите группу печати: efi check <printgroup>")
+	}
+	pg := args[0]
+	ctx := context.Background()
+	c, err := loadCycleConfig()
+	if err != nil {
+		return err
+	}
+	creds := c.credentials()
+	e, err := api.NewEFI(creds.EFI)
+	if err != nil {
+		return err
+	}
+	if err = e.Login(ctx); err != nil {
+		return err
+	}
+	itms, err := e.List(ctx, fmt.Sprintf("%s*", pg))
+	if err != nil {
+		return err
+	}
+	m := make(map[string]bool)
+	for _, it := range itms {
+		fmt.Println(it.File)
+		m[it.File] = true
+	}
+
+	rep, err := openRepo()
+	if err != nil {
+		return err
+	}
+	defer rep.Close()
+	pgs, err := rep.GetPrintPostedEFI(ctx)
+	if err != nil {
+		return err
+	}
+	for _, p := range pgs {
+		if p.PrintgroupID == pg {
+			fmt.Printf("Напечатано файлов %d из %d\n", len(m), p.FilesCount)
+			return nil
+		}
+	}
+	fmt.Printf("Напечатано файлов %d; группа не в статусе размещен на печать EFI\n", len(m))
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/egorka-gh/photocycle/job"
+)
+
+func jobCmd(args []string) error {
+	_, args, err := subcommand(args, "run")
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("укажите имя задачи: %v", job.Names())
+	}
+	c, err := loadCycleConfig()
+	if err != nil {
+		return err
+	}
+	j, err := job.ByName(args[0], c.jobs())
+	if err != nil {
+		return err
+	}
+	rep, err := openRepo()
+	if err != nil {
+		return err
+	}
+	defer rep.Close()
+	return job.RunOnce(context.Background(), rep, initLoger("", ""), c.Run, c.credentials(), j)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/spf13/pflag"
+)
+
+//command cli command, run gets args after command name
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"service":  {"service install|uninstall|start|stop|restart - управление службой", serviceCmd},
+	"run":      {"run - запуск в консоли", runCmd},
+	"job":      {"job run <name> - однократный запуск задачи", jobCmd},
+	"package":  {"package fetch [--save] [--raw] <source> <id> | dead list|retry|discard | unmapped - пакеты", packageCmd},
+	"netprint": {"netprint sync|rescan - синхронизация netprint", netprintCmd},
+	"efi":      {"efi check <printgroup> - проверка печати в EFI", efiCmd},
+	"config":   {"config show|validate - настройки", configCmd},
+	"alert":    {"alert list - группы, зависшие в статусе", alertCmd},
+}
+
+func main() {
+	fs := pflag.NewFlagSet("photocycle", pflag.ExitOnError)
+	fs.StringVar(&configFile, "config", "", "файл настроек, по умолчанию config.* в папке программы")
+	fs.SetInterspersed(false)
+	fs.Usage = usage
+	fs.Parse(os.Args[1:])
+	args := fs.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Неизвестная команда %q\n", args[0])
+		usage()
+		os.Exit(2)
+	}
+	if err := readConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	if err := cmd.run(args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Использование: photocycle [--config file] <command> [args]")
+	fmt.Fprintln(os.Stderr, envHint())
+	names := make([]string, 0, len(commands))
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[n].usage)
+	}
+}
+
+//subcommand checks args has one of valid subcommands
+func subcommand(args []string, valid ...string) (string, []string, error) {
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("не задана команда, допустимо: %s", strings.Join(valid, ", "))
+	}
+	for _, v := range valid {
+		if args[0] == v {
+			return v, args[1:], nil
+		}
+	}
+	return "", nil, fmt.Errorf("неизвестная команда %q, допустимо: %s", args[0], strings.Join(valid, ", "))
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/egorka-gh/photocycle"
+	"github.com/egorka-gh/photocycle/infrastructure/api"
+	"github.com/egorka-gh/photocycle/logging"
+	"github.com/egorka-gh/photocycle/netprint"
+	log "github.com/go-kit/kit/log"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+const timeLayout = "2006-01-02 15:04"
+
+func netprintCmd(args []string) error {
+	cmd, args, err := subcommand(args, "sync", "rescan")
+	if err != nil {
+		return err
+	}
+	if _, err = loadNetprintConfig(); err != nil {
+		return err
+	}
+	if cmd == "sync" {
+		return netprintSync(args)
+	}
+	return netprintRescan(args)
+}
+
+//netprintSync runs regular sync (from last sync timestamp)
+func netprintSync(args []string) error {
+	var sources []string
+	fs := pflag.NewFlagSet("netprint sync", pflag.ContinueOnError)
+	fs.StringSliceVar(&sources, "source", []string{"all"}, "ID источника, можно повторять; all - все источники netprint")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	rep, err := openRepo()
+	if err != nil {
+		return err
+	}
+	defer rep.Close()
+	ctx := context.Background()
+	su, err := selectSources(ctx, rep, sources)
+	if err != nil {
+		return err
+	}
+	logger := initLoger("", "")
+	failed := 0
+	for _, u := range su {
+		client, err := api.NewClient(&http.Client{Timeout: time.Second * 40}, u.URL, u.AppKey, "")
+		if err != nil {
+			return err
+		}
+		m := netprint.New(u.ID, viper.GetInt("netprint.offset"), client, rep, log.With(logger, logging.KeySource, u.ID))
+		if err := m.Sync(ctx); err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("синхронизация завершена с ошибками, источников %d", failed)
+	}
+	return nil
+}
+
+//netprintRescan rescans period, optionaly without saving
+func netprintRescan(args []string) error {
+	var (
+		fromStr  string
+		toStr    string
+		sources  []string
+		statuses []int
+		dryRun   bool
+		format   string
+	)
+	fs := pflag.NewFlagSet("netprint rescan", pflag.ContinueOnError)
+	fs.StringVar(&fromStr, "from", "", "начало периода ("+timeLayout+"), обязательно")
+	fs.StringVar(&toStr, "to", "", "конец периода ("+timeLayout+"), по умолчанию сейчас")
+	fs.StringSliceVar(&sources, "source", []string{"all"}, "ID источника, можно повторять; all - все источники netprint")
+	fs.IntSliceVar(&statuses, "statuses", netprint.DefaultStatuses, "статусы групп на сайте")
+	fs.BoolVar(&dryRun, "dry-run", false, "только показать изменения, не записывать")
+	fs.StringVar(&format, "format", "table", "формат вывода dry-run: table или json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fromStr == "" {
+		return fmt.Errorf("укажите начало периода --from")
+	}
+	from, err := time.ParseInLocation(timeLayout, fromStr, time.Local)
+	if err != nil {
+		return fmt.Errorf("ошибка преобразования --from: %s", err.Error())
+	}
+	to := time.Now()
+	if toStr != "" {
+		to, err = time.ParseInLocation(timeLayout, toStr, time.Local)
+		if err != nil {
+			return fmt.Errorf("ошибка преобразования --to: %s", err.Error())
+		}
+	}
+	if !to.After(from) {
+		return fmt.Errorf("конец периода должен быть позже начала")
+	}
+	if format != "table" && format != "json" {
+		return fmt.Errorf("неизвестный формат %q", format)
+	}
+
+	rep, err := openRepo()
+	if err != nil {
+		return err
+	}
+	defer rep.Close()
+
+	ctx := context.Background()
+	su, err := selectSources(ctx, rep, sources)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Период опроса %s - %s \n", from.Format(timeLayout), to.Format(timeLayout))
+	logger := log.NewLogfmtLogger(os.Stderr)
+	results := make([]netprint.RescanResult, 0, len(su))
+	for _, u := range su {
+		client, err := api.NewClient(http.DefaultClient, u.URL, u.AppKey, "")
+		if err != nil {
+			return err
+		}
+		m := netprint.New(u.ID, 0, client, rep, log.With(logger, logging.KeySource, u.ID))
+		res, err := m.Rescan(ctx, from, to, statuses, dryRun)
+		if err != nil {
+			fmt.Printf("Источник %d: ошибка %s\n", u.ID, err.Error())
+			continue
+		}
+		results = append(results, res)
+	}
+
+	if dryRun {
+		if format == "json" {
+			printJSON(results)
+		} else {
+			printTable(results)
+		}
+		return nil
+	}
+	for _, r := range results {
+		fmt.Printf("Источник %d: групп %d, добавлено %d, обновлено %d, без изменений %d\n", r.Source, r.Groups, len(r.Added), len(r.Updated), len(r.Unchanged))
+	}
+	return nil
+}
+
+//selectSources resolves --source values to source urls
+func selectSources(ctx context.Context, rep photocycle.Repository, sources []string) ([]photocycle.SourceURL, error) {
+	for _, s := range sources {
+		if s == "all" {
+			return rep.GetNetprintSources(ctx)
+		}
+	}
+	all, err := rep.GetSourceUrls(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]photocycle.SourceURL, len(all))
+	for _, u := range all {
+		byID[u.ID] = u
+	}
+	res := make([]photocycle.SourceURL, 0, len(sources))
+	for _, s := range sources {
+		id, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("не верный ID источника %q", s)
+		}
+		u, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("источник %d не найден или не активен", id)
+		}
+		res = append(res, u)
+	}
+	return res, nil
+}
+
+type previewRow struct {
+	Action string `json:"action"`
+	photocycle.GroupNetprint
+}
+
+func preview(results []netprint.RescanResult) []previewRow {
+	rows := make([]previewRow, 0)
+	for _, r := range results {
+		for _, np := range r.Added {
+			rows = append(rows, previewRow{Action: "insert", GroupNetprint: np})
+		}
+		for _, np := range r.Updated {
+			rows = append(rows, previewRow{Action: "update", GroupNetprint: np})
+		}
+	}
+	return rows
+}
+
+func printJSON(results []netprint.RescanResult) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(preview(results))
+}
+
+func printTable(results []netprint.RescanResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ACTION\tSOURCE\tGROUP\tNETPRINT\tBOX\tSTATE")
+	for _, r := range preview(results) {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%d\t%d\n", r.Action, r.Source, r.GroupID, r.NetprintID, r.BoxNumber, r.State)
+	}
+	w.Flush()
+	for _, r := range results {
+		fmt.Printf("Источник %d: групп %d, добавить %d, обновить %d, без изменений %d\n", r.Source, r.Groups, len(r.Added), len(r.Updated), len(r.Unchanged))
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/egorka-gh/photocycle"
+	"github.com/egorka-gh/photocycle/infrastructure/api"
+	"github.com/egorka-gh/photocycle/job"
+	"github.com/spf13/pflag"
+)
+
+func packageCmd(args []string) error {
+	cmd, args, err := subcommand(args, "fetch", "dead", "unmapped")
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case "dead":
+		return packageDead(args)
+	case "unmapped":
+		return packageUnmapped()
+	}
+	return packageFetch(args)
+}
+
+//packageUnmapped lists site delivery ids without delivery type mapping
+func packageUnmapped() error {
+	rep, err := openRepo()
+	if err != nil {
+		return err
+	}
+	defer rep.Close()
+	items, err := rep.GetDeliveryUnmapped(context.Background())
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tSITE DELIVERY\tPACKAGES\tSAMPLE\tFIRST SEEN\tLAST SEEN")
+	for _, u := range items {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%s\t%s\n", u.Source, u.NativeID, u.Packages, u.Sample, u.FirstSeen.Format("2006-01-02 15:04"), u.LastSeen.Format("2006-01-02 15:04"))
+	}
+	return w.Flush()
+}
+
+//packageDead manages dead packages (out of package_new processing after max attempts)
+func packageDead(args []string) error {
+	cmd, args, err := subcommand(args, "list", "retry", "discard")
+	if err != nil {
+		return err
+	}
+	rep, err := openRepo()
+	if err != nil {
+		return err
+	}
+	defer rep.Close()
+	ctx := context.Background()
+	if cmd == "list" {
+		pkgs, err := rep.GetDeadPackages(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SOURCE\tID\tCREATED\tATTEMPTS\tLAST ERROR")
+		for _, p := range pkgs {
+			fmt.Fprintf(w, "%d\t%d\t%s\t%d\t%s\n", p.Source, p.ID, p.Created.Format("2006-01-02 15:04"), p.Attempt, p.LastError)
+		}
+		return w.Flush()
+	}
+
+	if len(args) != 2 {
+		return fmt.Errorf("укажите источник и номер группы: package dead %s <source> <id>", cmd)
+	}
+	source, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("не верный ID источника %q", args[0])
+	}
+	groupID, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("не верный номер группы %q", args[1])
+	}
+	if cmd == "retry" {
+		err = rep.RetryDeadPackage(ctx, source, groupID)
+	} else {
+		err = rep.DiscardDeadPackage(ctx, source, groupID)
+	}
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("пакет %d источника %d не найден среди отброшенных", groupID, source)
+	}
+	return err
+}
+
+//packageFetch loads group from site, builds package and prints it, optionaly saves
+func packageFetch(args []string) error {
+	var (
+		save bool
+		raw  bool
+	)
+	fs := pflag.NewFlagSet("package fetch", pflag.ContinueOnError)
+	fs.BoolVar(&save, "save", false, "сохранить пакет в базу, существующий пакет обновляется")
+	fs.BoolVar(&raw, "raw", false, "показать json сайта и сопоставление полей")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	args = fs.Args()
+	if len(args) != 2 {
+		return fmt.Errorf("укажите источник и номер группы: package fetch [--save] [--raw] <source> <id>")
+	}
+	source, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("не верный ID источника %q", args[0])
+	}
+	groupID, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("не верный номер группы %q", args[1])
+	}
+
+	rep, err := openRepo()
+	if err != nil {
+		return err
+	}
+	defer rep.Close()
+	ctx := context.Background()
+	u, err := findSource(ctx, rep, source)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadCycleConfig()
+	if err != nil {
+		return err
+	}
+	creds := cfg.credentials()
+	cl, err := api.NewClient(&http.Client{Timeout: time.Second * 40}, u.URL, u.AppKey, creds.GroupKey)
+	if err != nil {
+		return err
+	}
+	var gbs *api.GroupBoxes
+	if u.HasBoxes {
+		gbs, err = cl.GetBoxes(ctx, groupID)
+		if err != nil {
+			return fmt.Errorf("api.GetBoxes error: %s", err.Error())
+		}
+	}
+	group, err := cl.GetGroup(ctx, groupID)
+	if err != nil {
+		return fmt.Errorf("api.GetGroup error: %s", err.Error())
+	}
+	b, err := api.CreateBuilder(rep)
+	if err != nil {
+		return err
+	}
+	p, warnings, err := b.BuildPackage(source, group)
+	if err != nil {
+		return fmt.Errorf("api.BuildPackage error: %s", err.Error())
+	}
+	api.ApplyBoxes(p, gbs)
+	if err = b.CheckOrders(ctx, p); err != nil {
+		return fmt.Errorf("CheckOrders error: %s", err.Error())
+	}
+
+	if raw {
+		printRaw(group, gbs, b.Trace(group))
+	}
+	printPackage(p)
+	for _, w := range warnings {
+		fmt.Printf("Предупреждение: %s\n", w.Message)
+	}
+
+	if save {
+		if api.HasWarning(warnings, api.WarnDeliveryUnmapped) {
+			if err = rep.AddDeliveryUnmapped(ctx, source, p.NativeDeliveryID, p.ID); err != nil {
+				return err
+			}
+		}
+		created, changes, err := job.SavePackage(ctx, rep, p)
+		if err != nil {
+			return fmt.Errorf("SavePackage error: %s", err.Error())
+		}
+		if created {
+			fmt.Println("Пакет добавлен")
+			return nil
+		}
+		fmt.Printf("Пакет обновлен, изменений %d\n", len(changes))
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ENTITY\tKEY\tFIELD\tOLD\tNEW")
+		for _, c := range changes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", c.Entity, c.Key, c.Field, c.OldValue, c.NewValue)
+		}
+		w.Flush()
+	}
+	return nil
+}
+
+//findSource finds online source by id
+func findSource(ctx context.Context, rep photocycle.Repository, source int) (photocycle.SourceURL, error) {
+	su, err := rep.GetSourceUrls(ctx)
+	if err != nil {
+		return photocycle.SourceURL{}, err
+	}
+	for _, u := range su {
+		if u.ID == source {
+			return u, nil
+		}
+	}
+	return photocycle.SourceURL{}, fmt.Errorf("источник %d не найден или не активен", source)
+}
+
+func printRaw(group map[string]interface{}, gbs *api.GroupBoxes, trace []api.MappedField) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	fmt.Println("== group json")
+	enc.Encode(group)
+	if gbs != nil {
+		fmt.Println("== boxes json")
+		enc.Encode(gbs)
+	}
+	fmt.Println("== mapping")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FAMILY\tJSON KEY\tFIELD\tRAW\tTRANSFORM\tVALUE")
+	for _, f := range trace {
+		v := "<not found>"
+		if f.Err != nil {
+			v = "<error> " + f.Err.Error()
+		} else if f.Found {
+			v = fmt.Sprintf("%v", f.Value)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%v\t%s\t%s\n", f.Family, f.JSONKey, f.Field, f.Raw, f.Transform, v)
+	}
+	w.Flush()
+}
+
+func printPackage(p *photocycle.Package) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "== package")
+	fmt.Fprintf(w, "source\t%d\n", p.Source)
+	fmt.Fprintf(w, "id\t%d\n", p.ID)
+	fmt.Fprintf(w, "number\t%s\n", p.IDName)
+	fmt.Fprintf(w, "client\t%d\n", p.ClientID)
+	fmt.Fprintf(w, "execution date\t%s\n", p.ExecutionDate)
+	fmt.Fprintf(w, "delivery\t%d (site %d) %s\n", p.DeliveryID, p.NativeDeliveryID, p.DeliveryName)
+	fmt.Fprintf(w, "site state\t%d %s\n", p.SrcState, p.SrcStateName)
+	fmt.Fprintf(w, "mail service\t%d\n", p.MailService)
+	fmt.Fprintf(w, "orders\t%d\n", p.OrdersNum)
+
+	fmt.Fprintln(w, "== properties")
+	for _, pp := range p.Properties {
+		fmt.Fprintf(w, "%s\t%s\n", pp.Property, pp.Value)
+	}
+
+	fmt.Fprintln(w, "== barcodes")
+	fmt.Fprintln(w, "BARCODE\tTYPE\tBOX")
+	for _, bc := range p.Barcodes {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", bc.Barcode, bc.BarcodeType, bc.BoxNumber)
+	}
+
+	fmt.Fprintln(w, "== boxes")
+	fmt.Fprintln(w, "BOX\tNUM\tBARCODE\tPRICE\tWEIGHT")
+	for _, bx := range p.Boxes {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%.2f\t%d\n", bx.ID, bx.Num, bx.Barcode, bx.Price, bx.Weight)
+		for _, it := range bx.Items {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%d-%d\t\n", it.OrderID, it.Alias, it.Type, it.From, it.To)
+		}
+	}
+
+	if len(p.Issues) > 0 {
+		fmt.Fprintln(w, "== issues")
+		fmt.Fprintln(w, "BOX\tORDER\tISSUE\tSTATE")
+		for _, i := range p.Issues {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", i.BoxID, i.OrderID, i.Issue, i.State)
+		}
+	}
+	w.Flush()
+}
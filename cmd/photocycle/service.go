@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/egorka-gh/photocycle"
+	"github.com/egorka-gh/photocycle/infrastructure/repo"
+	"github.com/egorka-gh/photocycle/job"
+	"github.com/egorka-gh/photocycle/notify"
+	"github.com/egorka-gh/photocycle/tracing"
+	log "github.com/go-kit/kit/log"
+	service1 "github.com/kardianos/service"
+	group "github.com/oklog/oklog/pkg/group"
+	"github.com/spf13/viper"
+)
+
+//demon logger
+var dLogger service1.Logger
+
+type program struct {
+	group     *group.Group
+	rep       photocycle.Repository
+	exporter  tracing.Exporter
+	interrupt chan struct{}
+	quit      chan struct{}
+}
+
+func newService() (service1.Service, error) {
+	svcConfig := &service1.Config{
+		Name:        "Cycle",
+		DisplayName: "Cycle Service",
+		Description: "Helper service for PhotoCycle",
+		Arguments:   []string{"run"},
+	}
+	if configFile != "" {
+		svcConfig.Arguments = []string{"--config", configFile, "run"}
+	}
+	return service1.New(&program{}, svcConfig)
+}
+
+func serviceCmd(args []string) error {
+	cmd, _, err := subcommand(args, service1.ControlAction[:]...)
+	if err != nil {
+		return err
+	}
+	s, err := newService()
+	if err != nil {
+		return err
+	}
+	return service1.Control(s, cmd)
+}
+
+//runCmd runs as os demon or in console using kardianos
+func runCmd(args []string) error {
+	s, err := newService()
+	if err != nil {
+		return err
+	}
+	dLogger, err = s.Logger(nil)
+	if err != nil {
+		return err
+	}
+	err = s.Run()
+	if err != nil {
+		dLogger.Error(err)
+	}
+	return err
+}
+
+func (p *program) Start(s service1.Service) error {
+	exp, err := openTracing()
+	if err != nil {
+		return err
+	}
+	logger := initLoger(viper.GetString("folders.log"), "cycle.log")
+	stats := repo.NewStats()
+	r, rep, d, err := initRuner(logger, stats)
+	if err != nil {
+		if exp != nil {
+			exp.Close()
+		}
+		return err
+	}
+	if exp != nil {
+		tracing.SetExporter(exp)
+	}
+
+	g := &group.Group{}
+	p.interrupt = make(chan struct{})
+	p.quit = make(chan struct{})
+	p.group = g
+	p.rep = rep
+	p.exporter = exp
+
+	runerRunning := make(chan struct{})
+	g.Add(func() error {
+		return r.Run(runerRunning)
+	}, func(error) {
+		close(runerRunning)
+	})
+
+	//notify actor
+	if d != nil {
+		notifyStop := make(chan struct{})
+		g.Add(func() error {
+			return d.Run(notifyStop)
+		}, func(error) {
+			close(notifyStop)
+		})
+	}
+
+	//watchdog actor
+	if limit := viper.GetInt("run.watchdog"); limit > 0 {
+		wdStop := make(chan struct{})
+		var sender notify.Sender
+		if d != nil {
+			sender = d
+		}
+		g.Add(func() error {
+			return job.Watchdog(r, time.Minute*time.Duration(limit), viper.GetString("run.heartbeatFile"), logger, sender, wdStop)
+		}, func(error) {
+			close(wdStop)
+		})
+	}
+
+	//repository stats actor
+	if interval := viper.GetInt("repo.stats"); interval > 0 {
+		statsStop := make(chan struct{})
+		g.Add(func() error {
+			ticker := time.NewTicker(time.Minute * time.Duration(interval))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					stats.Log(logger)
+				case <-statsStop:
+					stats.Log(logger)
+					return nil
+				}
+			}
+		}, func(error) {
+			close(statsStop)
+		})
+	}
+
+	//reload actor, SIGHUP reloads json and delivery maps
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	reloadStop := make(chan struct{})
+	g.Add(func() error {
+		for {
+			select {
+			case <-hup:
+				dLogger.Info("Reload requested")
+				r.Reload()
+			case <-reloadStop:
+				return nil
+			}
+		}
+	}, func(error) {
+		signal.Stop(hup)
+		close(reloadStop)
+	})
+
+	//initCancelInterrupt actor
+	running := make(chan struct{})
+	p.group.Add(
+		func() error {
+			select {
+			case <-p.interrupt:
+				return fmt.Errorf("get interrupt signal")
+			case <-running:
+				return nil
+			}
+		}, func(error) {
+			close(running)
+		})
+
+	if service1.Interactive() {
+		dLogger.Info("Running in terminal.")
+	} else {
+		dLogger.Info("Starting Cycle service...")
+	}
+	// Start should not block. Do the actual work async.
+	go p.run()
+	return nil
+}
+
+func (p *program) run() {
+	//close db cnn
+	defer func() {
+		if p.rep != nil {
+			p.rep.Close()
+		}
+		if p.exporter != nil {
+			tracing.SetExporter(nil)
+			if err := p.exporter.Close(); err != nil {
+				dLogger.Error(err)
+			}
+		}
+	}()
+	dLogger.Info("Cycle started")
+	dLogger.Info(p.group.Run())
+	close(p.quit)
+}
+
+func (p *program) Stop(s service1.Service) error {
+	// Stop should not block. Return with a few seconds.
+	dLogger.Info("Cycle Stopping!")
+	//interrupt service
+	close(p.interrupt)
+	//waite service stops
+	<-p.quit
+	dLogger.Info("Cycle stopped")
+	return nil
+}
+
+func initRuner(logger log.Logger, stats *repo.Stats) (job.Runer, photocycle.Repository, *notify.Dispatcher, error) {
+	c, err := loadCycleConfig()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	rep, err := openLoggedRepo(logger, stats)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	d, err := openNotify(logger)
+	if err != nil {
+		rep.Close()
+		return nil, nil, nil, err
+	}
+	var sender notify.Sender
+	if d != nil {
+		sender = d
+	}
+	jobs := make([]job.Job, 0, 5)
+	if !c.FillBox.Off {
+		jobs = append(jobs, job.FillBox(c.FillBox))
+	}
+	if !c.Import.Off {
+		jobs = append(jobs, job.Import(c.Import, c.FillBox.MapsReload))
+	}
+	if !c.Netprint.Off {
+		jobs = append(jobs, job.Netprint(c.Netprint))
+	}
+	if !c.WebSync.Off {
+		jobs = append(jobs, job.WebSync(c.WebSync))
+	}
+	if !c.StatusPush.Off {
+		jobs = append(jobs, job.StatusPush(c.StatusPush))
+	}
+	if !c.Stale.Off {
+		jobs = append(jobs, job.Stale(c.Stale))
+	}
+	if !c.EFI.Off {
+		jobs = append(jobs, job.PrintedEFI(c.EFI.PrintedEFIConfig))
+	}
+	r := job.NewRuner(c.Run, rep, logger, sender, c.credentials(), jobs...)
+	return r, rep, d, nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/egorka-gh/photocycle/infrastructure/api"
+	"github.com/egorka-gh/photocycle/job"
+	"github.com/egorka-gh/photocycle/logging"
+	"github.com/egorka-gh/photocycle/notify"
+	"github.com/go-sql-driver/mysql"
+	"github.com/spf13/viper"
+)
+
+//envPrefix environment overrides prefix, key dots are replaced by _ (PHOTOCYCLE_MYSQL, PHOTOCYCLE_EFI_PASS)
+const envPrefix = "PHOTOCYCLE"
+
+//secretSuffix secret file key suffix (mysql_file, efi.pass_file)
+const secretSuffix = "_file"
+
+//secret keys names (last key segment)
+var secretNames = map[string]bool{
+	"mysql":    true,
+	"pass":     true,
+	"key":      true,
+	"groupkey": true,
+	"token":    true,
+}
+
+func isSecret(key string) bool {
+	if strings.HasSuffix(key, secretSuffix) {
+		return false
+	}
+	return secretNames[key[strings.LastIndex(key, ".")+1:]]
+}
+
+//initEnv enables environment overrides
+func initEnv() {
+	viper.SetEnvPrefix(envPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+}
+
+//secretFiles lists set secret file keys (key_file in config or PHOTOCYCLE_KEY_FILE env),
+//base key may be not set
+func secretFiles() []string {
+	res := make([]string, 0)
+	for _, k := range viper.AllKeys() {
+		if strings.HasSuffix(k, secretSuffix) && viper.GetString(k) != "" {
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+//readSecrets sets targets (by lower case key) by content of secret files,
+//viper is not changed, so secrets are read into typed settings after Unmarshal
+func readSecrets(targets map[string]*string) error {
+	for _, k := range secretFiles() {
+		t, ok := targets[strings.TrimSuffix(k, secretSuffix)]
+		if !ok {
+			continue
+		}
+		b, err := ioutil.ReadFile(viper.GetString(k))
+		if err != nil {
+			return fmt.Errorf("%s: ошибка чтения файла %s", k, err.Error())
+		}
+		*t = strings.TrimSpace(string(b))
+	}
+	return nil
+}
+
+//mysqlDSN reads MySQL connection string
+func mysqlDSN() (string, error) {
+	dsn := viper.GetString("mysql")
+	return dsn, readSecrets(map[string]*string{"mysql": &dsn})
+}
+
+//notifyChannels reads notify channels settings, pass and token can be read from files
+func notifyChannels() (map[string]notify.ChannelConfig, error) {
+	var cfg map[string]notify.ChannelConfig
+	if err := viper.UnmarshalKey("notify.channels", &cfg); err != nil {
+		return nil, fmt.Errorf("ошибка настройки notify.channels %s", err.Error())
+	}
+	channels := make(map[string]*notify.ChannelConfig, len(cfg))
+	targets := make(map[string]*string, 2*len(cfg))
+	for name := range cfg {
+		c := cfg[name]
+		channels[name] = &c
+		targets["notify.channels."+name+".pass"] = &c.Pass
+		targets["notify.channels."+name+".token"] = &c.Token
+	}
+	if err := readSecrets(targets); err != nil {
+		return nil, err
+	}
+	for name, c := range channels {
+		cfg[name] = *c
+	}
+	return cfg, nil
+}
+
+//maskSecret hides secret value, mysql connection keeps all except password
+func maskSecret(key string, value interface{}) interface{} {
+	s, ok := value.(string)
+	if !ok || s == "" || !isSecret(key) {
+		return value
+	}
+	if key == "mysql" {
+		if c, err := mysql.ParseDSN(s); err == nil {
+			if c.Passwd != "" {
+				c.Passwd = "***"
+			}
+			return c.FormatDSN()
+		}
+	}
+	return "***"
+}
+
+//cycleConfig cycle service settings
+type cycleConfig struct {
+	MySQL   string
+	Folders struct {
+		Log string
+	}
+	Log struct {
+		Format string
+		Level  string
+		Levels map[string]string
+	}
+	Repo struct {
+		Timeout    int
+		Retries    int
+		RetryDelay int
+		Stats      int
+	}
+	Run job.RunConfig
+	API struct {
+		GroupKey string
+	}
+	FillBox    job.FillBoxConfig
+	Import     job.ImportConfig
+	WebSync    job.WebSyncConfig
+	StatusPush job.StatusPushConfig
+	Stale      job.StaleConfig
+	Netprint   job.NetprintConfig
+	EFI        struct {
+		job.PrintedEFIConfig `mapstructure:",squash"`
+		URL                  string
+		Key                  string
+		User                 string
+		Pass                 string
+	}
+	Trace struct {
+		Exporter string
+		File     string
+		URL      string
+	}
+}
+
+//configErrors collects settings errors
+type configErrors []string
+
+func (e *configErrors) add(key, format string, a ...interface{}) {
+	*e = append(*e, key+": "+fmt.Sprintf(format, a...))
+}
+
+func (e configErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return fmt.Errorf("ошибки в настройках:\n  %s", strings.Join(e, "\n  "))
+}
+
+//loadCycleConfig reads and validates cycle service settings
+func loadCycleConfig() (cycleConfig, error) {
+	var c cycleConfig
+	if err := viper.Unmarshal(&c); err != nil {
+		return c, fmt.Errorf("ошибка чтения настроек %s", err.Error())
+	}
+	if err := c.readSecrets(); err != nil {
+		return c, err
+	}
+	return c, c.validate()
+}
+
+//readSecrets reads secrets from secret files
+func (c *cycleConfig) readSecrets() error {
+	return readSecrets(map[string]*string{
+		"mysql":        &c.MySQL,
+		"api.groupkey": &c.API.GroupKey,
+		"efi.key":      &c.EFI.Key,
+		"efi.pass":     &c.EFI.Pass,
+	})
+}
+
+func (c cycleConfig) validate() error {
+	var errs configErrors
+	validateMySQL(&errs, c.MySQL)
+	for _, k := range secretFiles() {
+		if !isSecret(strings.TrimSuffix(k, secretSuffix)) {
+			errs.add(k, "ключ %s не секрет, файл не используется", strings.TrimSuffix(k, secretSuffix))
+		}
+	}
+	if _, err := notifyChannels(); err != nil {
+		errs.add("notify.channels", "%s", err.Error())
+	}
+	if c.Repo.Timeout < 0 {
+		errs.add("repo.timeout", "отрицательное значение")
+	}
+	if c.Repo.Retries < 1 {
+		errs.add("repo.retries", "должно быть не меньше 1")
+	}
+	if c.Repo.RetryDelay < 0 || c.Repo.Stats < 0 {
+		errs.add("repo", "отрицательное значение retryDelay или stats")
+	}
+	if c.Run.Interval < 3 {
+		errs.add("run.interval", "минимальный интервал 3 минуты")
+	}
+	if c.Run.BackoffMax < 0 {
+		errs.add("run.backoffMax", "отрицательное значение")
+	}
+	if c.Run.Watchdog != 0 && c.Run.Watchdog < 2*c.Run.Interval {
+		errs.add("run.watchdog", "должен быть не меньше двух run.interval")
+	}
+	if _, err := logging.New(ioutil.Discard, logging.Config{Format: c.Log.Format, Level: c.Log.Level, Levels: c.Log.Levels}); err != nil {
+		errs.add("log", "%s", err.Error())
+	}
+	if !c.FillBox.Off || !c.Import.Off || !c.WebSync.Off {
+		if c.API.GroupKey == "" {
+			errs.add("api.groupKey", "не задан ключ api группы (нужен fillBox, import, webSync)")
+		}
+	}
+	if !c.FillBox.Off {
+		if c.FillBox.Workers < 0 {
+			errs.add("fillBox.workers", "отрицательное значение")
+		}
+		validateRetry(&errs, "fillBox", c.FillBox.MaxAttempts, c.FillBox.RetryDelay, c.FillBox.RetryMaxDelay)
+	}
+	if !c.Import.Off && c.Import.Batch < 0 {
+		errs.add("import.batch", "отрицательное значение")
+	}
+	if !c.WebSync.Off {
+		if len(c.WebSync.Canceled) == 0 {
+			errs.add("webSync.canceled", "не заданы статусы отмены на сайте")
+		}
+		if c.WebSync.Interval < 0 {
+			errs.add("webSync.interval", "отрицательное значение")
+		}
+	}
+	if !c.StatusPush.Off {
+		validateRetry(&errs, "statusPush", c.StatusPush.MaxAttempts, c.StatusPush.RetryDelay, c.StatusPush.RetryMaxDelay)
+	}
+	if !c.Stale.Off {
+		for k, v := range c.Stale.SLA {
+			if _, err := strconv.Atoi(k); err != nil {
+				errs.add("stale.sla", "состояние %q не число", k)
+			}
+			if v <= 0 {
+				errs.add("stale.sla", "состояние %s: интервал должен быть больше 0", k)
+			}
+		}
+	}
+	if !c.Netprint.Off {
+		validateNetprint(&errs, c.Netprint.Interval, c.Netprint.Offset)
+	}
+	if !c.EFI.Off {
+		if c.EFI.URL == "" {
+			errs.add("efi.url", "не задан")
+		} else if _, err := url.Parse(c.EFI.URL); err != nil {
+			errs.add("efi.url", "%s", err.Error())
+		}
+		if c.EFI.Key == "" {
+			errs.add("efi.key", "не задан")
+		}
+		if c.EFI.User == "" {
+			errs.add("efi.user", "не задан")
+		}
+		if c.EFI.Pass == "" {
+			errs.add("efi.pass", "не задан")
+		}
+	}
+	switch c.Trace.Exporter {
+	case "", "file":
+	case "collector":
+		if c.Trace.URL == "" {
+			errs.add("trace.url", "не задан")
+		}
+	default:
+		errs.add("trace.exporter", "неизвестное значение %q", c.Trace.Exporter)
+	}
+	return errs.err()
+}
+
+//netprintConfig netprint commands settings
+type netprintConfig struct {
+	MySQL    string
+	Netprint struct {
+		Interval int
+		Offset   int
+	}
+}
+
+//loadNetprintConfig reads and validates netprint commands settings
+func loadNetprintConfig() (netprintConfig, error) {
+	var c netprintConfig
+	if err := viper.Unmarshal(&c); err != nil {
+		return c, fmt.Errorf("ошибка чтения настроек %s", err.Error())
+	}
+	if err := readSecrets(map[string]*string{"mysql": &c.MySQL}); err != nil {
+		return c, err
+	}
+	var errs configErrors
+	validateMySQL(&errs, c.MySQL)
+	validateNetprint(&errs, c.Netprint.Interval, c.Netprint.Offset)
+	return c, errs.err()
+}
+
+func validateMySQL(errs *configErrors, dsn string) {
+	if dsn == "" {
+		errs.add("mysql", "не задана строка подключения (mysql, mysql_file или %s_MYSQL)", envPrefix)
+		return
+	}
+	if _, err := mysql.ParseDSN(dsn); err != nil {
+		errs.add("mysql", "%s", err.Error())
+	}
+}
+
+func validateRetry(errs *configErrors, key string, maxAttempts, delay, maxDelay int) {
+	if maxAttempts < 0 {
+		errs.add(key+".maxAttempts", "отрицательное значение")
+	}
+	if delay < 0 || maxDelay < 0 {
+		errs.add(key+".retryDelay", "отрицательная задержка")
+	}
+	if delay > 0 && maxDelay > 0 && maxDelay < delay {
+		errs.add(key+".retryMaxDelay", "меньше retryDelay")
+	}
+}
+
+func validateNetprint(errs *configErrors, interval, offset int) {
+	if interval < 0 {
+		errs.add("netprint.interval", "отрицательное значение")
+	}
+	if offset < 0 {
+		errs.add("netprint.offset", "отрицательное значение")
+	}
+}
+
+//jobs jobs settings
+func (c cycleConfig) jobs() job.Config {
+	return job.Config{
+		Run:        c.Run,
+		FillBox:    c.FillBox,
+		Import:     c.Import,
+		WebSync:    c.WebSync,
+		StatusPush: c.StatusPush,
+		Stale:      c.Stale,
+		Netprint:   c.Netprint,
+		EFI:        c.EFI.PrintedEFIConfig,
+	}
+}
+
+//credentials jobs secrets
+func (c cycleConfig) credentials() job.Credentials {
+	return job.Credentials{
+		GroupKey: c.API.GroupKey,
+		EFI:      api.EFIConfig{URL: c.EFI.URL, Key: c.EFI.Key, User: c.EFI.User, Pass: c.EFI.Pass},
+	}
+}
+
+//envHint lists environment overrides for help
+func envHint() string {
+	return fmt.Sprintf("Переменные окружения %s_<КЛЮЧ> переопределяют настройки (точки заменяются на _), секреты можно читать из файлов <ключ>_file", envPrefix)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestSettings(t *testing.T) {
+	defer viper.Reset()
+	dir := t.TempDir()
+	pass := filepath.Join(dir, "efi.pass")
+	if err := ioutil.WriteFile(pass, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	token := filepath.Join(dir, "tg.token")
+	if err := ioutil.WriteFile(token, []byte("SECRET"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := filepath.Join(dir, "config.json")
+	err := ioutil.WriteFile(cfg, []byte(`{
+		"run.interval": 1,
+		"fillBox.off": true,
+		"efi.off": false,
+		"efi.url": "http://efi",
+		"efi.key": "k",
+		"efi.user": "u",
+		"efi.pass_file": "`+pass+`",
+		"efi.debug": true,
+		"statusPush.maxAttempts": 7,
+		"stale.sla": {"x": 10},
+		"notify.channels": {"admin": {"type": "telegram", "chat": "42", "token_file": "`+token+`"}},
+		"webSync.interval_file": "`+token+`"
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("PHOTOCYCLE_MYSQL", "root:pw@tcp(127.0.0.1:3306)/db?parseTime=true")
+	defer os.Unsetenv("PHOTOCYCLE_MYSQL")
+	configFile = cfg
+	defer func() { configFile = "" }()
+	if err = readConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loadCycleConfig()
+	if c.EFI.Pass != "secret" {
+		t.Errorf("expected efi.pass from file, got %q", c.EFI.Pass)
+	}
+	if jc := c.jobs(); !jc.FillBox.Off || jc.EFI.Off || !jc.EFI.Debug || jc.StatusPush.MaxAttempts != 7 || !jc.Run.Lock {
+		t.Errorf("unexpected jobs settings %+v", jc)
+	}
+	if !strings.HasPrefix(c.MySQL, "root:pw@") {
+		t.Errorf("expected mysql from env, got %q", c.MySQL)
+	}
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, k := range []string{"run.interval", "stale.sla", "websync.interval_file"} {
+		if !strings.Contains(err.Error(), k) {
+			t.Errorf("expected %s error, got %s", k, err.Error())
+		}
+	}
+	if strings.Contains(err.Error(), "mysql") || strings.Contains(err.Error(), "efi") {
+		t.Errorf("unexpected error %s", err.Error())
+	}
+
+	//nested secret keeps other channel settings
+	ch, err := notifyChannels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := ch["admin"]; a.Type != "telegram" || a.Chat != "42" || a.Token != "SECRET" {
+		t.Errorf("expected telegram channel with token from file, got %+v", a)
+	}
+	if creds := c.credentials(); creds.EFI.Pass != "secret" {
+		t.Errorf("expected efi pass in credentials, got %q", creds.EFI.Pass)
+	}
+	if viper.GetString("efi.pass") != "" {
+		t.Errorf("secret should not be set to viper, got %q", viper.GetString("efi.pass"))
+	}
+
+	if v := maskSecret("mysql", c.MySQL); v != "root:***@tcp(127.0.0.1:3306)/db?parseTime=true" {
+		t.Errorf("unexpected masked mysql %v", v)
+	}
+	if v := maskSecret("notify.channels.tg.token", "abc"); v != "***" {
+		t.Errorf("expected masked token, got %v", v)
+	}
+	if v := maskSecret("efi.pass_file", pass); v != pass {
+		t.Errorf("secret file path should not be masked, got %v", v)
+	}
+}
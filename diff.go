@@ -0,0 +1,160 @@
+package photocycle
+
+import (
+	"fmt"
+	"sort"
+)
+
+//PackageChange represents one changed value of package (package_change_log db object)
+type PackageChange struct {
+	Source    int    `json:"source" db:"source"`
+	PackageID int    `json:"package_id" db:"package_id"`
+	Entity    string `json:"entity" db:"entity"`
+	Key       string `json:"item_key" db:"item_key"`
+	Field     string `json:"field" db:"field"`
+	OldValue  string `json:"old_value" db:"old_value"`
+	NewValue  string `json:"new_value" db:"new_value"`
+}
+
+//package change entities
+const (
+	ChangePackage  = "package"
+	ChangeProperty = "property"
+	ChangeBarcode  = "barcode"
+	ChangeBox      = "box"
+	ChangeBoxItem  = "box_item"
+)
+
+//DiffPackage compares saved package with new one (built from site).
+//added items has empty OldValue, removed - empty NewValue
+func DiffPackage(old, new *Package) []PackageChange {
+	d := differ{source: new.Source, packageID: new.ID, res: make([]PackageChange, 0)}
+
+	//package fields
+	d.value(ChangePackage, "", "client_id", old.ClientID, new.ClientID)
+	d.value(ChangePackage, "", "id_name", old.IDName, new.IDName)
+	d.value(ChangePackage, "", "execution_date", old.ExecutionDate.format("2006-01-02"), new.ExecutionDate.format("2006-01-02"))
+	d.value(ChangePackage, "", "delivery_id", old.DeliveryID, new.DeliveryID)
+	d.value(ChangePackage, "", "delivery_name", old.DeliveryName, new.DeliveryName)
+	d.value(ChangePackage, "", "src_state", old.SrcState, new.SrcState)
+	d.value(ChangePackage, "", "src_state_name", old.SrcStateName, new.SrcStateName)
+	d.value(ChangePackage, "", "mail_service", old.MailService, new.MailService)
+	d.value(ChangePackage, "", "orders_num", old.OrdersNum, new.OrdersNum)
+
+	//properties
+	oldProps := make(map[string]string, len(old.Properties))
+	for _, p := range old.Properties {
+		oldProps[p.Property] = p.Value
+	}
+	newProps := make(map[string]string, len(new.Properties))
+	for _, p := range new.Properties {
+		newProps[p.Property] = p.Value
+	}
+	d.set(ChangeProperty, "", oldProps, newProps)
+
+	//barcodes
+	oldBars := make(map[string]string, len(old.Barcodes))
+	for _, b := range old.Barcodes {
+		oldBars[fmt.Sprintf("%s/%d", b.Barcode, b.BarcodeType)] = fmt.Sprint(b.BoxNumber)
+	}
+	newBars := make(map[string]string, len(new.Barcodes))
+	for _, b := range new.Barcodes {
+		newBars[fmt.Sprintf("%s/%d", b.Barcode, b.BarcodeType)] = fmt.Sprint(b.BoxNumber)
+	}
+	d.set(ChangeBarcode, "", oldBars, newBars)
+
+	//boxes
+	oldBoxes := make(map[string]PackageBox, len(old.Boxes))
+	for _, b := range old.Boxes {
+		oldBoxes[b.ID] = b
+	}
+	newBoxes := make(map[string]bool, len(new.Boxes))
+	for _, nb := range new.Boxes {
+		newBoxes[nb.ID] = true
+		ob, ok := oldBoxes[nb.ID]
+		if !ok {
+			d.add(ChangeBox, nb.ID, "", "", fmt.Sprint(nb.Num))
+			d.set(ChangeBoxItem, nb.ID, nil, boxItems(nb))
+			continue
+		}
+		d.value(ChangeBox, nb.ID, "box_num", ob.Num, nb.Num)
+		d.value(ChangeBox, nb.ID, "barcode", ob.Barcode, nb.Barcode)
+		d.value(ChangeBox, nb.ID, "price", ob.Price, nb.Price)
+		d.value(ChangeBox, nb.ID, "weight", ob.Weight, nb.Weight)
+		d.set(ChangeBoxItem, nb.ID, boxItems(ob), boxItems(nb))
+	}
+	for _, ob := range old.Boxes {
+		if !newBoxes[ob.ID] {
+			d.add(ChangeBox, ob.ID, "", fmt.Sprint(ob.Num), "")
+			d.set(ChangeBoxItem, ob.ID, boxItems(ob), nil)
+		}
+	}
+	return d.res
+}
+
+//boxItems box items keyed by order & alias
+func boxItems(b PackageBox) map[string]string {
+	res := make(map[string]string, len(b.Items))
+	for _, i := range b.Items {
+		res[fmt.Sprintf("%s/%s", i.OrderID, i.Alias)] = fmt.Sprintf("%s %d-%d", i.Type, i.From, i.To)
+	}
+	return res
+}
+
+type differ struct {
+	source    int
+	packageID int
+	res       []PackageChange
+}
+
+func (d *differ) add(entity, key, field, oldValue, newValue string) {
+	d.res = append(d.res, PackageChange{
+		Source:    d.source,
+		PackageID: d.packageID,
+		Entity:    entity,
+		Key:       key,
+		Field:     field,
+		OldValue:  oldValue,
+		NewValue:  newValue,
+	})
+}
+
+//value compares single value
+func (d *differ) value(entity, key, field string, oldValue, newValue interface{}) {
+	o, n := fmt.Sprint(oldValue), fmt.Sprint(newValue)
+	if o != n {
+		d.add(entity, key, field, o, n)
+	}
+}
+
+//set compares keyed values, key goes to field
+func (d *differ) set(entity, key string, old, new map[string]string) {
+	fields := make([]string, 0, len(old)+len(new))
+	for f := range old {
+		fields = append(fields, f)
+	}
+	for f := range new {
+		if _, ok := old[f]; !ok {
+			fields = append(fields, f)
+		}
+	}
+	sort.Strings(fields)
+	for _, f := range fields {
+		o, inOld := old[f]
+		n, inNew := new[f]
+		if inOld && inNew && o == n {
+			continue
+		}
+		d.add(entity, key, f, o, n)
+	}
+}
+
+//HasChanges checks if changes has entity (and key, if key is not empty)
+func HasChanges(changes []PackageChange, entity, key string) bool {
+	for _, c := range changes {
+		if c.Entity == entity && (key == "" || c.Key == key) {
+			return true
+		}
+	}
+	return false
+}
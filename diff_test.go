@@ -0,0 +1,50 @@
+package photocycle
+
+import "testing"
+
+func TestDiffPackage(t *testing.T) {
+	old := &Package{
+		Source: 8, ID: 100, DeliveryID: 1, OrdersNum: 2,
+		Properties: []PackageProperty{{Property: "phone", Value: "1"}, {Property: "city", Value: "Minsk"}},
+		Barcodes:   []PackageBarcode{{Barcode: "B1", BarcodeType: 2, BoxNumber: 1}},
+		Boxes: []PackageBox{
+			{ID: "8-1", Num: 1, Weight: 100, Items: []PackageBoxItem{{OrderID: "8_1", Alias: "a"}}},
+			{ID: "8-2", Num: 2, Items: []PackageBoxItem{{OrderID: "8_2", Alias: "a"}}},
+		},
+	}
+	new := &Package{
+		Source: 8, ID: 100, DeliveryID: 2, OrdersNum: 2,
+		Properties: []PackageProperty{{Property: "phone", Value: "2"}, {Property: "city", Value: "Minsk"}},
+		Barcodes:   []PackageBarcode{{Barcode: "B1", BarcodeType: 2, BoxNumber: 1}},
+		Boxes: []PackageBox{
+			{ID: "8-1", Num: 1, Weight: 200, Items: []PackageBoxItem{{OrderID: "8_1", Alias: "a"}, {OrderID: "8_3", Alias: "b"}}},
+			{ID: "8-4", Num: 2, Items: []PackageBoxItem{{OrderID: "8_2", Alias: "a"}}},
+		},
+	}
+	changes := DiffPackage(old, new)
+	expected := []PackageChange{
+		{Entity: ChangePackage, Field: "delivery_id", OldValue: "1", NewValue: "2"},
+		{Entity: ChangeProperty, Field: "phone", OldValue: "1", NewValue: "2"},
+		{Entity: ChangeBox, Key: "8-1", Field: "weight", OldValue: "100", NewValue: "200"},
+		{Entity: ChangeBoxItem, Key: "8-1", Field: "8_3/b", NewValue: " 0-0"},
+		{Entity: ChangeBox, Key: "8-4", NewValue: "2"},
+		{Entity: ChangeBoxItem, Key: "8-4", Field: "8_2/a", NewValue: " 0-0"},
+		{Entity: ChangeBox, Key: "8-2", OldValue: "2"},
+		{Entity: ChangeBoxItem, Key: "8-2", Field: "8_2/a", OldValue: " 0-0"},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("Expected %d changes, got %d: %+v", len(expected), len(changes), changes)
+	}
+	for i, e := range expected {
+		e.Source, e.PackageID = 8, 100
+		if changes[i] != e {
+			t.Errorf("Change %d: expected %+v, got %+v", i, e, changes[i])
+		}
+	}
+	if !HasChanges(changes, ChangeBoxItem, "8-1") || HasChanges(changes, ChangeBarcode, "") {
+		t.Error("HasChanges wrong result")
+	}
+	if len(DiffPackage(old, old)) != 0 {
+		t.Error("Expected no changes for same package")
+	}
+}
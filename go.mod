@@ -10,7 +10,7 @@ require (
 	github.com/kardianos/service v1.2.0
 	github.com/oklog/oklog v0.3.2
 	github.com/spf13/cast v1.3.1
-	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.7.1
 	golang.org/x/sys v0.0.0-20210616094352-59db8d763f22 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
@@ -4,12 +4,13 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"os"
 	"testing"
 )
 
 func TestGroupBoxes(t *testing.T) {
 	//http://fotokniga.by/api/?appkey=91b06dc1105454167c8aad18a96c4572&action=fk:get_group_boxes&id=43314
-	client, err := NewClient(http.DefaultClient, "http://fotokniga.by/", "91b06dc1105454167c8aad18a96c4572")
+	client, err := NewClient(http.DefaultClient, "http://fotokniga.by/", "91b06dc1105454167c8aad18a96c4572", "")
 	if err != nil {
 		t.Errorf("Error create client %q", err.Error())
 		return
@@ -21,7 +22,7 @@ func TestGroupBoxes(t *testing.T) {
 	}
 	fmt.Printf("Boxes:  %v\n", b)
 	//wrong url
-	client, err = NewClient(http.DefaultClient, "http://fotoknigGa.by/", "91b06dc1105454167c8aad18a96c4572")
+	client, err = NewClient(http.DefaultClient, "http://fotoknigGa.by/", "91b06dc1105454167c8aad18a96c4572", "")
 	if err != nil {
 		t.Errorf("Error create client %q", err.Error())
 		return
@@ -33,7 +34,7 @@ func TestGroupBoxes(t *testing.T) {
 	}
 	fmt.Printf("Error:  %v\n", err)
 	//wrong url
-	client, err = NewClient(http.DefaultClient, "http://fotoknigGa.by/", "91b06dc1105454167c8aad18a96c4572")
+	client, err = NewClient(http.DefaultClient, "http://fotoknigGa.by/", "91b06dc1105454167c8aad18a96c4572", "")
 	if err != nil {
 		t.Errorf("Error create client %q", err.Error())
 		return
@@ -45,7 +46,7 @@ func TestGroupBoxes(t *testing.T) {
 	}
 	fmt.Printf("Error:  %v\n", err)
 	//wrong key
-	client, err = NewClient(http.DefaultClient, "http://fotokniga.by/", "wrong_app_key")
+	client, err = NewClient(http.DefaultClient, "http://fotokniga.by/", "wrong_app_key", "")
 	if err != nil {
 		t.Errorf("Error create client %q", err.Error())
 		return
@@ -57,7 +58,7 @@ func TestGroupBoxes(t *testing.T) {
 	}
 	fmt.Printf("Error:  %v\n", err)
 	//wrong id
-	client, err = NewClient(http.DefaultClient, "http://fotokniga.by/", "91b06dc1105454167c8aad18a96c4572")
+	client, err = NewClient(http.DefaultClient, "http://fotokniga.by/", "91b06dc1105454167c8aad18a96c4572", "")
 	if err != nil {
 		t.Errorf("Error create client %q", err.Error())
 		return
@@ -72,7 +73,12 @@ func TestGroupBoxes(t *testing.T) {
 
 func TestGroup(t *testing.T) {
 	//https://fabrika-fotoknigi.ru/apiclient.php?cmd=group&args[number]=349141
-	client, err := NewClient(http.DefaultClient, "https://fabrika-fotoknigi.ru/", "")
+	//group api key from env PHOTOCYCLE_API_GROUPKEY
+	key := os.Getenv("PHOTOCYCLE_API_GROUPKEY")
+	if key == "" {
+		t.Skip("PHOTOCYCLE_API_GROUPKEY not set")
+	}
+	client, err := NewClient(http.DefaultClient, "https://fabrika-fotoknigi.ru/", "", key)
 	if err != nil {
 		t.Errorf("Error create client %q", err.Error())
 		return
@@ -84,7 +90,7 @@ func TestGroup(t *testing.T) {
 	}
 	fmt.Printf("Group:  %v\n", b)
 	//wrong url
-	client, err = NewClient(http.DefaultClient, "http://fotoknigGa.by/", "91b06dc1105454167c8aad18a96c4572")
+	client, err = NewClient(http.DefaultClient, "http://fotoknigGa.by/", "91b06dc1105454167c8aad18a96c4572", key)
 	if err != nil {
 		t.Errorf("Error create client %q", err.Error())
 		return
@@ -97,7 +103,7 @@ func TestGroup(t *testing.T) {
 	fmt.Printf("Error:  %v\n", err)
 
 	//wrong id
-	client, err = NewClient(http.DefaultClient, "https://fabrika-fotoknigi.ru/", "")
+	client, err = NewClient(http.DefaultClient, "https://fabrika-fotoknigi.ru/", "", key)
 	if err != nil {
 		t.Errorf("Error create client %q", err.Error())
 		return
@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"github.com/egorka-gh/photocycle"
 	"github.com/spf13/cast"
@@ -13,75 +15,101 @@ import (
 
 //CreateBuilder creates builder
 func CreateBuilder(rep photocycle.Repository) (*Builder, error) {
-	fm, err := rep.GetJSONMaps(context.Background())
+	m, err := loadMaps(context.Background(), rep)
 	if err != nil {
-		return nil, fmt.Errorf("error get JSONMaps from repository %q", err.Error())
-	}
-	dm, err := rep.GetDeliveryMaps(context.Background())
-	if err != nil {
-		return nil, fmt.Errorf("error get GetDeliveryMaps from repository %q", err.Error())
-	}
-	b := &Builder{
-		jmap:            fm,
-		deliveryMapping: dm,
+		return nil, err
 	}
+	b := &Builder{rep: rep}
+	b.maps.Store(m)
 	return b, nil
 }
 
 //Builder builds photocycle models by json keys from database
 type Builder struct {
-	//json keys map by family
-	jmap            map[int][]photocycle.JSONMap
-	deliveryMapping map[int]map[int]photocycle.DeliveryTypeMapping
+	rep photocycle.Repository
+	//current *builderMaps, swapped by Reload
+	maps atomic.Value
+}
+
+//current returns maps snapshot
+func (b *Builder) current() *builderMaps {
+	m, _ := b.maps.Load().(*builderMaps)
+	if m == nil {
+		return &builderMaps{}
+	}
+	return m
 }
 
-//BuildPackage builds photocycle.Package from raw
-func (b *Builder) BuildPackage(source int, raw map[string]interface{}) (*photocycle.Package, error) {
+//Warning not fatal problem found while building package
+type Warning struct {
+	Code    string
+	Field   string
+	Value   interface{}
+	Message string
+}
+
+//build warnings codes
+const (
+	//WarnDeliveryUnmapped site delivery id has no delivery_type_dictionary mapping
+	WarnDeliveryUnmapped = "delivery_unmapped"
+)
+
+//HasWarning checks if warnings contain code
+func HasWarning(warnings []Warning, code string) bool {
+	for _, w := range warnings {
+		if w.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+//BuildPackage builds photocycle.Package from raw, returns not fatal problems as warnings
+func (b *Builder) BuildPackage(source int, raw map[string]interface{}) (*photocycle.Package, []Warning, error) {
 	res := &photocycle.Package{}
-	fields, ok := b.jmap[5]
+	warnings := make([]Warning, 0)
+	m := b.current()
+	fields, ok := m.jmap[5]
 	if !ok {
-		return res, errors.New("buider init error, has no fields for family 5")
+		return res, warnings, errors.New("buider init error, has no fields for family 5")
 	}
 	//create & fill json vs object fields
-	jm := make(map[string]interface{})
-	for _, f := range fields {
-		v, ok := deepSearch(raw, f.JSONKey)
-		if !ok {
-			continue
-		}
-		jm[f.Field] = v
+	jm, err := m.mapFields(raw, fields)
+	if err != nil {
+		return nil, warnings, err
 	}
 	j, _ := json.Marshal(jm)
 	//fill target struct
-	err := json.Unmarshal(j, res)
+	err = json.Unmarshal(j, res)
 	if err != nil {
-		return nil, err
+		return nil, warnings, err
 	}
 	res.Source = source
 	//map site delivery id to photocycle id
 	//translate delivery id
-	m, ok := b.deliveryMapping[source]
-	if ok {
-		dm, ok := m[res.NativeDeliveryID]
-		if ok {
-			res.DeliveryID = dm.DeliveryType
-		}
+	if dm, ok := m.deliveryMapping[source][res.NativeDeliveryID]; ok {
+		res.DeliveryID = dm.DeliveryType
+	} else {
+		warnings = append(warnings, Warning{
+			Code:    WarnDeliveryUnmapped,
+			Field:   "delivery_id",
+			Value:   res.NativeDeliveryID,
+			Message: fmt.Sprintf("source %d site delivery %d (%s) has no delivery type mapping", source, res.NativeDeliveryID, res.DeliveryName),
+		})
 	}
-	//TODO count orders num?
 	//build prorerties
-	fields, ok = b.jmap[6]
+	fields, ok = m.jmap[6]
 	if !ok {
-		return res, errors.New("buider init error, has no fields for family 6")
+		return res, warnings, errors.New("buider init error, has no fields for family 6")
 	}
 	props := make([]photocycle.PackageProperty, 0, len(fields))
 	for _, f := range fields {
-		v, ok := deepSearch(raw, f.JSONKey)
+		v, ok, err := m.value(raw, f)
+		if err != nil {
+			return nil, warnings, err
+		}
 		if !ok {
-			if f.Field == "debt_sum" {
-				v = "0"
-			} else {
-				continue
-			}
+			continue
 		}
 		if v == "" {
 			continue
@@ -90,83 +118,440 @@ func (b *Builder) BuildPackage(source int, raw map[string]interface{}) (*photocy
 		p.Source = source
 		p.PackageID = res.ID
 		p.Property = f.Field
-		p.Value = cast.ToString(v)
+		p.Value = toString(v)
 		props = append(props, p)
 	}
 	res.Properties = props
 
 	//build barcodes
 	bars := make([]photocycle.PackageBarcode, 0)
-	v, ok := raw["boxes"]
-	if ok {
-		arr, ok := v.([]interface{})
-		if ok {
-			for _, im := range arr {
-				m, ok := im.(map[string]interface{})
-				if ok {
-					barcode := cast.ToString(m["barcode"])
-					if barcode != "" {
-						b := photocycle.PackageBarcode{}
-						b.Source = source
-						b.PackageID = res.ID
-						b.BarcodeType = 2
-						b.Barcode = barcode
-						b.BoxNumber = cast.ToInt(m["number"])
-						bars = append(bars, b)
-					}
-				}
+	for _, bs := range barcodeSources {
+		for _, e := range elements(raw, bs.path) {
+			barcode := cast.ToString(e["barcode"])
+			if barcode == "" {
+				continue
 			}
+			bars = append(bars, photocycle.PackageBarcode{
+				Source:      source,
+				PackageID:   res.ID,
+				BarcodeType: bs.barcodeType,
+				Barcode:     barcode,
+				BoxNumber:   cast.ToInt(e["number"]),
+			})
 		}
 	}
-	v, ok = raw["barcodes"]
-	if ok {
-		arr, ok := v.([]interface{})
-		if ok {
-			for _, im := range arr {
-				m, ok := im.(map[string]interface{})
-				if ok {
-					barcode := cast.ToString(m["barcode"])
-					if barcode != "" {
-						b := photocycle.PackageBarcode{}
-						b.Source = source
-						b.PackageID = res.ID
-						b.BarcodeType = 1
-						b.Barcode = barcode
-						b.BoxNumber = cast.ToInt(m["number"])
-						bars = append(bars, b)
-					}
-				}
+	res.Barcodes = bars
+
+	//build boxes (used if site has no get_group_boxes)
+	res.Boxes, err = m.buildBoxes(source, res.ID, raw)
+	if err != nil {
+		return nil, warnings, err
+	}
+	if n := res.CountOrders(); n > res.OrdersNum {
+		res.OrdersNum = n
+	}
+
+	return res, warnings, nil
+}
+
+//ApplyBoxes sets package boxes from get_group_boxes (if any) and recounts package orders
+func ApplyBoxes(p *photocycle.Package, gbs *GroupBoxes) {
+	if gbs != nil && len(gbs.Boxes) > 0 {
+		p.Boxes = BuildBoxes(p.Source, p.ID, gbs)
+	}
+	if n := p.CountOrders(); n > p.OrdersNum {
+		p.OrdersNum = n
+	}
+}
+
+//CheckOrders checks box items orders in database, fills package issues for unknown or canceled orders
+func (b *Builder) CheckOrders(ctx context.Context, p *photocycle.Package) error {
+	ids := make([]string, 0)
+	for _, bx := range p.Boxes {
+		for _, i := range bx.Items {
+			ids = append(ids, i.OrderID)
+		}
+	}
+	states, err := b.rep.GetOrderStates(ctx, ids)
+	if err != nil {
+		return err
+	}
+	p.Issues = make([]photocycle.PackageItemIssue, 0)
+	for _, bx := range p.Boxes {
+		for _, i := range bx.Items {
+			issue := ""
+			state, ok := states[i.OrderID]
+			if !ok {
+				issue = photocycle.IssueOrderUnknown
+			} else if photocycle.IsCanceled(state) {
+				issue = photocycle.IssueOrderCanceled
+			}
+			if issue == "" {
+				continue
 			}
+			p.Issues = append(p.Issues, photocycle.PackageItemIssue{
+				Source:    p.Source,
+				PackageID: p.ID,
+				BoxID:     bx.ID,
+				OrderID:   i.OrderID,
+				Issue:     issue,
+				State:     state,
+			})
 		}
 	}
+	return nil
+}
 
-	res.Barcodes = bars
+//barcodeSources json paths of package barcodes by barcode type
+var barcodeSources = []struct {
+	path        string
+	barcodeType int
+}{
+	{"boxes[*]", 2},
+	{"barcodes[*]", 1},
+}
+
+//json map families for boxes built from group payload
+const (
+	//familyBox box fields, json keys relative to element of group boxes array
+	familyBox = 7
+	//familyBoxItem box item fields, json keys relative to element of box orders array
+	familyBoxItem = 8
+)
 
+//default list paths, can be set by json map row with list flag
+const (
+	boxesPath    = "boxes[*]"
+	boxItemsPath = "orders[*]"
+)
+
+//splitList separates list row (json key of list elements) from fields
+func splitList(fields []photocycle.JSONMap, def string) ([]photocycle.JSONMap, string) {
+	res := make([]photocycle.JSONMap, 0, len(fields))
+	for _, f := range fields {
+		if f.IsList {
+			def = f.JSONKey
+			continue
+		}
+		res = append(res, f)
+	}
+	return res, def
+}
+
+//elements returns list elements (objects) found by path
+func elements(raw map[string]interface{}, path string) []map[string]interface{} {
+	//path can point to array itself or select its elements
+	v, ok := deepSearch(raw, path)
+	if !ok {
+		return nil
+	}
+	return toMaps(v)
+}
+
+//buildBoxes builds package boxes from group payload by json map families 7 (box) and 8 (box item)
+func (m *builderMaps) buildBoxes(source, packageID int, raw map[string]interface{}) ([]photocycle.PackageBox, error) {
+	res := make([]photocycle.PackageBox, 0)
+	fields, ok := m.jmap[familyBox]
+	if !ok {
+		//boxes not mapped
+		return res, nil
+	}
+	fields, boxesKey := splitList(fields, boxesPath)
+	itemFields, itemsKey := splitList(m.jmap[familyBoxItem], boxItemsPath)
+	for _, rb := range elements(raw, boxesKey) {
+		jm, err := m.mapFields(rb, fields)
+		if err != nil {
+			return nil, err
+		}
+		bx := photocycle.PackageBox{
+			Source:    source,
+			PackageID: packageID,
+			Num:       cast.ToInt(jm["box_num"]),
+			Barcode:   cast.ToString(jm["barcode"]),
+			Price:     cast.ToFloat64(jm["price"]),
+			Weight:    cast.ToInt(jm["weight"]),
+		}
+		if id := cast.ToString(jm["box_id"]); id != "" {
+			bx.ID = fmt.Sprintf("%d-%s", source, id)
+		} else {
+			//site box id not set, use number in package
+			bx.ID = fmt.Sprintf("%d-%d-%d", source, packageID, bx.Num)
+		}
+		items := elements(rb, itemsKey)
+		bx.Items = make([]photocycle.PackageBoxItem, 0, len(items))
+		for _, ri := range items {
+			im, err := m.mapFields(ri, itemFields)
+			if err != nil {
+				return nil, err
+			}
+			orderID := cast.ToString(im["order_id"])
+			if orderID == "" {
+				continue
+			}
+			bx.Items = append(bx.Items, photocycle.PackageBoxItem{
+				BoxID:   bx.ID,
+				OrderID: fmt.Sprintf("%d_%s", source, orderID),
+				Alias:   cast.ToString(im["alias"]),
+				Type:    cast.ToString(im["type"]),
+				From:    cast.ToInt(im["item_from"]),
+				To:      cast.ToInt(im["item_to"]),
+			})
+		}
+		res = append(res, bx)
+	}
 	return res, nil
 }
 
+//mapFields returns values found by json keys, keyed by field
+func (m *builderMaps) mapFields(raw map[string]interface{}, fields []photocycle.JSONMap) (map[string]interface{}, error) {
+	jm := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		v, ok, err := m.value(raw, f)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		jm[f.Field] = v
+	}
+	return jm, nil
+}
+
+//value finds value by json key and applies field transform.
+//if json key selects several values (has * or filter) list field gets all of them, not list field gets first one
+func (m *builderMaps) value(raw map[string]interface{}, f photocycle.JSONMap) (interface{}, bool, error) {
+	t, hasTransform := m.transforms[f.Transform]
+	var v interface{}
+	var ok, multi bool
+	if hasTransform && len(t.Concat) > 0 {
+		v, ok = t.concat(raw)
+	} else {
+		v, ok, multi = search(raw, f.JSONKey)
+	}
+	if multi && !f.IsList {
+		list := v.([]interface{})
+		v, ok, multi = nil, false, false
+		if len(list) > 0 {
+			v, ok = list[0], true
+		}
+	}
+	if !hasTransform {
+		return v, ok, nil
+	}
+	var err error
+	if multi {
+		list := v.([]interface{})
+		res := make([]interface{}, 0, len(list))
+		for _, e := range list {
+			e, err = t.apply(e)
+			if err != nil {
+				break
+			}
+			res = append(res, e)
+		}
+		v = res
+	} else {
+		v, ok, err = t.finish(v, ok)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("field %s (%s): %s", f.Field, f.JSONKey, err.Error())
+	}
+	return v, ok, nil
+}
+
+//toMaps converts json array of objects, skips not object elements
+func toMaps(v interface{}) []map[string]interface{} {
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	res := make([]map[string]interface{}, 0, len(arr))
+	for _, im := range arr {
+		if m, ok := im.(map[string]interface{}); ok {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+//BuildBoxes converts site boxes (get_group_boxes) to photocycle boxes
+func BuildBoxes(source, packageID int, gbs *GroupBoxes) []photocycle.PackageBox {
+	res := make([]photocycle.PackageBox, 0)
+	// can be nil if site not support boxes
+	if gbs == nil {
+		return res
+	}
+	for _, ba := range gbs.Boxes {
+		bg := photocycle.PackageBox{
+			Source:    source,
+			PackageID: packageID,
+			ID:        fmt.Sprintf("%d-%d", source, ba.ID),
+			Num:       ba.Number,
+			Barcode:   ba.Barcode,
+			Price:     ba.Price,
+			Weight:    ba.Weight,
+		}
+		bg.Items = make([]photocycle.PackageBoxItem, 0, len(ba.Items))
+		for _, bi := range ba.Items {
+			i := photocycle.PackageBoxItem{
+				BoxID:   bg.ID,
+				OrderID: fmt.Sprintf("%d_%d", source, bi.OrderID),
+				Alias:   bi.Alias,
+				Type:    bi.Type,
+				From:    bi.From,
+				To:      bi.To,
+			}
+			bg.Items = append(bg.Items, i)
+		}
+		res = append(res, bg)
+	}
+	return res
+}
+
+//MappedField json key vs model field, result of Trace
+type MappedField struct {
+	Family    int
+	JSONKey   string
+	Field     string
+	Transform string
+	Raw       interface{}
+	Value     interface{}
+	Found     bool
+	Err       error
+}
+
+//Trace lists package (5) and package properties (6) fields with raw values found by json keys
+func (b *Builder) Trace(raw map[string]interface{}) []MappedField {
+	res := make([]MappedField, 0)
+	m := b.current()
+	for _, family := range []int{5, 6} {
+		for _, f := range m.jmap[family] {
+			rv, _ := deepSearch(raw, f.JSONKey)
+			v, ok, err := m.value(raw, f)
+			res = append(res, MappedField{
+				Family:    family,
+				JSONKey:   f.JSONKey,
+				Field:     f.Field,
+				Transform: f.Transform,
+				Raw:       rv,
+				Value:     v,
+				Found:     ok,
+				Err:       err,
+			})
+		}
+	}
+	return res
+}
+
 // deepSearch scans deep maps,
-//following the key indexes point delemited
+//following the key indexes point delemited.
+//Key segment can select array elements:
 //
-// In case intermediate keys do not existreturns nil, false
+//	boxes[0].barcode         - element by index
+//	boxes[*].number          - all elements
+//	barcodes[type=2].barcode - elements with field value
+//
+// If key has * or filter, result is []interface{} of all found values.
+// In case intermediate keys do not exist returns nil, false
 func deepSearch(m map[string]interface{}, key string) (interface{}, bool) {
-	path := strings.Split(key, ".")
-	lastKey := path[len(path)-1]
-	path = path[0 : len(path)-1]
-	for _, k := range path {
-		m2, ok := m[k]
-		if !ok {
-			// intermediate key does not exist
-			return nil, false
+	v, ok, _ := search(m, key)
+	return v, ok
+}
+
+//search implements deepSearch, multi is true if key has * or filter
+func search(m map[string]interface{}, key string) (v interface{}, ok bool, multi bool) {
+	cur := []interface{}{m}
+	for _, seg := range splitPath(key) {
+		name, selectors := parseSegment(seg)
+		next := make([]interface{}, 0, len(cur))
+		for _, c := range cur {
+			cm, ok := c.(map[string]interface{})
+			if !ok {
+				// intermediate key is a value
+				continue
+			}
+			v, ok := cm[name]
+			if !ok {
+				// key does not exist
+				continue
+			}
+			vals := []interface{}{v}
+			for _, sel := range selectors {
+				if sel == "*" || strings.Contains(sel, "=") {
+					multi = true
+				}
+				vals = selectElements(vals, sel)
+			}
+			next = append(next, vals...)
 		}
-		m3, ok := m2.(map[string]interface{})
+		cur = next
+	}
+	if multi {
+		return cur, len(cur) > 0, true
+	}
+	if len(cur) == 0 {
+		return nil, false, false
+	}
+	return cur[0], true, false
+}
+
+//selectElements applies array selector (index, * or key=value) to each value
+func selectElements(vals []interface{}, sel string) []interface{} {
+	res := make([]interface{}, 0, len(vals))
+	for _, v := range vals {
+		arr, ok := v.([]interface{})
 		if !ok {
-			// intermediate key is a value
-			return nil, false
+			continue
+		}
+		switch {
+		case sel == "*":
+			res = append(res, arr...)
+		case strings.Contains(sel, "="):
+			kv := strings.SplitN(sel, "=", 2)
+			for _, e := range arr {
+				em, ok := e.(map[string]interface{})
+				if ok && cast.ToString(em[kv[0]]) == kv[1] {
+					res = append(res, e)
+				}
+			}
+		default:
+			i, err := strconv.Atoi(sel)
+			if err == nil && i >= 0 && i < len(arr) {
+				res = append(res, arr[i])
+			}
 		}
-		// continue search from here
-		m = m3
 	}
-	v, ok := m[lastKey]
-	return v, ok
+	return res
+}
+
+//splitPath splits key by points outside brackets
+func splitPath(key string) []string {
+	res := make([]string, 0, strings.Count(key, ".")+1)
+	depth, start := 0, 0
+	for i, r := range key {
+		switch r {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case '.':
+			if depth == 0 {
+				res = append(res, key[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(res, key[start:])
+}
+
+//parseSegment splits key segment to map key and array selectors: a[0][*] -> a, [0, *]
+func parseSegment(seg string) (string, []string) {
+	i := strings.Index(seg, "[")
+	if i < 0 || !strings.HasSuffix(seg, "]") {
+		return seg, nil
+	}
+	name := seg[:i]
+	selectors := strings.Split(seg[i+1:len(seg)-1], "][")
+	return name, selectors
 }
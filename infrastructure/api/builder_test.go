@@ -2,8 +2,11 @@ package api
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"testing"
 
 	"github.com/egorka-gh/photocycle"
@@ -18,7 +21,7 @@ func TestBuildPackage(t *testing.T) {
 		return
 	}
 	//http://fotokniga.by/apiclient.php?cmd=group&args[number]=44059
-	client, err := NewClient(http.DefaultClient, "http://fotokniga.by/", "")
+	client, err := NewClient(http.DefaultClient, "http://fotokniga.by/", "", os.Getenv("PHOTOCYCLE_API_GROUPKEY"))
 	if err != nil {
 		t.Errorf("Error create client %q", err.Error())
 		return
@@ -35,7 +38,7 @@ func TestBuildPackage(t *testing.T) {
 		t.Errorf("Error create builder  %q", err.Error())
 		return
 	}
-	p, err := builder.BuildPackage(8, g)
+	p, _, err := builder.BuildPackage(8, g)
 	if err != nil {
 		t.Errorf("Error build package  %q", err.Error())
 		return
@@ -45,3 +48,266 @@ func TestBuildPackage(t *testing.T) {
 	rep.PackageAddWithBoxes(context.Background(), ps)
 
 }
+
+func TestBuildPackageBoxes(t *testing.T) {
+	b := testBuilder(t, &mapsRepo{jmap: map[int][]photocycle.JSONMap{
+		5: {{JSONKey: "id", Field: "id"}},
+		6: {},
+		7: {
+			{JSONKey: "number", Field: "box_num"},
+			{JSONKey: "barcode", Field: "barcode"},
+			{JSONKey: "weight", Field: "weight"},
+		},
+		8: {
+			{JSONKey: "id", Field: "order_id"},
+			{JSONKey: "alias", Field: "alias"},
+		},
+	}})
+	raw := map[string]interface{}{
+		"id": 100.0,
+		"boxes": []interface{}{
+			map[string]interface{}{
+				"number":  1.0,
+				"barcode": "B1",
+				"weight":  500.0,
+				"orders": []interface{}{
+					map[string]interface{}{"id": 501.0, "alias": "book"},
+					map[string]interface{}{"alias": "no id"},
+				},
+			},
+			"not a box",
+		},
+	}
+	p, _, err := b.BuildPackage(8, raw)
+	if err != nil {
+		t.Fatalf("Error build package %q", err.Error())
+	}
+	if len(p.Boxes) != 1 {
+		t.Fatalf("Expected 1 box, got %d", len(p.Boxes))
+	}
+	bx := p.Boxes[0]
+	if bx.ID != "8-100-1" || bx.Num != 1 || bx.Barcode != "B1" || bx.Weight != 500 || bx.PackageID != 100 {
+		t.Errorf("Wrong box %+v", bx)
+	}
+	if len(bx.Items) != 1 {
+		t.Fatalf("Expected 1 box item, got %d", len(bx.Items))
+	}
+	if it := bx.Items[0]; it.OrderID != "8_501" || it.BoxID != bx.ID || it.Alias != "book" {
+		t.Errorf("Wrong box item %+v", it)
+	}
+	if len(p.Barcodes) != 1 || p.Barcodes[0].Barcode != "B1" {
+		t.Errorf("Wrong barcodes %+v", p.Barcodes)
+	}
+}
+
+type statesRepo struct {
+	photocycle.Repository
+	states map[string]int
+}
+
+func (r *statesRepo) GetOrderStates(ctx context.Context, ids []string) (map[string]int, error) {
+	return r.states, nil
+}
+
+func TestCheckOrders(t *testing.T) {
+	b := &Builder{rep: &statesRepo{states: map[string]int{
+		"8_1": photocycle.StatePrint,
+		"8_2": photocycle.StateCanceled,
+	}}}
+	p := &photocycle.Package{Source: 8, ID: 100, Boxes: []photocycle.PackageBox{
+		{ID: "8-1", Items: []photocycle.PackageBoxItem{{OrderID: "8_1"}, {OrderID: "8_2"}}},
+		{ID: "8-2", Items: []photocycle.PackageBoxItem{{OrderID: "8_3"}, {OrderID: "8_1"}}},
+	}}
+	ApplyBoxes(p, nil)
+	if p.OrdersNum != 3 {
+		t.Errorf("Expected orders num 3, got %d", p.OrdersNum)
+	}
+	if err := b.CheckOrders(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Issues) != 2 {
+		t.Fatalf("Expected 2 issues, got %+v", p.Issues)
+	}
+	if i := p.Issues[0]; i.OrderID != "8_2" || i.Issue != photocycle.IssueOrderCanceled || i.BoxID != "8-1" {
+		t.Errorf("Wrong issue %+v", i)
+	}
+	if i := p.Issues[1]; i.OrderID != "8_3" || i.Issue != photocycle.IssueOrderUnknown || i.BoxID != "8-2" {
+		t.Errorf("Wrong issue %+v", i)
+	}
+}
+
+// mapsRepo serves json and delivery maps
+type mapsRepo struct {
+	photocycle.Repository
+	jmap    map[int][]photocycle.JSONMap
+	dmap    map[int]map[int]photocycle.DeliveryTypeMapping
+	aliases map[string]photocycle.Alias
+	err     error
+}
+
+func (r *mapsRepo) GetJSONMaps(ctx context.Context) (map[int][]photocycle.JSONMap, error) {
+	return r.jmap, r.err
+}
+
+func (r *mapsRepo) GetDeliveryMaps(ctx context.Context) (map[int]map[int]photocycle.DeliveryTypeMapping, error) {
+	return r.dmap, r.err
+}
+
+func (r *mapsRepo) LoadAlias(ctx context.Context, alias string) (photocycle.Alias, error) {
+	a, ok := r.aliases[alias]
+	if !ok {
+		return a, sql.ErrNoRows
+	}
+	return a, nil
+}
+
+func testBuilder(t *testing.T, r *mapsRepo) *Builder {
+	b, err := CreateBuilder(r)
+	if err != nil {
+		t.Fatalf("CreateBuilder error %q", err.Error())
+	}
+	return b
+}
+
+func TestReload(t *testing.T) {
+	r := &mapsRepo{
+		jmap: map[int][]photocycle.JSONMap{
+			5: {{Family: 5, AttrType: 501, JSONKey: "id", Field: "id"}},
+		},
+		dmap: map[int]map[int]photocycle.DeliveryTypeMapping{
+			8: {1: {Source: 8, SiteID: 1, DeliveryType: 10}},
+		},
+	}
+	b := testBuilder(t, r)
+	r.jmap = map[int][]photocycle.JSONMap{
+		5: {
+			{Family: 5, AttrType: 501, JSONKey: "group_id", Field: "id"},
+			{Family: 5, AttrType: 502, JSONKey: "number", Field: "number"},
+		},
+	}
+	r.dmap = map[int]map[int]photocycle.DeliveryTypeMapping{
+		8: {1: {Source: 8, SiteID: 1, DeliveryType: 10}},
+	}
+	changes, err := b.Reload(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Errorf("expected 2 changes, got %v", changes)
+	}
+	p, _, _ := b.BuildPackage(8, map[string]interface{}{"group_id": 5.0, "number": "A5"})
+	if p.ID != 5 || p.IDName != "A5" {
+		t.Errorf("new map not applied %+v", p)
+	}
+
+	//broken reload keeps previous maps
+	r.err = errors.New("db is down")
+	if _, err = b.Reload(context.Background()); err == nil {
+		t.Error("expected reload error")
+	}
+	r.err = nil
+	r.jmap[5][0].Transform = "{broken"
+	if _, err = b.Reload(context.Background()); err == nil {
+		t.Error("expected transform compile error")
+	}
+	p, _, _ = b.BuildPackage(8, map[string]interface{}{"group_id": 6.0})
+	if p.ID != 6 {
+		t.Errorf("previous map lost %+v", p)
+	}
+}
+
+func TestDeepSearch(t *testing.T) {
+	raw := map[string]interface{}{
+		"client": map[string]interface{}{"name": "ivan"},
+		"boxes": []interface{}{
+			map[string]interface{}{"number": 1.0, "barcode": "b1", "type": "box"},
+			map[string]interface{}{"number": 2.0, "barcode": "b2", "type": "pack"},
+		},
+		"matrix": []interface{}{[]interface{}{"a", "b"}, []interface{}{"c"}},
+	}
+	cases := []struct {
+		key   string
+		want  string
+		found bool
+	}{
+		{"client.name", "ivan", true},
+		{"client.phone", "", false},
+		{"boxes[1].barcode", "b2", true},
+		{"boxes[2].barcode", "", false},
+		{"boxes[*].barcode", "[b1 b2]", true},
+		{"boxes[type=pack].number", "[2]", true},
+		{"boxes[type=none].number", "", false},
+		{"matrix[*][0]", "[a c]", true},
+		{"matrix[0][x]", "", false},
+	}
+	for _, c := range cases {
+		v, ok := deepSearch(raw, c.key)
+		if ok != c.found {
+			t.Errorf("%s: expected found %v, got %v", c.key, c.found, ok)
+			continue
+		}
+		if ok && fmt.Sprint(v) != c.want {
+			t.Errorf("%s: expected %s, got %v", c.key, c.want, v)
+		}
+	}
+}
+
+func TestBuildPackageListField(t *testing.T) {
+	b := testBuilder(t, &mapsRepo{jmap: map[int][]photocycle.JSONMap{
+		5: {{Family: 5, JSONKey: "id", Field: "id"}},
+		6: {
+			{Family: 6, JSONKey: "boxes[*].barcode", Field: "all_barcodes", IsList: true},
+			{Family: 6, JSONKey: "boxes[*].barcode", Field: "first_barcode"},
+		},
+	}})
+	raw := map[string]interface{}{
+		"id": 10.0,
+		"boxes": []interface{}{
+			map[string]interface{}{"number": 1.0, "barcode": "b1"},
+			map[string]interface{}{"number": 2.0, "barcode": "b2"},
+		},
+	}
+	p, _, err := b.BuildPackage(1, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	props := map[string]string{}
+	for _, pr := range p.Properties {
+		props[pr.Property] = pr.Value
+	}
+	if props["all_barcodes"] != "b1, b2" || props["first_barcode"] != "b1" {
+		t.Errorf("unexpected properties %v", props)
+	}
+	if len(p.Barcodes) != 2 || p.Barcodes[1].BoxNumber != 2 {
+		t.Errorf("unexpected barcodes %+v", p.Barcodes)
+	}
+}
+
+func TestBuildPackageDeliveryUnmapped(t *testing.T) {
+	b := testBuilder(t, &mapsRepo{
+		jmap: map[int][]photocycle.JSONMap{
+			5: {
+				{Family: 5, JSONKey: "id", Field: "id"},
+				{Family: 5, JSONKey: "delivery_id", Field: "native_delivery_id"},
+			},
+			6: {},
+		},
+		dmap: map[int]map[int]photocycle.DeliveryTypeMapping{
+			8: {1: {Source: 8, SiteID: 1, DeliveryType: 10}},
+		},
+	})
+	p, warnings, err := b.BuildPackage(8, map[string]interface{}{"id": 1.0, "delivery_id": 1.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.DeliveryID != 10 || len(warnings) != 0 {
+		t.Errorf("expected delivery 10 without warnings, got %d %v", p.DeliveryID, warnings)
+	}
+	p, warnings, err = b.BuildPackage(8, map[string]interface{}{"id": 2.0, "delivery_id": 2.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.DeliveryID != 0 || !HasWarning(warnings, WarnDeliveryUnmapped) {
+		t.Errorf("expected unmapped delivery warning, got %d %v", p.DeliveryID, warnings)
+	}
+}
@@ -7,13 +7,20 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+
+	"github.com/egorka-gh/photocycle/tracing"
 )
 
+//ErrNotFound site has no requested object
+var ErrNotFound = errors.New("not found on site")
+
 // Client represent Service backed by an HTTP server living at the remote instance.
 type Client struct {
 	BaseURL   *url.URL
 	UserAgent string
 	AppKey    string
+	//GroupKey group api key, group api has own key
+	GroupKey string
 
 	httpClient *http.Client
 	calls      int
@@ -21,8 +28,9 @@ type Client struct {
 	broken     bool
 }
 
-//NewClient creates Service backed by an HTTP server living at the remote instance
-func NewClient(httpClient *http.Client, baseURL, appKey string) (FFService, error) {
+//NewClient creates Service backed by an HTTP server living at the remote instance,
+//groupKey is used by GetGroup only
+func NewClient(httpClient *http.Client, baseURL, appKey, groupKey string) (FFService, error) {
 	u, err := url.Parse(baseURL)
 	if err != nil {
 		return nil, err
@@ -30,6 +38,7 @@ func NewClient(httpClient *http.Client, baseURL, appKey string) (FFService, erro
 	return &Client{
 		BaseURL:    u,
 		AppKey:     appKey,
+		GroupKey:   groupKey,
 		httpClient: httpClient,
 		//TODO hardcoded
 		callsLimit: 200,
@@ -41,7 +50,7 @@ func (c *Client) GetNPGroups(ctx context.Context, statuses []int, fromTS int64)
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	//https://fabrika-fotoknigi.ru/api/?appkey=e5ea49c386479f7c30f60e52e8b9107b&action=fk:get_groups_by_status_and_period&debug=1&status=40&start=1574334313
+	//https://fabrika-fotoknigi.ru/api/?appkey=<appkey>&action=fk:get_groups_by_status_and_period&debug=1&status=40&start=1574334313
 	data := url.Values{}
 	data.Set("action", "fk:get_groups_by_status_and_period")
 	data.Set("start", strconv.FormatInt(fromTS, 10))
@@ -69,8 +78,12 @@ func (c *Client) GetGroup(ctx context.Context, groupID int) (map[string]interfac
 	if ctx == nil {
 		ctx = context.Background()
 	}
+	//group api has own key
+	if c.GroupKey == "" {
+		return nil, errors.New("group api key not set")
+	}
 	data := url.Values{}
-	data.Set("appkey", "sp0oULbDnJfk7AjBNtVG")
+	data.Set("appkey", c.GroupKey)
 	data.Set("cmd", "group")
 	data.Set("args[number]", strconv.Itoa(groupID))
 	rq, err := c.newRequest(ctx, "POST", "api.php/", data)
@@ -93,6 +106,10 @@ func (c *Client) GetGroup(ctx context.Context, groupID int) (map[string]interfac
 	if !ok {
 		return raw, errors.New("empty or wrong responce")
 	}
+	if res == nil || res == false {
+		//site has no such group
+		return nil, ErrNotFound
+	}
 	raw, ok = res.(map[string]interface{})
 	if !ok {
 		return raw, errors.New("empty or wrong responce")
@@ -106,7 +123,7 @@ func (c *Client) GetBoxes(ctx context.Context, groupID int) (*GroupBoxes, error)
 		ctx = context.Background()
 	}
 
-	//http://fotokniga.by/api/?appkey=91b06dc1105454167c8aad18a96c4572&action=fk:get_group_boxes&id=43314
+	//http://fotokniga.by/api/?appkey=<appkey>&action=fk:get_group_boxes&id=43314
 	data := url.Values{}
 	data.Set("action", "fk:get_group_boxes")
 	data.Set("id", strconv.Itoa(groupID))
@@ -125,13 +142,53 @@ func (c *Client) GetBoxes(ctx context.Context, groupID int) (*GroupBoxes, error)
 	return res, err
 }
 
+//PushStatus implement Service
+func (c *Client) PushStatus(ctx context.Context, s StatusUpdate) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	data := url.Values{}
+	data.Set("action", "fk:set_status")
+	data.Set("group_id", strconv.Itoa(s.GroupID))
+	if s.OrderID != "" {
+		data.Set("order_id", s.OrderID)
+	}
+	data.Set("status", strconv.Itoa(s.Status))
+	data.Set("key", s.Key)
+	rq, err := c.newRequest(ctx, "POST", "api/", data)
+	if err != nil {
+		return err
+	}
+	rq.Header.Set("Idempotency-Key", s.Key)
+	res := &statusResult{}
+	r, err := c.do(rq, res)
+	if err != nil {
+		return err
+	}
+	if r.StatusCode != http.StatusOK {
+		return statusError(r.StatusCode)
+	}
+	if !res.Result {
+		if res.Error == "" {
+			res.Error = "status not accepted"
+		}
+		return errors.New(res.Error)
+	}
+	return nil
+}
+
 func (c *Client) newRequest(ctx context.Context, method, path string, data url.Values) (*http.Request, error) {
 	rel := &url.URL{Path: path}
 	u := c.BaseURL.ResolveReference(rel)
 	if data.Get("appkey") == "" {
 		data.Set("appkey", c.AppKey)
 	}
-	req, err := newRequest(ctx, method, u, data, true)
+	//keep action for span name
+	action := data.Get("action")
+	if action == "" {
+		action = data.Get("cmd")
+	}
+	req, err := newRequest(context.WithValue(ctx, actionKey{}, action), method, u, data, true)
 	if err != nil {
 		return nil, err
 	}
@@ -142,18 +199,23 @@ func (c *Client) newRequest(ctx context.Context, method, path string, data url.V
 	return req, nil
 }
 
+type actionKey struct{}
+
 //Active - not broken & not over calls limit
 func (c *Client) Active() bool {
 	return !c.broken && (c.callsLimit <= 0 || c.calls < c.callsLimit)
 }
 
-func (c *Client) do(req *http.Request, v interface{}) (*http.Response, error) {
+func (c *Client) do(req *http.Request, v interface{}) (resp *http.Response, err error) {
 	if !c.Active() {
 		return nil, errors.New("client is not active")
 	}
 	c.calls++
+	action, _ := req.Context().Value(actionKey{}).(string)
+	_, span := tracing.StartSpan(req.Context(), "api "+action, "host", req.URL.Host, "path", req.URL.Path)
+	defer func() { span.End(err) }()
 	ae := apiError{}
-	resp, err := do(c.httpClient, req, v, &ae)
+	resp, err = do(c.httpClient, req, v, &ae)
 	if _, ok := err.(transportError); ok {
 		c.broken = true
 	}
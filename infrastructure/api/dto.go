@@ -50,3 +50,17 @@ type NPBox struct {
 type Status struct {
 	Value int `json:"value"`
 }
+
+//StatusUpdate dto to push status to site, OrderID is empty for group status
+type StatusUpdate struct {
+	GroupID int
+	OrderID string
+	Status  int
+	Key     string
+}
+
+//statusResult push status responce
+type statusResult struct {
+	Result bool   `json:"result"`
+	Error  string `json:"error"`
+}
@@ -9,8 +9,6 @@ import (
 	"net/http/cookiejar"
 	"net/url"
 	"time"
-
-	"github.com/spf13/viper"
 )
 
 const apiPath string = "live/api/v5/"
@@ -24,9 +22,17 @@ type EFI struct {
 	client  *http.Client
 }
 
+//EFIConfig EFI api settings
+type EFIConfig struct {
+	URL  string
+	Key  string
+	User string
+	Pass string
+}
+
 //New init new EFI
-func NewEFI() (*EFI, error) {
-	us := viper.GetString("efi.url")
+func NewEFI(c EFIConfig) (*EFI, error) {
+	us := c.URL
 	if us == "" {
 		return nil, fmt.Errorf("initCheckPrinted error: efi.url not set")
 	}
@@ -36,15 +42,15 @@ func NewEFI() (*EFI, error) {
 	}
 	u = u.ResolveReference(&url.URL{Path: apiPath})
 
-	key := viper.GetString("efi.key")
+	key := c.Key
 	if key == "" {
 		return nil, fmt.Errorf("initCheckPrinted error: efi.key not set")
 	}
-	user := viper.GetString("efi.user")
+	user := c.User
 	if user == "" {
 		return nil, fmt.Errorf("initCheckPrinted error: efi.user not set")
 	}
-	pass := viper.GetString("efi.pass")
+	pass := c.Pass
 	if pass == "" {
 		return nil, fmt.Errorf("initCheckPrinted error: efi.pass not set")
 	}
@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+
+	"github.com/egorka-gh/photocycle/tracing"
 )
 
 func newRequest(ctx context.Context, method string, endpoint *url.URL, data url.Values, unescape bool) (*http.Request, error) {
@@ -38,6 +40,7 @@ func newRequest(ctx context.Context, method string, endpoint *url.URL, data url.
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	}
 	req.Header.Set("Accept", "application/json")
+	tracing.SetHeaders(ctx, req.Header)
 
 	return req, nil
 }
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/egorka-gh/photocycle"
+)
+
+//builderMaps json and delivery maps used by Builder, never changed after load
+type builderMaps struct {
+	//json keys map by family
+	jmap map[int][]photocycle.JSONMap
+	//compiled json map transforms by spec
+	transforms      map[string]*transform
+	deliveryMapping map[int]map[int]photocycle.DeliveryTypeMapping
+}
+
+//loadMaps loads and compiles maps from repository
+func loadMaps(ctx context.Context, rep photocycle.Repository) (*builderMaps, error) {
+	fm, err := rep.GetJSONMaps(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error get JSONMaps from repository %q", err.Error())
+	}
+	dm, err := rep.GetDeliveryMaps(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error get GetDeliveryMaps from repository %q", err.Error())
+	}
+	return newMaps(fm, dm)
+}
+
+func newMaps(fm map[int][]photocycle.JSONMap, dm map[int]map[int]photocycle.DeliveryTypeMapping) (*builderMaps, error) {
+	tm, err := compileTransforms(fm)
+	if err != nil {
+		return nil, err
+	}
+	return &builderMaps{
+		jmap:            fm,
+		transforms:      tm,
+		deliveryMapping: dm,
+	}, nil
+}
+
+//Reload reloads json and delivery maps from repository and swaps them atomically.
+//returns list of changes; on error builder keeps previous maps
+func (b *Builder) Reload(ctx context.Context) ([]string, error) {
+	m, err := loadMaps(ctx, b.rep)
+	if err != nil {
+		return nil, err
+	}
+	changes := diffMaps(b.current(), m)
+	b.maps.Store(m)
+	return changes, nil
+}
+
+//diffMaps describes json map rows and delivery mappings added, removed or changed
+func diffMaps(old, new *builderMaps) []string {
+	res := make([]string, 0)
+	oj, nj := jsonMapRows(old.jmap), jsonMapRows(new.jmap)
+	for _, k := range sortedKeys(oj, nj) {
+		o, inOld := oj[k]
+		n, inNew := nj[k]
+		switch {
+		case !inOld:
+			res = append(res, fmt.Sprintf("json map added %s: %s", k, n))
+		case !inNew:
+			res = append(res, fmt.Sprintf("json map removed %s: %s", k, o))
+		case o != n:
+			res = append(res, fmt.Sprintf("json map changed %s: %s -> %s", k, o, n))
+		}
+	}
+	od, nd := deliveryRows(old.deliveryMapping), deliveryRows(new.deliveryMapping)
+	for _, k := range sortedKeys(od, nd) {
+		o, inOld := od[k]
+		n, inNew := nd[k]
+		switch {
+		case !inOld:
+			res = append(res, fmt.Sprintf("delivery map added %s: %s", k, n))
+		case !inNew:
+			res = append(res, fmt.Sprintf("delivery map removed %s: %s", k, o))
+		case o != n:
+			res = append(res, fmt.Sprintf("delivery map changed %s: %s -> %s", k, o, n))
+		}
+	}
+	return res
+}
+
+//jsonMapRows json map rows as text keyed by family/attr type
+func jsonMapRows(jm map[int][]photocycle.JSONMap) map[string]string {
+	res := make(map[string]string)
+	for family, fields := range jm {
+		for _, f := range fields {
+			k := fmt.Sprintf("family %d attr %d src %d", family, f.AttrType, f.SrcType)
+			res[k] = fmt.Sprintf("key=%s field=%s list=%v transform=%s", f.JSONKey, f.Field, f.IsList, f.Transform)
+		}
+	}
+	return res
+}
+
+//deliveryRows delivery mappings as text keyed by source/site delivery id
+func deliveryRows(dm map[int]map[int]photocycle.DeliveryTypeMapping) map[string]string {
+	res := make(map[string]string)
+	for source, m := range dm {
+		for site, d := range m {
+			k := fmt.Sprintf("source %d site %d", source, site)
+			res[k] = fmt.Sprintf("delivery=%d send=%v", d.DeliveryType, d.SetSend)
+		}
+	}
+	return res
+}
+
+func sortedKeys(a, b map[string]string) []string {
+	res := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		res = append(res, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			res = append(res, k)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
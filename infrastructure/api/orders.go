@@ -0,0 +1,197 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/egorka-gh/photocycle"
+	"github.com/spf13/cast"
+)
+
+//json map families for orders built from group payload,
+//date fields (src_date, date_in) need date transform
+const (
+	//familyOrder order fields, json keys relative to element of group orders array
+	familyOrder = 9
+	//familyExtraInfo order extra info fields, json keys relative to order element
+	familyExtraInfo = 10
+	//familyPrintGroup print group fields, json keys relative to element of order items array
+	familyPrintGroup = 11
+	//familyPrintGroupFile print group file fields, json keys relative to element of item files array
+	familyPrintGroupFile = 12
+)
+
+//default list paths, can be set by json map row with list flag
+const (
+	ordersPath = "orders[*]"
+	itemsPath  = "items[*]"
+	filesPath  = "files[*]"
+)
+
+//build warnings codes
+const (
+	//WarnAliasUnknown print group alias not found in book_synonym
+	WarnAliasUnknown = "alias_unknown"
+)
+
+//BuildOrders builds group orders with extra info, print groups and files from raw,
+//print groups book type is set by book_synonym alias
+func (b *Builder) BuildOrders(ctx context.Context, source, groupID int, raw map[string]interface{}) ([]photocycle.Order, []Warning, error) {
+	warnings := make([]Warning, 0)
+	m := b.current()
+	fields, ok := m.jmap[familyOrder]
+	if !ok {
+		return nil, warnings, fmt.Errorf("buider init error, has no fields for family %d", familyOrder)
+	}
+	fields, path := splitList(fields, ordersPath)
+	xFields, _ := splitList(m.jmap[familyExtraInfo], "")
+	pgFields, pgPath := splitList(m.jmap[familyPrintGroup], itemsPath)
+	fFields, fPath := splitList(m.jmap[familyPrintGroupFile], filesPath)
+	//aliases cache
+	aliases := make(map[string]*photocycle.Alias)
+
+	res := make([]photocycle.Order, 0)
+	for _, ro := range elements(raw, path) {
+		o := photocycle.Order{}
+		if err := m.fill(ro, fields, &o); err != nil {
+			return nil, warnings, err
+		}
+		if o.SourceID == "" {
+			//no site id, skip
+			continue
+		}
+		o.ID = fmt.Sprintf("%d_%s", source, o.SourceID)
+		o.Source = source
+		o.GroupID = groupID
+		o.State = photocycle.StateLoadWaite
+
+		if len(xFields) > 0 {
+			if err := m.fill(ro, xFields, &o.ExtraInfo); err != nil {
+				return nil, warnings, err
+			}
+			o.ExtraInfo.ID = o.ID
+			o.ExtraInfo.GroupID = groupID
+		}
+
+		items := elements(ro, pgPath)
+		o.PrintGroups = make([]photocycle.PrintGroup, 0, len(items))
+		fotos := 0
+		for i, ri := range items {
+			pg := photocycle.PrintGroup{}
+			if err := m.fill(ri, pgFields, &pg); err != nil {
+				return nil, warnings, err
+			}
+			pg.ID = fmt.Sprintf("%s_%d", o.ID, i+1)
+			pg.OrderID = o.ID
+			pg.State = o.State
+			if pg.Alias != "" {
+				a, err := b.alias(ctx, aliases, pg.Alias)
+				if err != nil {
+					return nil, warnings, err
+				}
+				if a == nil {
+					warnings = append(warnings, Warning{
+						Code:    WarnAliasUnknown,
+						Field:   "alias",
+						Value:   pg.Alias,
+						Message: fmt.Sprintf("order %s alias %q not found in book_synonym", o.ID, pg.Alias),
+					})
+				} else {
+					pg.BookType = a.Type
+					o.HasCover = o.HasCover || a.HasCover
+				}
+			}
+
+			files := elements(ri, fPath)
+			pg.Files = make([]photocycle.PrintGroupFile, 0, len(files))
+			for _, rf := range files {
+				f := photocycle.PrintGroupFile{}
+				if err := m.fill(rf, fFields, &f); err != nil {
+					return nil, warnings, err
+				}
+				if f.FileName == "" {
+					continue
+				}
+				f.PrintGroupID = pg.ID
+				if f.PrintQtty == 0 {
+					f.PrintQtty = 1
+				}
+				pg.Files = append(pg.Files, f)
+			}
+			if pg.FileNum == 0 {
+				pg.FileNum = len(pg.Files)
+			}
+			fotos += pg.FileNum
+			o.PrintGroups = append(o.PrintGroups, pg)
+		}
+		if o.FotosNum == 0 {
+			o.FotosNum = fotos
+		}
+		res = append(res, o)
+	}
+	return res, warnings, nil
+}
+
+//fill maps raw by fields into target struct (by json tags)
+func (m *builderMaps) fill(raw map[string]interface{}, fields []photocycle.JSONMap, target interface{}) error {
+	jm, err := m.mapFields(raw, fields)
+	if err != nil {
+		return err
+	}
+	normalize(target, jm)
+	j, _ := json.Marshal(jm)
+	if err = json.Unmarshal(j, target); err != nil {
+		return fmt.Errorf("%T: %s", target, err.Error())
+	}
+	return nil
+}
+
+//normalize casts mapped values to kinds of target struct fields,
+//site sends ids as numbers or strings, numbers as strings etc
+func normalize(target interface{}, jm map[string]interface{}) {
+	t := reflect.TypeOf(target).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		v, ok := jm[name]
+		if !ok || v == nil {
+			continue
+		}
+		switch f.Type.Kind() {
+		case reflect.String:
+			jm[name] = toString(v)
+		case reflect.Int, reflect.Int64:
+			if n, err := parseNumber(v); err == nil {
+				jm[name] = int(n)
+			}
+		case reflect.Float32, reflect.Float64:
+			if n, err := parseNumber(v); err == nil {
+				jm[name] = n
+			}
+		case reflect.Bool:
+			jm[name] = cast.ToBool(v)
+		}
+	}
+}
+
+//alias loads book_synonym by alias, nil if not found
+func (b *Builder) alias(ctx context.Context, cache map[string]*photocycle.Alias, alias string) (*photocycle.Alias, error) {
+	alias = strings.TrimSpace(alias)
+	if a, ok := cache[alias]; ok {
+		return a, nil
+	}
+	a, err := b.rep.LoadAlias(ctx, alias)
+	if err == sql.ErrNoRows {
+		cache[alias] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("repository.LoadAlias error: %s", err.Error())
+	}
+	cache[alias] = &a
+	return &a, nil
+}
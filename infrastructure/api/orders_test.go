@@ -0,0 +1,93 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/egorka-gh/photocycle"
+)
+
+func TestBuildOrders(t *testing.T) {
+	b := testBuilder(t, &mapsRepo{
+		jmap: map[int][]photocycle.JSONMap{
+			9: {
+				{JSONKey: "projects[*]", Field: "orders", IsList: true},
+				{JSONKey: "id", Field: "src_id"},
+				{JSONKey: "created", Field: "src_date", Transform: `{"date":"2006-01-02 15:04:05"}`},
+			},
+			10: {
+				{JSONKey: "alias", Field: "calc_alias"},
+				{JSONKey: "books", Field: "books"},
+			},
+			11: {
+				{JSONKey: "alias", Field: "alias"},
+				{JSONKey: "width", Field: "width"},
+			},
+			12: {
+				{JSONKey: "name", Field: "file_name"},
+				{JSONKey: "qty", Field: "prt_qty"},
+			},
+		},
+		aliases: map[string]photocycle.Alias{
+			"book20": {ID: 1, Alias: "book20", Type: 2, HasCover: true},
+		},
+	})
+	raw := map[string]interface{}{
+		"id": 100.0,
+		"projects": []interface{}{
+			map[string]interface{}{
+				"id":      501.0,
+				"created": "2021-03-05 10:20:00",
+				"alias":   "book20",
+				"books":   "3",
+				"items": []interface{}{
+					map[string]interface{}{
+						"alias": "book20",
+						"width": "203",
+						"files": []interface{}{
+							map[string]interface{}{"name": "001.jpg", "qty": 2.0},
+							map[string]interface{}{"name": "002.jpg"},
+							map[string]interface{}{"qty": 1.0},
+						},
+					},
+					map[string]interface{}{"alias": "unknown"},
+				},
+			},
+			map[string]interface{}{"created": "2021-03-05 10:20:00"},
+		},
+	}
+	orders, warnings, err := b.BuildOrders(context.Background(), 8, 100, raw)
+	if err != nil {
+		t.Fatalf("BuildOrders error %q", err.Error())
+	}
+	if len(orders) != 1 {
+		t.Fatalf("expected 1 order, got %d", len(orders))
+	}
+	o := orders[0]
+	if o.ID != "8_501" || o.GroupID != 100 || o.State != photocycle.StateLoadWaite || !o.HasCover {
+		t.Errorf("unexpected order %+v", o)
+	}
+	if !o.SourceDate.Equal(time.Date(2021, 3, 5, 10, 20, 0, 0, time.Local)) {
+		t.Errorf("unexpected src_date %v", o.SourceDate)
+	}
+	if o.ExtraInfo.ID != o.ID || o.ExtraInfo.Alias != "book20" || o.ExtraInfo.Books != 3 {
+		t.Errorf("unexpected extra info %+v", o.ExtraInfo)
+	}
+	if len(o.PrintGroups) != 2 {
+		t.Fatalf("expected 2 print groups, got %d", len(o.PrintGroups))
+	}
+	pg := o.PrintGroups[0]
+	if pg.ID != "8_501_1" || pg.BookType != 2 || pg.Width != 203 || pg.FileNum != 2 {
+		t.Errorf("unexpected print group %+v", pg)
+	}
+	if pg.Files[0].PrintGroupID != pg.ID || pg.Files[0].PrintQtty != 2 || pg.Files[1].PrintQtty != 1 {
+		t.Errorf("unexpected files %+v", pg.Files)
+	}
+	if o.FotosNum != 2 {
+		t.Errorf("expected 2 fotos, got %d", o.FotosNum)
+	}
+	if len(warnings) != 1 || warnings[0].Code != WarnAliasUnknown {
+		t.Errorf("expected unknown alias warning, got %v", warnings)
+	}
+}
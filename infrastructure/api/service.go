@@ -12,5 +12,7 @@ type FFService interface {
 	//common FF api
 	GetBoxes(ctx context.Context, groupID int) (*GroupBoxes, error)
 	GetGroup(ctx context.Context, groupID int) (map[string]interface{}, error)
+	//PushStatus sets group or order status on site, repeated push with same key is ignored by site
+	PushStatus(ctx context.Context, s StatusUpdate) error
 	Active() bool
 }
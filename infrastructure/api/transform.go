@@ -0,0 +1,183 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/egorka-gh/photocycle"
+	"github.com/spf13/cast"
+)
+
+//transform declarative value transform (attr_json_map.transform), json object like
+//
+//	{"concat": ["name", "surname"], "sep": " ", "default": "0", "trim": true, "case": "upper",
+//	 "enum": {"1": "курьер"}, "number": true, "date": "02.01.2006"}
+//
+//steps are applied in this order: concat (or json_key lookup), default, trim, case, enum, number, date
+type transform struct {
+	//Concat keys to join, json_key is ignored
+	Concat []string `json:"concat"`
+	//Sep concat separator
+	Sep string `json:"sep"`
+	//Default value if key not found or empty
+	Default interface{} `json:"default"`
+	Trim    bool        `json:"trim"`
+	//Case upper, lower or title
+	Case string `json:"case"`
+	//Enum lookup table, not found values are kept
+	Enum map[string]interface{} `json:"enum"`
+	//Number parses string number, allows spaces and comma as decimal separator
+	Number bool `json:"number"`
+	//Date parses string date by go layout, result is time.Time
+	Date string `json:"date"`
+}
+
+func parseTransform(spec string) (*transform, error) {
+	t := &transform{}
+	if err := json.Unmarshal([]byte(spec), t); err != nil {
+		return nil, fmt.Errorf("wrong transform %q: %s", spec, err.Error())
+	}
+	switch t.Case {
+	case "", "upper", "lower", "title":
+	default:
+		return nil, fmt.Errorf("wrong transform %q: unknown case %q", spec, t.Case)
+	}
+	return t, nil
+}
+
+//compileTransforms parses transforms of json maps, keyed by spec
+func compileTransforms(fm map[int][]photocycle.JSONMap) (map[string]*transform, error) {
+	res := make(map[string]*transform)
+	for _, fields := range fm {
+		for _, f := range fields {
+			if f.Transform == "" {
+				continue
+			}
+			if _, ok := res[f.Transform]; ok {
+				continue
+			}
+			t, err := parseTransform(f.Transform)
+			if err != nil {
+				return nil, fmt.Errorf("family %d field %s: %s", f.Family, f.Field, err.Error())
+			}
+			res[f.Transform] = t
+		}
+	}
+	return res, nil
+}
+
+//value looks up and transforms value
+func (t *transform) value(raw map[string]interface{}, key string) (interface{}, bool, error) {
+	if len(t.Concat) > 0 {
+		v, ok := t.concat(raw)
+		return t.finish(v, ok)
+	}
+	v, ok := deepSearch(raw, key)
+	return t.finish(v, ok)
+}
+
+//concat joins not empty values of concat keys
+func (t *transform) concat(raw map[string]interface{}) (interface{}, bool) {
+	parts := make([]string, 0, len(t.Concat))
+	for _, k := range t.Concat {
+		if pv, found := deepSearch(raw, k); found {
+			if s := toString(pv); s != "" {
+				parts = append(parts, s)
+			}
+		}
+	}
+	return strings.Join(parts, t.Sep), len(parts) > 0
+}
+
+//finish sets default and applies transform steps
+func (t *transform) finish(v interface{}, ok bool) (interface{}, bool, error) {
+	if !ok || v == nil || v == "" {
+		if t.Default == nil {
+			return v, ok, nil
+		}
+		v, ok = t.Default, true
+	}
+	v, err := t.apply(v)
+	return v, ok, err
+}
+
+func (t *transform) apply(v interface{}) (interface{}, error) {
+	if s, isStr := v.(string); isStr {
+		if t.Trim {
+			s = strings.TrimSpace(s)
+		}
+		switch t.Case {
+		case "upper":
+			s = strings.ToUpper(s)
+		case "lower":
+			s = strings.ToLower(s)
+		case "title":
+			s = strings.Title(strings.ToLower(s))
+		}
+		v = s
+	}
+	if t.Enum != nil {
+		if ev, ok := t.Enum[cast.ToString(v)]; ok {
+			v = ev
+		}
+	}
+	if t.Number {
+		n, err := parseNumber(v)
+		if err != nil {
+			return nil, err
+		}
+		v = n
+	}
+	if t.Date != "" {
+		s := cast.ToString(v)
+		if s == "" {
+			return nil, nil
+		}
+		d, err := time.ParseInLocation(t.Date, s, time.Local)
+		if err != nil {
+			return nil, err
+		}
+		v = d
+	}
+	return v, nil
+}
+
+//parseNumber parses numbers like "1 234,50"
+func parseNumber(v interface{}) (float64, error) {
+	s, ok := v.(string)
+	if !ok {
+		return cast.ToFloat64E(v)
+	}
+	s = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', ' ':
+			return -1
+		case ',':
+			return '.'
+		}
+		return r
+	}, s)
+	if s == "" {
+		return 0, nil
+	}
+	return cast.ToFloat64E(s)
+}
+
+//toString converts transformed value to string, list values are joined
+func toString(v interface{}) string {
+	switch t := v.(type) {
+	case time.Time:
+		return t.Format("2006-01-02")
+	case []interface{}:
+		parts := make([]string, 0, len(t))
+		for _, e := range t {
+			if s := toString(e); s != "" {
+				parts = append(parts, s)
+			}
+		}
+		return strings.Join(parts, ", ")
+	}
+	return cast.ToString(v)
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/egorka-gh/photocycle"
+)
+
+func TestTransform(t *testing.T) {
+	raw := map[string]interface{}{
+		"name":  "  ivan ",
+		"last":  "petrov",
+		"price": "1 234,50",
+		"date":  "05.03.2021",
+		"kind":  2.0,
+		"empty": "",
+	}
+	cases := []struct {
+		spec  string
+		key   string
+		want  interface{}
+		found bool
+	}{
+		{`{"trim":true,"case":"upper"}`, "name", "IVAN", true},
+		{`{"concat":["name","last"],"sep":"/"}`, "", "  ivan /petrov", true},
+		{`{"number":true}`, "price", 1234.5, true},
+		{`{"enum":{"1":"post","2":"courier"}}`, "kind", "courier", true},
+		{`{"default":"0"}`, "missing", "0", true},
+		{`{"default":"0"}`, "empty", "0", true},
+		{`{"trim":true}`, "missing", nil, false},
+		{`{"date":"02.01.2006"}`, "date", time.Date(2021, 3, 5, 0, 0, 0, 0, time.Local), true},
+	}
+	for _, c := range cases {
+		tr, err := parseTransform(c.spec)
+		if err != nil {
+			t.Fatalf("%s: parse error %q", c.spec, err.Error())
+		}
+		v, ok, err := tr.value(raw, c.key)
+		if err != nil {
+			t.Errorf("%s: error %q", c.spec, err.Error())
+			continue
+		}
+		if ok != c.found || v != c.want {
+			t.Errorf("%s: expected %v (%v), got %v (%v)", c.spec, c.want, c.found, v, ok)
+		}
+	}
+
+	if _, err := parseTransform(`{"case":"camel"}`); err == nil {
+		t.Error("Expected error on unknown case")
+	}
+	tr, _ := parseTransform(`{"number":true}`)
+	if _, _, err := tr.value(raw, "name"); err == nil {
+		t.Error("Expected error on not a number")
+	}
+}
+
+func TestBuildPackageTransform(t *testing.T) {
+	fm := map[int][]photocycle.JSONMap{
+		5: {
+			{Family: 5, JSONKey: "id", Field: "id"},
+			{Family: 5, JSONKey: "date", Field: "execution_date", Transform: `{"date":"2006-01-02"}`},
+		},
+		6: {
+			{Family: 6, JSONKey: "debt", Field: "debt_sum", Transform: `{"default":"0"}`},
+			{Family: 6, JSONKey: "sum", Field: "sum", Transform: `{"number":true}`},
+		},
+	}
+	b := testBuilder(t, &mapsRepo{jmap: fm})
+	p, _, err := b.BuildPackage(8, map[string]interface{}{"id": 1.0, "date": "2021-03-05", "sum": "10,5"})
+	if err != nil {
+		t.Fatalf("Error build package %q", err.Error())
+	}
+	if d := time.Time(p.ExecutionDate); d.Year() != 2021 || d.Month() != 3 || d.Day() != 5 {
+		t.Errorf("Wrong execution date %v", p.ExecutionDate)
+	}
+	props := make(map[string]string)
+	for _, pp := range p.Properties {
+		props[pp.Property] = pp.Value
+	}
+	if props["debt_sum"] != "0" || props["sum"] != "10.5" {
+		t.Errorf("Wrong properties %v", props)
+	}
+}
@@ -0,0 +1,552 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/egorka-gh/photocycle"
+	"github.com/egorka-gh/photocycle/logging"
+	"github.com/egorka-gh/photocycle/tracing"
+	log "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-sql-driver/mysql"
+)
+
+//Middleware is a Repository decorator
+type Middleware func(photocycle.Repository) photocycle.Repository
+
+//Chain composes middlewares, first middleware is outermost (runs first)
+func Chain(outer Middleware, others ...Middleware) Middleware {
+	return func(next photocycle.Repository) photocycle.Repository {
+		for i := len(others) - 1; i >= 0; i-- {
+			next = others[i](next)
+		}
+		return outer(next)
+	}
+}
+
+//Interceptor wraps single repository call, method is Repository method name
+type Interceptor func(ctx context.Context, method string, call func(ctx context.Context) error) error
+
+//Intercept makes Middleware that runs each Repository call (except Close) through interceptor
+func Intercept(i Interceptor) Middleware {
+	return func(next photocycle.Repository) photocycle.Repository {
+		return &intercepted{next: next, call: i}
+	}
+}
+
+//Timeout limits each call by d, 0 - no limit
+func Timeout(d time.Duration) Middleware {
+	return Intercept(func(ctx context.Context, method string, call func(ctx context.Context) error) error {
+		if d <= 0 {
+			return call(ctx)
+		}
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		return call(ctx)
+	})
+}
+
+//Logging logs failed calls with run and item ids from context, sql.ErrNoRows is not logged
+func Logging(logger log.Logger) Middleware {
+	logger = log.With(logger, logging.KeyComponent, "repo")
+	return Intercept(func(ctx context.Context, method string, call func(ctx context.Context) error) error {
+		start := time.Now()
+		err := call(ctx)
+		if err != nil && err != sql.ErrNoRows {
+			level.Error(tracing.Logger(ctx, logger)).Log(logging.KeyMsg, "repository call failed", logging.KeyMethod, method, "elapsed", time.Since(start), logging.KeyErr, err)
+		}
+		return err
+	})
+}
+
+//retrySafe methods can be repeated after failed call: they are idempotent or run single transaction,
+//so failed call changes nothing. AddNetprints and SetNetprints run several batches,
+//they are safe as INSERT IGNORE and ON DUPLICATE KEY UPDATE make repeated batches idempotent.
+//AddAlerts (returns rows saved by call), StartOrders and SetPrintedEFI (stored procedures) and TryLock are not retried
+var retrySafe = map[string]bool{
+	"GetLastNetprintSync":       true,
+	"SetLastNetprintSync":       true,
+	"AddNetprints":              true,
+	"GetNetprintSources":        true,
+	"GetNetprints":              true,
+	"SetNetprints":              true,
+	"GetSourceUrls":             true,
+	"GetNewPackages":            true,
+	"NewPackageUpdate":          true,
+	"GetDeadPackages":           true,
+	"RetryDeadPackage":          true,
+	"DiscardDeadPackage":        true,
+	"PackageAddWithBoxes":       true,
+	"GetOrderStates":            true,
+	"LoadPackage":               true,
+	"PackageUpdate":             true,
+	"CreateOrder":               true,
+	"LoadOrder":                 true,
+	"LogState":                  true,
+	"SetOrderState":             true,
+	"LoadAlias":                 true,
+	"ClearGroup":                true,
+	"AddExtraInfo":              true,
+	"SetGroupState":             true,
+	"GetGroupState":             true,
+	"LoadBaseOrderByState":      true,
+	"LoadBaseOrderByChildState": true,
+	"FillOrders":                true,
+	"CountCurrentOrders":        true,
+	"GetCurrentOrders":          true,
+	"GetStatusOutbox":           true,
+	"StatusOutboxUpdate":        true,
+	"GetActiveAlerts":           true,
+	"ResolveAlerts":             true,
+	"CancelGroup":               true,
+	"GetJSONMaps":               true,
+	"GetDeliveryMaps":           true,
+	"AddDeliveryUnmapped":       true,
+	"GetDeliveryUnmapped":       true,
+	"GetPrintPostedEFI":         true,
+}
+
+//mysql errors that roll back statement or transaction and can be repeated
+const (
+	errLockWaitTimeout = 1205
+	errDeadlock        = 1213
+)
+
+//IsRetryable checks if err is mysql deadlock or lock wait timeout
+func IsRetryable(err error) bool {
+	if e, ok := err.(*mysql.MySQLError); ok {
+		return e.Number == errDeadlock || e.Number == errLockWaitTimeout
+	}
+	return false
+}
+
+//Retry repeats retry safe calls failed by deadlock or lock wait timeout
+//attempts - max calls count, delay - first pause, doubles on each retry
+func Retry(attempts int, delay time.Duration, logger log.Logger) Middleware {
+	logger = log.With(logger, logging.KeyComponent, "repo")
+	return Intercept(func(ctx context.Context, method string, call func(ctx context.Context) error) error {
+		err := call(ctx)
+		if !retrySafe[method] {
+			return err
+		}
+		d := delay
+		for i := 1; i < attempts && IsRetryable(err); i++ {
+			level.Warn(tracing.Logger(ctx, logger)).Log(logging.KeyMsg, "retry repository call", logging.KeyMethod, method, "attempt", i+1, logging.KeyErr, err)
+			t := time.NewTimer(d)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return err
+			case <-t.C:
+			}
+			d *= 2
+			err = call(ctx)
+		}
+		return err
+	})
+}
+
+//MethodStats calls statistic of one Repository method
+type MethodStats struct {
+	Calls  int64
+	Errors int64
+	Total  time.Duration
+	Max    time.Duration
+}
+
+//Stats collects calls latency and errors by method
+type Stats struct {
+	mu      sync.Mutex
+	methods map[string]*MethodStats
+}
+
+//NewStats creates empty Stats
+func NewStats() *Stats {
+	return &Stats{methods: make(map[string]*MethodStats)}
+}
+
+func (s *Stats) add(method string, d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.methods[method]
+	if !ok {
+		m = &MethodStats{}
+		s.methods[method] = m
+	}
+	m.Calls++
+	if err != nil && err != sql.ErrNoRows {
+		m.Errors++
+	}
+	m.Total += d
+	if d > m.Max {
+		m.Max = d
+	}
+}
+
+//Snapshot returns copy of collected stats, reset clears collected
+func (s *Stats) Snapshot(reset bool) map[string]MethodStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[string]MethodStats, len(s.methods))
+	for k, m := range s.methods {
+		res[k] = *m
+	}
+	if reset {
+		s.methods = make(map[string]*MethodStats)
+	}
+	return res
+}
+
+//Log writes stats collected since last Log by method and resets it
+func (s *Stats) Log(logger log.Logger) {
+	snap := s.Snapshot(true)
+	methods := make([]string, 0, len(snap))
+	for k := range snap {
+		methods = append(methods, k)
+	}
+	sort.Strings(methods)
+	logger = log.With(logger, logging.KeyComponent, "repo")
+	for _, k := range methods {
+		m := snap[k]
+		level.Info(logger).Log(logging.KeyMsg, "repository stats", logging.KeyMethod, k, "calls", m.Calls, "errors", m.Errors, "avg", m.Total/time.Duration(m.Calls), "max", m.Max)
+	}
+}
+
+//Metrics collects each call latency and errors into s
+func Metrics(s *Stats) Middleware {
+	return Intercept(func(ctx context.Context, method string, call func(ctx context.Context) error) error {
+		start := time.Now()
+		err := call(ctx)
+		s.add(method, time.Since(start), err)
+		return err
+	})
+}
+
+//intercepted runs Repository calls through interceptor
+type intercepted struct {
+	next photocycle.Repository
+	call Interceptor
+}
+
+//Close closes underlying Repository, not intercepted
+func (r *intercepted) Close() {
+	r.next.Close()
+}
+
+func (r *intercepted) GetLastNetprintSync(ctx context.Context, source int) (res int64, err error) {
+	err = r.call(ctx, "GetLastNetprintSync", func(ctx context.Context) error {
+		res, err = r.next.GetLastNetprintSync(ctx, source)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) SetLastNetprintSync(ctx context.Context, source int, tstamp int64) error {
+	return r.call(ctx, "SetLastNetprintSync", func(ctx context.Context) error {
+		return r.next.SetLastNetprintSync(ctx, source, tstamp)
+	})
+}
+
+func (r *intercepted) AddNetprints(ctx context.Context, netprints []photocycle.GroupNetprint) error {
+	return r.call(ctx, "AddNetprints", func(ctx context.Context) error {
+		return r.next.AddNetprints(ctx, netprints)
+	})
+}
+
+func (r *intercepted) GetNetprintSources(ctx context.Context) (res []photocycle.SourceURL, err error) {
+	err = r.call(ctx, "GetNetprintSources", func(ctx context.Context) error {
+		res, err = r.next.GetNetprintSources(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) GetNetprints(ctx context.Context, source int, groups []int) (res []photocycle.GroupNetprint, err error) {
+	err = r.call(ctx, "GetNetprints", func(ctx context.Context) error {
+		res, err = r.next.GetNetprints(ctx, source, groups)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) SetNetprints(ctx context.Context, netprints []photocycle.GroupNetprint) error {
+	return r.call(ctx, "SetNetprints", func(ctx context.Context) error {
+		return r.next.SetNetprints(ctx, netprints)
+	})
+}
+
+func (r *intercepted) GetSourceUrls(ctx context.Context) (res []photocycle.SourceURL, err error) {
+	err = r.call(ctx, "GetSourceUrls", func(ctx context.Context) error {
+		res, err = r.next.GetSourceUrls(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) GetNewPackages(ctx context.Context) (res []photocycle.PackageNew, err error) {
+	err = r.call(ctx, "GetNewPackages", func(ctx context.Context) error {
+		res, err = r.next.GetNewPackages(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) NewPackageUpdate(ctx context.Context, g photocycle.PackageNew) error {
+	return r.call(ctx, "NewPackageUpdate", func(ctx context.Context) error {
+		return r.next.NewPackageUpdate(ctx, g)
+	})
+}
+
+func (r *intercepted) GetDeadPackages(ctx context.Context) (res []photocycle.PackageNew, err error) {
+	err = r.call(ctx, "GetDeadPackages", func(ctx context.Context) error {
+		res, err = r.next.GetDeadPackages(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) RetryDeadPackage(ctx context.Context, source, id int) error {
+	return r.call(ctx, "RetryDeadPackage", func(ctx context.Context) error {
+		return r.next.RetryDeadPackage(ctx, source, id)
+	})
+}
+
+func (r *intercepted) DiscardDeadPackage(ctx context.Context, source, id int) error {
+	return r.call(ctx, "DiscardDeadPackage", func(ctx context.Context) error {
+		return r.next.DiscardDeadPackage(ctx, source, id)
+	})
+}
+
+func (r *intercepted) PackageAddWithBoxes(ctx context.Context, packages []*photocycle.Package) error {
+	return r.call(ctx, "PackageAddWithBoxes", func(ctx context.Context) error {
+		return r.next.PackageAddWithBoxes(ctx, packages)
+	})
+}
+
+func (r *intercepted) GetOrderStates(ctx context.Context, ids []string) (res map[string]int, err error) {
+	err = r.call(ctx, "GetOrderStates", func(ctx context.Context) error {
+		res, err = r.next.GetOrderStates(ctx, ids)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) LoadPackage(ctx context.Context, source, id int) (res *photocycle.Package, err error) {
+	err = r.call(ctx, "LoadPackage", func(ctx context.Context) error {
+		res, err = r.next.LoadPackage(ctx, source, id)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) PackageUpdate(ctx context.Context, p *photocycle.Package, changes []photocycle.PackageChange) error {
+	return r.call(ctx, "PackageUpdate", func(ctx context.Context) error {
+		return r.next.PackageUpdate(ctx, p, changes)
+	})
+}
+
+func (r *intercepted) CreateOrder(ctx context.Context, o photocycle.Order) error {
+	return r.call(ctx, "CreateOrder", func(ctx context.Context) error {
+		return r.next.CreateOrder(ctx, o)
+	})
+}
+
+func (r *intercepted) LoadOrder(ctx context.Context, id string) (res photocycle.Order, err error) {
+	err = r.call(ctx, "LoadOrder", func(ctx context.Context) error {
+		res, err = r.next.LoadOrder(ctx, id)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) LogState(ctx context.Context, orderID string, state int, message string) error {
+	return r.call(ctx, "LogState", func(ctx context.Context) error {
+		return r.next.LogState(ctx, orderID, state, message)
+	})
+}
+
+func (r *intercepted) SetOrderState(ctx context.Context, orderID string, state int) error {
+	return r.call(ctx, "SetOrderState", func(ctx context.Context) error {
+		return r.next.SetOrderState(ctx, orderID, state)
+	})
+}
+
+func (r *intercepted) LoadAlias(ctx context.Context, alias string) (res photocycle.Alias, err error) {
+	err = r.call(ctx, "LoadAlias", func(ctx context.Context) error {
+		res, err = r.next.LoadAlias(ctx, alias)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) ClearGroup(ctx context.Context, source, group int, keepID string) error {
+	return r.call(ctx, "ClearGroup", func(ctx context.Context) error {
+		return r.next.ClearGroup(ctx, source, group, keepID)
+	})
+}
+
+func (r *intercepted) AddExtraInfo(ctx context.Context, ei photocycle.OrderExtraInfo) error {
+	return r.call(ctx, "AddExtraInfo", func(ctx context.Context) error {
+		return r.next.AddExtraInfo(ctx, ei)
+	})
+}
+
+func (r *intercepted) SetGroupState(ctx context.Context, source, state, group int, keepID string) error {
+	return r.call(ctx, "SetGroupState", func(ctx context.Context) error {
+		return r.next.SetGroupState(ctx, source, state, group, keepID)
+	})
+}
+
+func (r *intercepted) GetGroupState(ctx context.Context, baseID string, source, group int) (res photocycle.GroupState, err error) {
+	err = r.call(ctx, "GetGroupState", func(ctx context.Context) error {
+		res, err = r.next.GetGroupState(ctx, baseID, source, group)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) LoadBaseOrderByState(ctx context.Context, source, state int) (res photocycle.Order, err error) {
+	err = r.call(ctx, "LoadBaseOrderByState", func(ctx context.Context) error {
+		res, err = r.next.LoadBaseOrderByState(ctx, source, state)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) LoadBaseOrderByChildState(ctx context.Context, source, baseState, childState int) (res []photocycle.Order, err error) {
+	err = r.call(ctx, "LoadBaseOrderByChildState", func(ctx context.Context) error {
+		res, err = r.next.LoadBaseOrderByChildState(ctx, source, baseState, childState)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) FillOrders(ctx context.Context, orders []photocycle.Order) error {
+	return r.call(ctx, "FillOrders", func(ctx context.Context) error {
+		return r.next.FillOrders(ctx, orders)
+	})
+}
+
+func (r *intercepted) StartOrders(ctx context.Context, source, group int, skipID string) error {
+	return r.call(ctx, "StartOrders", func(ctx context.Context) error {
+		return r.next.StartOrders(ctx, source, group, skipID)
+	})
+}
+
+func (r *intercepted) CountCurrentOrders(ctx context.Context, source int) (res int, err error) {
+	err = r.call(ctx, "CountCurrentOrders", func(ctx context.Context) error {
+		res, err = r.next.CountCurrentOrders(ctx, source)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) GetCurrentOrders(ctx context.Context, source int) (res []photocycle.GroupState, err error) {
+	err = r.call(ctx, "GetCurrentOrders", func(ctx context.Context) error {
+		res, err = r.next.GetCurrentOrders(ctx, source)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) GetStatusOutbox(ctx context.Context, limit int) (res []photocycle.StatusPush, err error) {
+	err = r.call(ctx, "GetStatusOutbox", func(ctx context.Context) error {
+		res, err = r.next.GetStatusOutbox(ctx, limit)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) StatusOutboxUpdate(ctx context.Context, p photocycle.StatusPush) error {
+	return r.call(ctx, "StatusOutboxUpdate", func(ctx context.Context) error {
+		return r.next.StatusOutboxUpdate(ctx, p)
+	})
+}
+
+func (r *intercepted) GetActiveAlerts(ctx context.Context) (res []photocycle.StateAlert, err error) {
+	err = r.call(ctx, "GetActiveAlerts", func(ctx context.Context) error {
+		res, err = r.next.GetActiveAlerts(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) AddAlerts(ctx context.Context, alerts []photocycle.StateAlert) ([]photocycle.StateAlert, error) {
+	var res []photocycle.StateAlert
+	err := r.call(ctx, "AddAlerts", func(ctx context.Context) error {
+		var err error
+		res, err = r.next.AddAlerts(ctx, alerts)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) ResolveAlerts(ctx context.Context, ids []int) error {
+	return r.call(ctx, "ResolveAlerts", func(ctx context.Context) error {
+		return r.next.ResolveAlerts(ctx, ids)
+	})
+}
+
+func (r *intercepted) CancelGroup(ctx context.Context, source, group, state int, message string) (res int, err error) {
+	err = r.call(ctx, "CancelGroup", func(ctx context.Context) error {
+		res, err = r.next.CancelGroup(ctx, source, group, state, message)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) GetJSONMaps(ctx context.Context) (res map[int][]photocycle.JSONMap, err error) {
+	err = r.call(ctx, "GetJSONMaps", func(ctx context.Context) error {
+		res, err = r.next.GetJSONMaps(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) GetDeliveryMaps(ctx context.Context) (res map[int]map[int]photocycle.DeliveryTypeMapping, err error) {
+	err = r.call(ctx, "GetDeliveryMaps", func(ctx context.Context) error {
+		res, err = r.next.GetDeliveryMaps(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) AddDeliveryUnmapped(ctx context.Context, source, nativeID, packageID int) error {
+	return r.call(ctx, "AddDeliveryUnmapped", func(ctx context.Context) error {
+		return r.next.AddDeliveryUnmapped(ctx, source, nativeID, packageID)
+	})
+}
+
+func (r *intercepted) GetDeliveryUnmapped(ctx context.Context) (res []photocycle.DeliveryUnmapped, err error) {
+	err = r.call(ctx, "GetDeliveryUnmapped", func(ctx context.Context) error {
+		res, err = r.next.GetDeliveryUnmapped(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) GetPrintPostedEFI(ctx context.Context) (res []photocycle.PrintPostedEFI, err error) {
+	err = r.call(ctx, "GetPrintPostedEFI", func(ctx context.Context) error {
+		res, err = r.next.GetPrintPostedEFI(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (r *intercepted) SetPrintedEFI(ctx context.Context, printgroupID string) error {
+	return r.call(ctx, "SetPrintedEFI", func(ctx context.Context) error {
+		return r.next.SetPrintedEFI(ctx, printgroupID)
+	})
+}
+
+func (r *intercepted) TryLock(ctx context.Context, name string) (res photocycle.Lock, err error) {
+	err = r.call(ctx, "TryLock", func(ctx context.Context) error {
+		res, err = r.next.TryLock(ctx, name)
+		return err
+	})
+	return res, err
+}
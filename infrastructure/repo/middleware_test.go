@@ -0,0 +1,90 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/egorka-gh/photocycle"
+	log "github.com/go-kit/kit/log"
+	"github.com/go-sql-driver/mysql"
+)
+
+//failRepo fails calls by errs, then succeeds
+type failRepo struct {
+	photocycle.Repository
+	errs     []error
+	calls    int
+	deadline bool
+}
+
+func (r *failRepo) fail(ctx context.Context) error {
+	r.calls++
+	_, r.deadline = ctx.Deadline()
+	if len(r.errs) == 0 {
+		return nil
+	}
+	err := r.errs[0]
+	r.errs = r.errs[1:]
+	return err
+}
+
+func (r *failRepo) PackageAddWithBoxes(ctx context.Context, packages []*photocycle.Package) error {
+	return r.fail(ctx)
+}
+
+func (r *failRepo) AddAlerts(ctx context.Context, alerts []photocycle.StateAlert) ([]photocycle.StateAlert, error) {
+	return nil, r.fail(ctx)
+}
+
+func (r *failRepo) LoadOrder(ctx context.Context, id string) (photocycle.Order, error) {
+	return photocycle.Order{ID: id}, r.fail(ctx)
+}
+
+func TestMiddleware(t *testing.T) {
+	deadlock := &mysql.MySQLError{Number: 1213, Message: "Deadlock found"}
+	stub := &failRepo{errs: []error{deadlock, &mysql.MySQLError{Number: 1205}}}
+	stats := NewStats()
+	logger := log.NewNopLogger()
+	rep := Chain(Metrics(stats), Logging(logger), Retry(3, time.Millisecond, logger), Timeout(time.Second))(stub)
+
+	if err := rep.PackageAddWithBoxes(context.Background(), nil); err != nil {
+		t.Fatalf("expected success after retries, got %v", err)
+	}
+	if stub.calls != 3 || !stub.deadline {
+		t.Fatalf("expected 3 calls with deadline, got %d, deadline %v", stub.calls, stub.deadline)
+	}
+
+	//attempts limit
+	stub.calls = 0
+	stub.errs = []error{deadlock, deadlock, deadlock, deadlock}
+	if err := rep.PackageAddWithBoxes(context.Background(), nil); err != deadlock || stub.calls != 3 {
+		t.Fatalf("expected deadlock after 3 calls, got %v, calls %d", err, stub.calls)
+	}
+
+	//not retry safe
+	stub.calls = 0
+	stub.errs = []error{deadlock}
+	if _, err := rep.AddAlerts(context.Background(), nil); err != deadlock || stub.calls != 1 {
+		t.Fatalf("expected AddAlerts not retried, got %v, calls %d", err, stub.calls)
+	}
+
+	//results and errors pass unchanged
+	stub.errs = []error{sql.ErrNoRows}
+	o, err := rep.LoadOrder(context.Background(), "1-1")
+	if err != sql.ErrNoRows || o.ID != "1-1" {
+		t.Fatalf("expected order and sql.ErrNoRows, got %v, %v", o, err)
+	}
+
+	snap := stats.Snapshot(true)
+	if m := snap["PackageAddWithBoxes"]; m.Calls != 2 || m.Errors != 1 {
+		t.Errorf("expected PackageAddWithBoxes 2 calls 1 error, got %+v", m)
+	}
+	if m := snap["LoadOrder"]; m.Calls != 1 || m.Errors != 0 {
+		t.Errorf("expected LoadOrder 1 call without errors, got %+v", m)
+	}
+	if len(stats.Snapshot(false)) != 0 {
+		t.Error("expected stats reset")
+	}
+}
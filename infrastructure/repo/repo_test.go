@@ -1,10 +1,13 @@
 package repo
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
 	"testing"
+
+	"github.com/egorka-gh/photocycle"
 )
 
 type exec struct {
@@ -12,7 +15,7 @@ type exec struct {
 
 var execRuns int
 
-func (e *exec) Exec(query string, args ...interface{}) (sql.Result, error) {
+func (e *exec) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
 	execRuns++
 	i := strings.Count(query, "?")
 	if i != len(args) {
@@ -28,7 +31,7 @@ func TestInsertBatch(t *testing.T) {
 		j := i
 		args = append(args, j)
 	}
-	err := insertBatch(new(exec), "INSERT", "(?,?,?,?,?)", args)
+	err := insertBatch(context.Background(), new(exec), "INSERT", "(?,?,?,?,?)", args)
 	if err != nil {
 		t.Error(err.Error())
 		return
@@ -44,7 +47,7 @@ func TestInsertBatch(t *testing.T) {
 		j := i
 		args = append(args, j)
 	}
-	err = insertBatch(new(exec), "INSERT", "(?,?,?,?,?)", args)
+	err = insertBatch(context.Background(), new(exec), "INSERT", "(?,?,?,?,?)", args)
 	if err != nil {
 		t.Error(err.Error())
 		return
@@ -55,7 +58,7 @@ func TestInsertBatch(t *testing.T) {
 
 	execRuns = 0
 	maxParamsPerBatch = 10
-	err = insertBatch(new(exec), "INSERT", "(?,?,?,?,?)", args)
+	err = insertBatch(context.Background(), new(exec), "INSERT", "(?,?,?,?,?)", args)
 	if err != nil {
 		t.Error(err.Error())
 		return
@@ -65,3 +68,26 @@ func TestInsertBatch(t *testing.T) {
 	}
 
 }
+
+func TestDiffBoxItems(t *testing.T) {
+	old := []photocycle.PackageBoxItem{
+		{OrderID: "1-1", Alias: "a", Type: "book", From: 1, To: 5},
+		{OrderID: "1-1", Alias: "a", Type: "book", From: 6, To: 10},
+		{OrderID: "1-2", Alias: "b", Type: "photo", From: 1, To: 1},
+	}
+	new := []photocycle.PackageBoxItem{
+		{OrderID: "1-1", Alias: "a", Type: "book", From: 1, To: 5},
+		{OrderID: "1-1", Alias: "c", Type: "book", From: 6, To: 10},
+		{OrderID: "1-3", Alias: "d", Type: "photo", From: 1, To: 1},
+	}
+	added, changed, removed := diffBoxItems(old, new)
+	if len(added) != 1 || added[0].OrderID != "1-3" {
+		t.Errorf("expected added 1-3, got %v", added)
+	}
+	if len(changed) != 1 || changed[0].Alias != "c" {
+		t.Errorf("expected changed alias c, got %v", changed)
+	}
+	if len(removed) != 1 || removed[0].OrderID != "1-2" {
+		t.Errorf("expected removed 1-2, got %v", removed)
+	}
+}
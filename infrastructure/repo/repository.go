@@ -2,6 +2,7 @@ package repo
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"strings"
 
@@ -47,9 +48,20 @@ func (b *basicRepository) GetSourceUrls(ctx context.Context) ([]photocycle.Sourc
 	return res, err
 }
 
+func (b *basicRepository) GetNetprintSources(ctx context.Context) ([]photocycle.SourceURL, error) {
+	var sql string = "SELECT s.id, s.type,  s1.url, s1.appkey, s.has_boxes FROM sources s INNER JOIN services s1 ON s.id = s1.src_id AND s1.srvc_id = 1 AND s1.url!='' WHERE s.online = 1 AND s.netprint = 1"
+	res := []photocycle.SourceURL{}
+	err := b.db.SelectContext(ctx, &res, sql)
+	return res, err
+}
+
 func (b *basicRepository) GetNewPackages(ctx context.Context) ([]photocycle.PackageNew, error) {
 	//var sql string = "SELECT source, id, client_id, created, attempt FROM package_new WHERE attempt < 10"
-	var sql string = "SELECT p.source, p.id, p.client_id, p.created, p.attempt FROM package_new p INNER JOIN sources s ON p.source = s.id AND s.online=1"
+	var sb strings.Builder
+	sb.WriteString("SELECT p.source, p.id, p.client_id, p.created, p.attempt, IFNULL(p.next_attempt, p.created) next_attempt, p.last_error, p.dead")
+	sb.WriteString(" FROM package_new p INNER JOIN sources s ON p.source = s.id AND s.online=1")
+	sb.WriteString(" WHERE p.dead = 0 AND (p.next_attempt IS NULL OR p.next_attempt <= NOW())")
+	sql := sb.String()
 	res := []photocycle.PackageNew{}
 	err := b.db.SelectContext(ctx, &res, sql)
 	return res, err
@@ -59,18 +71,58 @@ func (b *basicRepository) NewPackageUpdate(ctx context.Context, g photocycle.Pac
 	if b.readOnly {
 		return nil
 	}
-	sql := "UPDATE package_new SET attempt = ? WHERE source = ? AND id = ?"
-	_, err := b.db.ExecContext(ctx, sql, g.Attempt, g.Source, g.ID)
+	sql := "UPDATE package_new SET attempt = ?, next_attempt = ?, last_error = LEFT(?, 250), dead = ? WHERE source = ? AND id = ?"
+	_, err := b.db.ExecContext(ctx, sql, g.Attempt, g.NextAttempt, g.LastError, g.Dead, g.Source, g.ID)
 	return err
 }
 
+func (b *basicRepository) GetDeadPackages(ctx context.Context) ([]photocycle.PackageNew, error) {
+	sql := "SELECT p.source, p.id, p.client_id, p.created, p.attempt, IFNULL(p.next_attempt, p.created) next_attempt, p.last_error, p.dead FROM package_new p WHERE p.dead = 1 ORDER BY p.source, p.id"
+	res := []photocycle.PackageNew{}
+	err := b.db.SelectContext(ctx, &res, sql)
+	return res, err
+}
+
+func (b *basicRepository) RetryDeadPackage(ctx context.Context, source, id int) error {
+	if b.readOnly {
+		return nil
+	}
+	sql := "UPDATE package_new SET attempt = 0, next_attempt = NULL, last_error = '', dead = 0 WHERE source = ? AND id = ? AND dead = 1"
+	r, err := b.db.ExecContext(ctx, sql, source, id)
+	return checkAffected(r, err)
+}
+
+func (b *basicRepository) DiscardDeadPackage(ctx context.Context, source, id int) error {
+	if b.readOnly {
+		return nil
+	}
+	sql := "DELETE FROM package_new WHERE source = ? AND id = ? AND dead = 1"
+	r, err := b.db.ExecContext(ctx, sql, source, id)
+	return checkAffected(r, err)
+}
+
+//checkAffected returns sql.ErrNoRows if nothing changed
+func checkAffected(r sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
 func (b *basicRepository) PackageAddWithBoxes(ctx context.Context, packages []*photocycle.Package) error {
 	if b.readOnly || len(packages) == 0 {
 		return nil
 	}
 	//insert packages
 	oSQL := "INSERT IGNORE INTO package (source, id, client_id, state, state_date, id_name, execution_date, delivery_id, delivery_name, src_state, src_state_name, mail_service, orders_num) VALUES "
-	oVals := "(?, ?, ?, 200, NOW(), ?, ?, ?, ?, ?, ?, ?, 0)"
+	oVals := "(?, ?, ?, 200, NOW(), ?, ?, ?, ?, ?, ?, ?, ?)"
 	oArgs := []interface{}{}
 
 	//TODO save props
@@ -92,10 +144,14 @@ func (b *basicRepository) PackageAddWithBoxes(ctx context.Context, packages []*p
 	pSQL := "INSERT INTO package_box_item (box_id, order_id, alias, item_from, item_to, type ,state ,state_date) VALUES "
 	pVals := "(?, ?, ?, ?, ?, ?, ?, NOW())"
 	pArgs := []interface{}{}
+
+	iSQL := "INSERT IGNORE INTO package_box_item_issue (source, package_id, box_id, order_id, issue, state, created) VALUES "
+	iVals := "(?, ?, ?, ?, ?, ?, NOW())"
+	iArgs := []interface{}{}
 	for _, o := range packages {
 		//packages
 		//source, id, client_id, state, state_date, id_name, execution_date, delivery_id, delivery_name, src_state, src_state_name, mail_service, orders_num
-		oArgs = append(oArgs, o.Source, o.ID, o.ClientID, o.IDName, o.ExecutionDate.String(), o.DeliveryID, o.DeliveryName, o.SrcState, o.SrcStateName, o.MailService)
+		oArgs = append(oArgs, o.Source, o.ID, o.ClientID, o.IDName, o.ExecutionDate.String(), o.DeliveryID, o.DeliveryName, o.SrcState, o.SrcStateName, o.MailService, o.OrdersNum)
 		//props
 		for _, prop := range o.Properties {
 			propArgs = append(propArgs, prop.Source, prop.PackageID, prop.Property, prop.Value)
@@ -113,6 +169,10 @@ func (b *basicRepository) PackageAddWithBoxes(ctx context.Context, packages []*p
 				pArgs = append(pArgs, p.BoxID, p.OrderID, p.Alias, p.From, p.To, p.Type, photocycle.StateWaiteProduction)
 			}
 		}
+		//box items issues
+		for _, i := range o.Issues {
+			iArgs = append(iArgs, i.Source, i.PackageID, i.BoxID, i.OrderID, i.Issue, i.State)
+		}
 	}
 
 	//run in transaction
@@ -120,28 +180,33 @@ func (b *basicRepository) PackageAddWithBoxes(ctx context.Context, packages []*p
 	if err != nil {
 		return err
 	}
-	err = insertBatch(t, oSQL, oVals, oArgs)
+	err = insertBatch(ctx, t, oSQL, oVals, oArgs)
 	if err != nil {
 		t.Rollback()
 		return err
 	}
 
-	err = insertBatch(t, propSQL, propVals, propArgs)
+	err = insertBatch(ctx, t, propSQL, propVals, propArgs)
 	if err != nil {
 		t.Rollback()
 		return err
 	}
-	err = insertBatch(t, barSQL, barVals, barArgs)
+	err = insertBatch(ctx, t, barSQL, barVals, barArgs)
 	if err != nil {
 		t.Rollback()
 		return err
 	}
-	err = insertBatch(t, xSQL, xVals, xArgs)
+	err = insertBatch(ctx, t, xSQL, xVals, xArgs)
 	if err != nil {
 		t.Rollback()
 		return err
 	}
-	err = insertBatch(t, pSQL, pVals, pArgs)
+	err = insertBatch(ctx, t, pSQL, pVals, pArgs)
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+	err = insertBatch(ctx, t, iSQL, iVals, iArgs)
 	if err != nil {
 		t.Rollback()
 		return err
@@ -150,7 +215,7 @@ func (b *basicRepository) PackageAddWithBoxes(ctx context.Context, packages []*p
 	//del from package_new
 	dSQL := "DELETE FROM package_new WHERE source =  ? AND id = ?"
 	for _, o := range packages {
-		_, err = t.Exec(dSQL, o.Source, o.ID)
+		_, err = t.ExecContext(ctx, dSQL, o.Source, o.ID)
 		if err != nil {
 			t.Rollback()
 			return err
@@ -160,9 +225,237 @@ func (b *basicRepository) PackageAddWithBoxes(ctx context.Context, packages []*p
 	return t.Commit()
 }
 
+func (b *basicRepository) LoadPackage(ctx context.Context, source, id int) (*photocycle.Package, error) {
+	res := &photocycle.Package{}
+	ssql := "SELECT source, id, client_id, state, state_date, id_name, execution_date, delivery_id, delivery_name, src_state, src_state_name, mail_service, orders_num FROM package WHERE source = ? AND id = ?"
+	err := b.db.GetContext(ctx, res, ssql, source, id)
+	if err != nil {
+		return nil, err
+	}
+	res.Properties = []photocycle.PackageProperty{}
+	ssql = "SELECT source, id, property, value FROM package_prop WHERE source = ? AND id = ?"
+	if err = b.db.SelectContext(ctx, &res.Properties, ssql, source, id); err != nil {
+		return nil, err
+	}
+	res.Barcodes = []photocycle.PackageBarcode{}
+	ssql = "SELECT source, id, barcode, bar_type, box_number FROM package_barcode WHERE source = ? AND id = ?"
+	if err = b.db.SelectContext(ctx, &res.Barcodes, ssql, source, id); err != nil {
+		return nil, err
+	}
+	res.Boxes = []photocycle.PackageBox{}
+	ssql = "SELECT source, package_id, box_id, box_num, barcode, price, weight, state, state_date FROM package_box WHERE source = ? AND package_id = ? ORDER BY box_num"
+	if err = b.db.SelectContext(ctx, &res.Boxes, ssql, source, id); err != nil {
+		return nil, err
+	}
+	items := []photocycle.PackageBoxItem{}
+	var sb strings.Builder
+	sb.WriteString("SELECT i.box_id, i.order_id, i.alias, i.type, i.item_from, i.item_to")
+	sb.WriteString(" FROM package_box_item i")
+	sb.WriteString(" INNER JOIN package_box b ON i.box_id = b.box_id")
+	sb.WriteString(" WHERE b.source = ? AND b.package_id = ?")
+	if err = b.db.SelectContext(ctx, &items, sb.String(), source, id); err != nil {
+		return nil, err
+	}
+	for i := range res.Boxes {
+		res.Boxes[i].Items = []photocycle.PackageBoxItem{}
+		for _, it := range items {
+			if it.BoxID == res.Boxes[i].ID {
+				res.Boxes[i].Items = append(res.Boxes[i].Items, it)
+			}
+		}
+	}
+	return res, nil
+}
+
+func (b *basicRepository) PackageUpdate(ctx context.Context, p *photocycle.Package, changes []photocycle.PackageChange) error {
+	if b.readOnly {
+		return nil
+	}
+	//run in transaction
+	t, err := b.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = packageUpdate(ctx, t, p, changes)
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+	return t.Commit()
+}
+
+func packageUpdate(ctx context.Context, t *sqlx.Tx, p *photocycle.Package, changes []photocycle.PackageChange) error {
+	//del from package_new
+	_, err := t.ExecContext(ctx, "DELETE FROM package_new WHERE source =  ? AND id = ?", p.Source, p.ID)
+	if err != nil {
+		return err
+	}
+	//issues are replaced
+	if _, err = t.ExecContext(ctx, "DELETE FROM package_box_item_issue WHERE source = ? AND package_id = ?", p.Source, p.ID); err != nil {
+		return err
+	}
+	args := []interface{}{}
+	for _, i := range p.Issues {
+		args = append(args, i.Source, i.PackageID, i.BoxID, i.OrderID, i.Issue, i.State)
+	}
+	if err = insertBatch(ctx, t, "INSERT IGNORE INTO package_box_item_issue (source, package_id, box_id, order_id, issue, state, created) VALUES ", "(?, ?, ?, ?, ?, ?, NOW())", args); err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	if photocycle.HasChanges(changes, photocycle.ChangePackage, "") {
+		ssql := "UPDATE package SET client_id = ?, id_name = ?, execution_date = ?, delivery_id = ?, delivery_name = ?, src_state = ?, src_state_name = ?, mail_service = ?, orders_num = ? WHERE source = ? AND id = ?"
+		_, err = t.ExecContext(ctx, ssql, p.ClientID, p.IDName, p.ExecutionDate.String(), p.DeliveryID, p.DeliveryName, p.SrcState, p.SrcStateName, p.MailService, p.OrdersNum, p.Source, p.ID)
+		if err != nil {
+			return err
+		}
+	}
+	//properties & barcodes are replaced
+	if photocycle.HasChanges(changes, photocycle.ChangeProperty, "") {
+		if _, err = t.ExecContext(ctx, "DELETE FROM package_prop WHERE source = ? AND id = ?", p.Source, p.ID); err != nil {
+			return err
+		}
+		args = args[:0]
+		for _, prop := range p.Properties {
+			args = append(args, prop.Source, prop.PackageID, prop.Property, prop.Value)
+		}
+		if err = insertBatch(ctx, t, "INSERT INTO package_prop (source, id, property, value) VALUES ", "(?, ?, ?, ?)", args); err != nil {
+			return err
+		}
+	}
+	if photocycle.HasChanges(changes, photocycle.ChangeBarcode, "") {
+		if _, err = t.ExecContext(ctx, "DELETE FROM package_barcode WHERE source = ? AND id = ?", p.Source, p.ID); err != nil {
+			return err
+		}
+		args = args[:0]
+		for _, bar := range p.Barcodes {
+			args = append(args, bar.Source, bar.PackageID, bar.Barcode, bar.BarcodeType, bar.BoxNumber)
+		}
+		if err = insertBatch(ctx, t, "INSERT INTO package_barcode (source, id, barcode, bar_type, box_number) VALUES ", "(?, ?, ?, ?, ?)", args); err != nil {
+			return err
+		}
+	}
+	//boxes, keep state of existing boxes
+	newBoxes := make(map[string]bool, len(p.Boxes))
+	for _, x := range p.Boxes {
+		newBoxes[x.ID] = true
+	}
+	for _, c := range changes {
+		if c.Entity == photocycle.ChangeBox && c.Field == "" && c.NewValue == "" && !newBoxes[c.Key] {
+			//removed box
+			if _, err = t.ExecContext(ctx, "DELETE FROM package_box_item WHERE box_id = ?", c.Key); err != nil {
+				return err
+			}
+			if _, err = t.ExecContext(ctx, "DELETE FROM package_box WHERE source = ? AND package_id = ? AND box_id = ?", p.Source, p.ID, c.Key); err != nil {
+				return err
+			}
+		}
+	}
+	xSQL := "INSERT INTO package_box (source, package_id, box_id, box_num, barcode, price, weight, state, state_date) VALUES (?, ?, ?, ?, ?, ?, ?, ?, NOW())"
+	xSQL = xSQL + " ON DUPLICATE KEY UPDATE box_num = VALUES(box_num), barcode = VALUES(barcode), price = VALUES(price), weight = VALUES(weight)"
+	for _, x := range p.Boxes {
+		if !photocycle.HasChanges(changes, photocycle.ChangeBox, x.ID) && !photocycle.HasChanges(changes, photocycle.ChangeBoxItem, x.ID) {
+			continue
+		}
+		if _, err = t.ExecContext(ctx, xSQL, x.Source, x.PackageID, x.ID, x.Num, x.Barcode, x.Price, x.Weight, photocycle.StateWaiteProduction); err != nil {
+			return err
+		}
+		if !photocycle.HasChanges(changes, photocycle.ChangeBoxItem, x.ID) {
+			continue
+		}
+		if err = updateBoxItems(ctx, t, x); err != nil {
+			return err
+		}
+	}
+	//change log
+	args = args[:0]
+	for _, c := range changes {
+		args = append(args, c.Source, c.PackageID, c.Entity, c.Key, c.Field, c.OldValue, c.NewValue)
+	}
+	return insertBatch(ctx, t, "INSERT INTO package_change_log (source, package_id, entity, item_key, field, old_value, new_value, created) VALUES ", "(?, ?, ?, ?, ?, LEFT(?, 250), LEFT(?, 250), NOW())", args)
+}
+
+//updateBoxItems saves box items, keeps state of existing items
+func updateBoxItems(ctx context.Context, t *sqlx.Tx, x photocycle.PackageBox) error {
+	old := []photocycle.PackageBoxItem{}
+	if err := t.SelectContext(ctx, &old, "SELECT box_id, order_id, alias, type, item_from, item_to FROM package_box_item WHERE box_id = ?", x.ID); err != nil {
+		return err
+	}
+	added, changed, removed := diffBoxItems(old, x.Items)
+	where := " WHERE box_id = ? AND order_id = ? AND item_from = ? AND item_to = ?"
+	for _, i := range removed {
+		if _, err := t.ExecContext(ctx, "DELETE FROM package_box_item"+where, x.ID, i.OrderID, i.From, i.To); err != nil {
+			return err
+		}
+	}
+	for _, i := range changed {
+		if _, err := t.ExecContext(ctx, "UPDATE package_box_item SET alias = ?, type = ?"+where, i.Alias, i.Type, x.ID, i.OrderID, i.From, i.To); err != nil {
+			return err
+		}
+	}
+	args := make([]interface{}, 0, len(added)*7)
+	for _, i := range added {
+		args = append(args, x.ID, i.OrderID, i.Alias, i.From, i.To, i.Type, photocycle.StateWaiteProduction)
+	}
+	return insertBatch(ctx, t, "INSERT INTO package_box_item (box_id, order_id, alias, item_from, item_to, type ,state ,state_date) VALUES ", "(?, ?, ?, ?, ?, ?, ?, NOW())", args)
+}
+
+//diffBoxItems compares saved box items with new ones by order and item range
+func diffBoxItems(old, new []photocycle.PackageBoxItem) (added, changed, removed []photocycle.PackageBoxItem) {
+	key := func(i photocycle.PackageBoxItem) string {
+		return fmt.Sprintf("%s/%d/%d", i.OrderID, i.From, i.To)
+	}
+	saved := make(map[string]photocycle.PackageBoxItem, len(old))
+	for _, i := range old {
+		saved[key(i)] = i
+	}
+	for _, i := range new {
+		k := key(i)
+		o, ok := saved[k]
+		if !ok {
+			added = append(added, i)
+			continue
+		}
+		delete(saved, k)
+		if o.Alias != i.Alias || o.Type != i.Type {
+			changed = append(changed, i)
+		}
+	}
+	for _, i := range old {
+		if _, ok := saved[key(i)]; ok {
+			removed = append(removed, i)
+		}
+	}
+	return added, changed, removed
+}
+
+func (b *basicRepository) GetOrderStates(ctx context.Context, ids []string) (map[string]int, error) {
+	res := make(map[string]int, len(ids))
+	if len(ids) == 0 {
+		return res, nil
+	}
+	ssql, args, err := sqlx.In("SELECT id, state FROM orders WHERE id IN (?)", ids)
+	if err != nil {
+		return nil, err
+	}
+	rows := []struct {
+		ID    string `db:"id"`
+		State int    `db:"state"`
+	}{}
+	err = b.db.SelectContext(ctx, &rows, b.db.Rebind(ssql), args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		res[r.ID] = r.State
+	}
+	return res, nil
+}
+
 var maxParamsPerBatch int = 500
 
-func insertBatch(execer sqlx.Execer, insert, values string, params []interface{}) error {
+func insertBatch(ctx context.Context, execer sqlx.ExecerContext, insert, values string, params []interface{}) error {
 
 	if len(params) == 0 {
 		return nil
@@ -193,7 +486,7 @@ func insertBatch(execer sqlx.Execer, insert, values string, params []interface{}
 		if len(params) == 0 || len(batchParams) >= maxParamsPerBatch {
 			//run batch
 			var ssql = sb.String()
-			_, err := execer.Exec(ssql, batchParams...)
+			_, err := execer.ExecContext(ctx, ssql, batchParams...)
 			if err != nil {
 				return err
 			}
@@ -219,11 +512,31 @@ func (b *basicRepository) SetLastNetprintSync(ctx context.Context, source int, t
 }
 
 func (b *basicRepository) AddNetprints(ctx context.Context, netprints []photocycle.GroupNetprint) error {
+	return b.saveNetprints(ctx, "INSERT IGNORE INTO group_netprint (source,group_id,netprint_id,state,box_number) VALUES ", "", netprints)
+}
+
+func (b *basicRepository) GetNetprints(ctx context.Context, source int, groups []int) ([]photocycle.GroupNetprint, error) {
+	res := []photocycle.GroupNetprint{}
+	if len(groups) == 0 {
+		return res, nil
+	}
+	ssql, args, err := sqlx.In("SELECT source, group_id, netprint_id, state, box_number FROM group_netprint WHERE source = ? AND group_id IN (?)", source, groups)
+	if err != nil {
+		return nil, err
+	}
+	err = b.db.SelectContext(ctx, &res, b.db.Rebind(ssql), args...)
+	return res, err
+}
+
+func (b *basicRepository) SetNetprints(ctx context.Context, netprints []photocycle.GroupNetprint) error {
+	return b.saveNetprints(ctx, "INSERT INTO group_netprint (source,group_id,netprint_id,state,box_number) VALUES ", " ON DUPLICATE KEY UPDATE state = VALUES(state), box_number = VALUES(box_number)", netprints)
+}
+
+//saveNetprints runs batch insert, onDuplicate is appended to each batch
+func (b *basicRepository) saveNetprints(ctx context.Context, insert, onDuplicate string, netprints []photocycle.GroupNetprint) error {
 	if b.readOnly || len(netprints) < 1 {
 		return nil
 	}
-	//batch insert
-	oSQL := "INSERT IGNORE INTO group_netprint (source,group_id,netprint_id,state,box_number) VALUES "
 	var oVals []string
 	var oArgs []interface{}
 	//limit bath size
@@ -232,7 +545,7 @@ func (b *basicRepository) AddNetprints(ctx context.Context, netprints []photocyc
 		if i%batch == 0 {
 			if len(oVals) > 0 {
 				//run batch
-				sql := oSQL + strings.Join(oVals, ",")
+				sql := insert + strings.Join(oVals, ",") + onDuplicate
 				if _, err := b.db.ExecContext(ctx, sql, oArgs...); err != nil {
 					return err
 				}
@@ -246,7 +559,7 @@ func (b *basicRepository) AddNetprints(ctx context.Context, netprints []photocyc
 	}
 	if len(oVals) > 0 {
 		//run batch
-		sql := oSQL + strings.Join(oVals, ",")
+		sql := insert + strings.Join(oVals, ",") + onDuplicate
 		if _, err := b.db.ExecContext(ctx, sql, oArgs...); err != nil {
 			return err
 		}
@@ -268,7 +581,7 @@ func (b *basicRepository) CreateOrder(ctx context.Context, o photocycle.Order) e
 }
 
 func (b *basicRepository) FillOrders(ctx context.Context, orders []photocycle.Order) error {
-	if b.readOnly {
+	if b.readOnly || len(orders) == 0 {
 		return nil
 	}
 	//insert orders
@@ -319,26 +632,26 @@ func (b *basicRepository) FillOrders(ctx context.Context, orders []photocycle.Or
 	if err != nil {
 		return err
 	}
-	_, err = t.Exec(oSQL, oArgs...)
+	_, err = t.ExecContext(ctx, oSQL, oArgs...)
 	if err != nil {
 		t.Rollback()
 		return err
 	}
 
-	_, err = t.Exec(xSQL, xArgs...)
+	_, err = t.ExecContext(ctx, xSQL, xArgs...)
 	if err != nil {
 		t.Rollback()
 		return err
 	}
 	if len(pVals) > 0 {
-		_, err = t.Exec(pSQL, pArgs...)
+		_, err = t.ExecContext(ctx, pSQL, pArgs...)
 		if err != nil {
 			t.Rollback()
 			return err
 		}
 	}
 	if len(fVals) > 0 {
-		_, err = t.Exec(fSQL, fArgs...)
+		_, err = t.ExecContext(ctx, fSQL, fArgs...)
 		if err != nil {
 			t.Rollback()
 			return err
@@ -468,6 +781,93 @@ func (b *basicRepository) GetCurrentOrders(ctx context.Context, source int) ([]p
 	return res, err
 }
 
+func (b *basicRepository) GetStatusOutbox(ctx context.Context, limit int) ([]photocycle.StatusPush, error) {
+	var sb strings.Builder
+	sb.WriteString("SELECT so.id, so.source, so.entity, so.entity_id, so.group_id, so.src_id, so.state, so.site_status, so.idem_key, so.created, so.attempt, IFNULL(so.next_attempt, so.created) next_attempt, so.last_error, so.dead")
+	sb.WriteString(" FROM status_outbox so")
+	sb.WriteString(" WHERE so.sent IS NULL AND so.dead = 0 AND (so.next_attempt IS NULL OR so.next_attempt <= NOW())")
+	sb.WriteString(" ORDER BY so.id")
+	sb.WriteString(" LIMIT ?")
+	res := []photocycle.StatusPush{}
+	err := b.db.SelectContext(ctx, &res, sb.String(), limit)
+	return res, err
+}
+
+func (b *basicRepository) StatusOutboxUpdate(ctx context.Context, p photocycle.StatusPush) error {
+	if b.readOnly {
+		return nil
+	}
+	sql := "UPDATE status_outbox SET attempt = ?, next_attempt = ?, last_error = LEFT(?, 250), dead = ?, sent = IF(?, NOW(), NULL) WHERE id = ?"
+	_, err := b.db.ExecContext(ctx, sql, p.Attempt, p.NextAttempt, p.LastError, p.Dead, p.Sent, p.ID)
+	return err
+}
+
+func (b *basicRepository) GetActiveAlerts(ctx context.Context) ([]photocycle.StateAlert, error) {
+	sql := "SELECT sa.id, sa.source, sa.group_id, sa.state, sa.state_date, sa.created FROM state_alert sa WHERE sa.resolved IS NULL ORDER BY sa.source, sa.created"
+	res := []photocycle.StateAlert{}
+	err := b.db.SelectContext(ctx, &res, sql)
+	return res, err
+}
+
+func (b *basicRepository) AddAlerts(ctx context.Context, alerts []photocycle.StateAlert) ([]photocycle.StateAlert, error) {
+	if b.readOnly || len(alerts) == 0 {
+		return alerts, nil
+	}
+	//one row per insert, unique key state_alert_active_uk skips alert that is already active
+	sql := "INSERT IGNORE INTO state_alert (source, group_id, state, state_date, created) VALUES (?, ?, ?, ?, NOW())"
+	saved := make([]photocycle.StateAlert, 0, len(alerts))
+	for _, a := range alerts {
+		res, err := b.db.ExecContext(ctx, sql, a.Source, a.GroupID, a.State, a.StateDate)
+		if err != nil {
+			return saved, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		if id, err := res.LastInsertId(); err == nil {
+			a.ID = int(id)
+		}
+		saved = append(saved, a)
+	}
+	return saved, nil
+}
+
+func (b *basicRepository) ResolveAlerts(ctx context.Context, ids []int) error {
+	if b.readOnly || len(ids) == 0 {
+		return nil
+	}
+	query, args, err := sqlx.In("UPDATE state_alert SET resolved = NOW() WHERE id IN (?) AND resolved IS NULL", ids)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.ExecContext(ctx, b.db.Rebind(query), args...)
+	return err
+}
+
+func (b *basicRepository) CancelGroup(ctx context.Context, source, group, state int, message string) (int, error) {
+	if b.readOnly {
+		return 0, nil
+	}
+	//active orders, same as GetCurrentOrders
+	where := " WHERE o.source = ? AND o.group_id = ? AND o.state BETWEEN 100 AND 450"
+	t, err := b.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	_, err = t.ExecContext(ctx, "INSERT INTO state_log (order_id, state, state_date, comment) SELECT o.id, ?, NOW(), LEFT(?, 250) FROM orders o"+where, state, message, source, group)
+	if err != nil {
+		t.Rollback()
+		return 0, err
+	}
+	r, err := t.ExecContext(ctx, "UPDATE orders o SET o.state = ?, o.state_date = NOW()"+where, state, source, group)
+	if err != nil {
+		t.Rollback()
+		return 0, err
+	}
+	n, _ := r.RowsAffected()
+	return int(n), t.Commit()
+}
+
 func (b *basicRepository) GetJSONMaps(ctx context.Context) (map[int][]photocycle.JSONMap, error) {
 	res := []photocycle.JSONMap{}
 	var sb strings.Builder
@@ -512,6 +912,30 @@ func (b *basicRepository) GetDeliveryMaps(ctx context.Context) (map[int]map[int]
 	return resMap, err
 }
 
+func (b *basicRepository) AddDeliveryUnmapped(ctx context.Context, source, nativeID, packageID int) error {
+	if b.readOnly {
+		return nil
+	}
+	sql := "INSERT INTO delivery_unmapped (source, native_id, package_id, first_seen, last_seen) VALUES (?, ?, ?, NOW(), NOW()) ON DUPLICATE KEY UPDATE last_seen = NOW()"
+	_, err := b.db.ExecContext(ctx, sql, source, nativeID, packageID)
+	return err
+}
+
+func (b *basicRepository) GetDeliveryUnmapped(ctx context.Context) ([]photocycle.DeliveryUnmapped, error) {
+	res := []photocycle.DeliveryUnmapped{}
+	var sb strings.Builder
+	sb.WriteString("SELECT du.source, du.native_id, COUNT(*) packages,")
+	sb.WriteString(" SUBSTRING_INDEX(GROUP_CONCAT(du.package_id ORDER BY du.last_seen DESC), ',', 5) sample,")
+	sb.WriteString(" MIN(du.first_seen) first_seen, MAX(du.last_seen) last_seen")
+	sb.WriteString(" FROM delivery_unmapped du")
+	sb.WriteString(" LEFT OUTER JOIN delivery_type_dictionary dtd ON du.source = dtd.source AND du.native_id = dtd.site_id AND dtd.delivery_type != 0")
+	sb.WriteString(" WHERE dtd.source IS NULL")
+	sb.WriteString(" GROUP BY du.source, du.native_id")
+	sb.WriteString(" ORDER BY du.source, du.native_id")
+	err := b.db.SelectContext(ctx, &res, sb.String())
+	return res, err
+}
+
 func (b *basicRepository) GetPrintPostedEFI(ctx context.Context) ([]photocycle.PrintPostedEFI, error) {
 	res := []photocycle.PrintPostedEFI{}
 	var sb strings.Builder
@@ -535,3 +959,47 @@ func (b *basicRepository) SetPrintedEFI(ctx context.Context, printgroupID string
 	_, err := b.db.ExecContext(ctx, sql, printgroupID)
 	return err
 }
+
+//TryLock gets MySQL named lock (GET_LOCK) on dedicated connection, lock name is prefixed by database name
+func (b *basicRepository) TryLock(ctx context.Context, name string) (photocycle.Lock, error) {
+	conn, err := b.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var res sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(LEFT(CONCAT(DATABASE(), '.', ?), 64), 0)", name).Scan(&res)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !res.Valid || res.Int64 != 1 {
+		//held by other connection
+		conn.Close()
+		return nil, nil
+	}
+	return &dbLock{conn: conn, name: name}, nil
+}
+
+//dbLock MySQL named lock, lock is released by server if connection is lost
+type dbLock struct {
+	conn *sql.Conn
+	name string
+}
+
+//IsHeld checks lock is held by lock connection, fails if connection is lost
+func (l *dbLock) IsHeld(ctx context.Context) (bool, error) {
+	var res sql.NullBool
+	err := l.conn.QueryRowContext(ctx, "SELECT IS_USED_LOCK(LEFT(CONCAT(DATABASE(), '.', ?), 64)) = CONNECTION_ID()", l.name).Scan(&res)
+	if err != nil {
+		return false, err
+	}
+	return res.Valid && res.Bool, nil
+}
+
+func (l *dbLock) Release() error {
+	_, err := l.conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(LEFT(CONCAT(DATABASE(), '.', ?), 64))", l.name)
+	if cerr := l.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -5,16 +5,31 @@ import (
 	"fmt"
 
 	"github.com/egorka-gh/photocycle/infrastructure/api"
-	"github.com/spf13/viper"
+	"github.com/egorka-gh/photocycle/logging"
+	log "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 )
 
-func initCheckPrinted(j *baseJob) error {
-	//TODO check some
-	j.debug = viper.GetBool("efi.debug")
+//printedEFIJob checks in EFI if posted printgroups are printed
+type printedEFIJob struct {
+	baseJob
+	//dryRun only logs efi list, printgroups are not marked printed (efi.debug)
+	dryRun bool
+}
+
+func initCheckPrinted(j *printedEFIJob, c PrintedEFIConfig) error {
+	//check efi settings
+	if _, err := api.NewEFI(j.creds.EFI); err != nil {
+		return err
+	}
+	j.dryRun = c.Debug
+	if j.dryRun {
+		level.Warn(j.logger).Log(logging.KeyMsg, "efi.debug is on, printgroups are not marked printed")
+	}
 	return nil
 }
 
-func checkPrinted(ctx context.Context, j *baseJob) error {
+func checkPrinted(ctx context.Context, j *printedEFIJob, logger log.Logger) error {
 
 	//get printgroups in state printpost
 	pgs, err := j.repo.GetPrintPostedEFI(ctx)
@@ -26,7 +41,7 @@ func checkPrinted(ctx context.Context, j *baseJob) error {
 		return nil
 	}
 
-	e, err := api.NewEFI()
+	e, err := api.NewEFI(j.creds.EFI)
 	if err != nil {
 		return err
 	}
@@ -42,8 +57,8 @@ func checkPrinted(ctx context.Context, j *baseJob) error {
 		if err != nil {
 			return err
 		}
-		if j.debug {
-			j.logger.Log("debug", fmt.Sprintf("mask %s,responce %+v", mask, itms))
+		level.Debug(logger).Log(logging.KeyMsg, "efi list", logging.KeyPrintgroup, p.PrintgroupID, "mask", mask, "responce", fmt.Sprintf("%+v", itms))
+		if j.dryRun {
 			continue
 		}
 
@@ -57,6 +72,9 @@ func checkPrinted(ctx context.Context, j *baseJob) error {
 		if len(m) == p.FilesCount {
 			//all files printed
 			//mark in database
+			if err = j.checkLock(ctx, logger); err != nil {
+				return err
+			}
 			err = j.repo.SetPrintedEFI(ctx, p.PrintgroupID)
 			if err != nil {
 				return err
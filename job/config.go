@@ -0,0 +1,89 @@
+package job
+
+//Config jobs settings, caller reads them from config file sections (run, fillBox, import ...)
+type Config struct {
+	Run        RunConfig
+	FillBox    FillBoxConfig
+	Import     ImportConfig
+	WebSync    WebSyncConfig
+	StatusPush StatusPushConfig
+	Stale      StaleConfig
+	Netprint   NetprintConfig
+	EFI        PrintedEFIConfig
+}
+
+//RunConfig runner settings
+type RunConfig struct {
+	//Interval run interval in minutes
+	Interval int
+	//Lock runs jobs under database lock
+	Lock bool
+	//BackoffMax max skip of failing job in minutes
+	BackoffMax int
+	//Watchdog runner stall limit in minutes, 0 - watchdog off
+	Watchdog int
+	//HeartbeatFile heartbeat file updated by watchdog
+	HeartbeatFile string
+}
+
+//RetryConfig failure policy settings, delays in minutes
+type RetryConfig struct {
+	MaxAttempts   int
+	RetryDelay    int
+	RetryMaxDelay int
+}
+
+//FillBoxConfig fillBox job settings
+type FillBoxConfig struct {
+	Off         bool
+	Workers     int
+	RetryConfig `mapstructure:",squash"`
+	//MapsReload json and delivery maps reload interval in minutes, used by import too
+	MapsReload     int
+	StrictDelivery bool
+}
+
+//ImportConfig import job settings
+type ImportConfig struct {
+	Off bool
+	//Batch max groups per source per run
+	Batch int
+}
+
+//WebSyncConfig webSync job settings
+type WebSyncConfig struct {
+	Off      bool
+	Interval int
+	//Canceled site statuses of canceled groups
+	Canceled []int
+}
+
+//StatusPushConfig statusPush job settings
+type StatusPushConfig struct {
+	Off         bool
+	Batch       int
+	RetryConfig `mapstructure:",squash"`
+}
+
+//StaleConfig stale job settings
+type StaleConfig struct {
+	Off      bool
+	Interval int
+	//SLA max minutes in state by state
+	SLA map[string]int
+}
+
+//NetprintConfig netprint job settings
+type NetprintConfig struct {
+	Off      bool
+	Interval int
+	//Offset sync offset in hours
+	Offset int
+}
+
+//PrintedEFIConfig printedEFI job settings, EFI api settings are in Credentials
+type PrintedEFIConfig struct {
+	Off bool
+	//Debug dry run, printgroups are not marked printed
+	Debug bool
+}
@@ -2,27 +2,90 @@ package job
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/egorka-gh/photocycle"
 	"github.com/egorka-gh/photocycle/infrastructure/api"
+	"github.com/egorka-gh/photocycle/logging"
+	"github.com/egorka-gh/photocycle/notify"
+	log "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 )
 
-func initFillBoxes(j *baseJob) error {
-	b, err := api.CreateBuilder(j.repo)
+//fillBoxJob loads packages from package_new
+type fillBoxJob struct {
+	baseJob
+	mapsLoader
+	retry   retryPolicy
+	workers int
+	//strict keeps packages with unmapped delivery in package_new
+	strict bool
+}
+
+//mapsLoader holds builder of jobs that use site json and delivery maps,
+//maps are reloaded by interval or by Reload request
+type mapsLoader struct {
+	builder *api.Builder
+	//builder maps reload interval, 0 - reload by request only
+	mapsReload time.Duration
+	mapsLoaded time.Time
+	//reload requested, set by Reload
+	reload int32
+}
+
+//initMaps creates builder, sets reload interval in minutes
+func (m *mapsLoader) initMaps(repo photocycle.Repository, reload int) error {
+	b, err := api.CreateBuilder(repo)
 	if err != nil {
+		return err
+	}
+	m.builder = b
+	m.mapsLoaded = time.Now()
+	m.mapsReload = time.Minute * time.Duration(reload)
+	return nil
+}
+
+//Reload requests maps reload on next run
+func (m *mapsLoader) Reload() {
+	atomic.StoreInt32(&m.reload, 1)
+}
+
+func initFillBoxes(j *fillBoxJob, c FillBoxConfig) error {
+	if err := j.initMaps(j.repo, c.MapsReload); err != nil {
 		return fmt.Errorf("initFillBoxes error: %s", err.Error())
 	}
-	j.builder = b
+	j.retry = newRetryPolicy(c.RetryConfig)
+	j.strict = c.StrictDelivery
+	j.workers = c.Workers
+	if j.workers <= 0 {
+		j.workers = 4
+	}
 	return nil
 }
 
-func fillBoxes(ctx context.Context, j *baseJob) error {
-	//create api clients map
-	var clients = make(map[int]api.FFService)
-	var hasBox = make(map[int]bool)
+//sourceResult fillBoxes counters by source
+type sourceResult struct {
+	source   int
+	found    int
+	added    int
+	failed   int
+	held     int
+	skipped  int
+	canceled bool
+	//err source panic
+	err error
+}
+
+//fillBoxes processes package_new, sources run in parallel (up to j.workers),
+//groups of one source are processed sequentially
+func fillBoxes(ctx context.Context, j *fillBoxJob, logger log.Logger) error {
+	reloadMaps(ctx, &j.mapsLoader, logger)
 	su, err := j.repo.GetSourceUrls(ctx)
 	if err != nil {
 		return fmt.Errorf("repository.GetSourceUrls error: %s", err.Error())
@@ -30,18 +93,6 @@ func fillBoxes(ctx context.Context, j *baseJob) error {
 	if len(su) == 0 {
 		return nil
 	}
-	for _, u := range su {
-		c := &http.Client{
-			Timeout: time.Second * 40,
-		}
-		cl, err := api.NewClient(c, u.URL, u.AppKey)
-		if err != nil {
-			return err
-		}
-
-		clients[u.ID] = cl
-		hasBox[u.ID] = u.HasBoxes
-	}
 	//fetch not processed groups
 	grps, err := j.repo.GetNewPackages(ctx)
 	if err != nil {
@@ -50,108 +101,255 @@ func fillBoxes(ctx context.Context, j *baseJob) error {
 	if len(grps) == 0 {
 		return nil
 	}
-	//get boxes first
-	filled := make([]*photocycle.Package, 0, len(grps))
+	bySource := make(map[int][]photocycle.PackageNew)
 	for _, g := range grps {
-		//check cancel
-		if err := ctx.Err(); err != nil {
-			return err
-		}
-		cl, ok := clients[g.Source]
+		bySource[g.Source] = append(bySource[g.Source], g)
+	}
+
+	results := make(chan sourceResult, len(su))
+	sem := make(chan struct{}, j.workers)
+	var wg sync.WaitGroup
+	for _, u := range su {
+		sg, ok := bySource[u.ID]
 		if !ok {
-			return fmt.Errorf("source %d not found", g.Source)
-		}
-		if !cl.Active() {
 			continue
 		}
-		var gbs *api.GroupBoxes
-		if hasBox[g.Source] {
-			//load boxes from site
-			gbs, err = cl.GetBoxes(ctx, g.ID)
-			if err != nil || gbs == nil || len(gbs.Boxes) == 0 {
-				//boxes not filled or some error
-				if err != nil {
-					j.logger.Log("error", fmt.Sprintf("source %d; group %d; api.GetBoxes error: %s", g.Source, g.ID, err.Error()))
+		delete(bySource, u.ID)
+		wg.Add(1)
+		go func(u photocycle.SourceURL, sg []photocycle.PackageNew) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				results <- sourceResult{source: u.ID, found: len(sg), canceled: true}
+				return
+			}
+			defer func() { <-sem }()
+			results <- safeFillSource(ctx, j, logger, u, sg)
+		}(u, sg)
+	}
+	for source, sg := range bySource {
+		level.Error(logger).Log(logging.KeyMsg, "source not found, groups skipped", logging.KeySource, source, "groups", len(sg))
+	}
+	wg.Wait()
+	close(results)
 
-				}
-				//increment err counter and skip
-				g.Attempt++
-				if g.Attempt < 4 {
-					//maybe it's not ready
-					//try next time
-					j.repo.NewPackageUpdate(ctx, g)
-					continue
-				}
+	found, added := 0, 0
+	var panicErr error
+	for r := range results {
+		found += r.found
+		added += r.added
+		if r.err != nil {
+			level.Error(logger).Log(logging.KeyMsg, "source panic", logging.KeySource, r.source, logging.KeyErr, r.err)
+			if panicErr == nil {
+				panicErr = r.err
 			}
 		}
+		level.Info(logger).Log(logging.KeyMsg, "source result", logging.KeySource, r.source, "found", r.found, "added", r.added, "failed", r.failed, "held", r.held, "skipped", r.skipped, "canceled", r.canceled)
+	}
+	level.Info(logger).Log(logging.KeyMsg, "result", "found", found, "added", added)
+	if panicErr != nil {
+		//runner logs stack and notifies
+		return panicErr
+	}
+	return ctx.Err()
+}
+
+//safeFillSource runs fillSource in source worker, panic is returned as panicError in source result,
+//so other sources are not affected
+func safeFillSource(ctx context.Context, j *fillBoxJob, logger log.Logger, u photocycle.SourceURL, grps []photocycle.PackageNew) (res sourceResult) {
+	defer func() {
+		if v := recover(); v != nil {
+			res = sourceResult{source: u.ID, found: len(grps), skipped: len(grps), err: newPanicError(v)}
+		}
+	}()
+	return fillSource(ctx, j, logger, u, grps)
+}
 
-		//j.logger.Log("boxes", fmt.Sprintf("%v", gbs))
+//reloadMaps reloads builder maps if requested or reload interval elapsed,
+//keeps previous maps if reload fails
+func reloadMaps(ctx context.Context, j *mapsLoader, logger log.Logger) {
+	requested := atomic.CompareAndSwapInt32(&j.reload, 1, 0)
+	if !requested && (j.mapsReload <= 0 || time.Since(j.mapsLoaded) < j.mapsReload) {
+		return
+	}
+	j.mapsLoaded = time.Now()
+	changes, err := j.builder.Reload(ctx)
+	if err != nil {
+		level.Error(logger).Log(logging.KeyMsg, "reload maps failed, previous maps are used", logging.KeyErr, err)
+		return
+	}
+	if len(changes) == 0 {
+		level.Info(logger).Log(logging.KeyMsg, "maps reloaded, no changes")
+		return
+	}
+	level.Info(logger).Log(logging.KeyMsg, "maps reloaded", "changes", len(changes))
+	for _, c := range changes {
+		level.Info(logger).Log(logging.KeyMsg, "maps change", "change", c)
+	}
+}
 
-		//get group (raw)
-		raw, err := cl.GetGroup(ctx, g.ID)
-		if err != nil {
-			j.logger.Log("error", fmt.Sprintf("source %d; group %d; api.GetGroup error: %s", g.Source, g.ID, err.Error()))
-			g.Attempt++
-			j.repo.NewPackageUpdate(ctx, g)
-			continue
+//fillSource processes groups of one source, uses own api client
+func fillSource(ctx context.Context, j *fillBoxJob, logger log.Logger, u photocycle.SourceURL, grps []photocycle.PackageNew) sourceResult {
+	res := sourceResult{source: u.ID, found: len(grps)}
+	logger = log.With(logger, logging.KeySource, u.ID)
+	c := &http.Client{
+		Timeout: time.Second * 40,
+	}
+	cl, err := api.NewClient(c, u.URL, u.AppKey, j.creds.GroupKey)
+	if err != nil {
+		level.Error(logger).Log(logging.KeyMsg, "api.NewClient failed", logging.KeyErr, err)
+		res.skipped = len(grps)
+		return res
+	}
+	for i, g := range grps {
+		//check cancel
+		if ctx.Err() != nil {
+			res.canceled = true
+			res.skipped += len(grps) - i
+			return res
 		}
-		group, err := j.builder.BuildPackage(g.Source, raw)
-		if err != nil {
-			j.logger.Log("error", fmt.Sprintf("source %d; group %d; api.BuildPackage error: %s", g.Source, g.ID, err.Error()))
-			g.Attempt++
-			j.repo.NewPackageUpdate(ctx, g)
-			continue
+		if !cl.Active() {
+			//broken or over calls limit
+			res.skipped += len(grps) - i
+			j.alert(notify.KindBreaker, u.ID, fmt.Sprintf("api client is not active, groups skipped %d", len(grps)-i))
+			return res
+		}
+		if j.checkLock(ctx, logger) != nil {
+			res.canceled = true
+			res.skipped += len(grps) - i
+			return res
 		}
+		gctx, glog, span := startItem(ctx, logger, "group", logging.KeySource, g.Source, logging.KeyGroup, g.ID)
+		outcome, err := fillGroup(gctx, j, cl, glog, u, g)
+		span.End(err)
+		switch outcome {
+		case groupAdded:
+			res.added++
+		case groupFailed:
+			res.failed++
+		case groupHeld:
+			res.held++
+		}
+	}
+	return res
+}
 
-		//fill boxes
-		group.Boxes = make([]photocycle.PackageBox, 0)
-		// can be nil if site not support boxes
-		if gbs != nil {
-			for _, ba := range gbs.Boxes {
-				bg := photocycle.PackageBox{
-					Source:    group.Source,
-					PackageID: group.ID,
-					ID:        fmt.Sprintf("%d-%d", group.Source, ba.ID),
-					Num:       ba.Number,
-					Barcode:   ba.Barcode,
-					Price:     ba.Price,
-					Weight:    ba.Weight,
-				}
-				bg.Items = make([]photocycle.PackageBoxItem, 0, len(ba.Items))
-				for _, bi := range ba.Items {
-					i := photocycle.PackageBoxItem{
-						BoxID:   bg.ID,
-						OrderID: fmt.Sprintf("%d_%d", group.Source, bi.OrderID),
-						Alias:   bi.Alias,
-						Type:    bi.Type,
-						From:    bi.From,
-						To:      bi.To,
-					}
-					bg.Items = append(bg.Items, i)
+//fillGroup outcomes
+const (
+	groupAdded = iota
+	groupFailed
+	groupHeld
+)
+
+//fillGroup loads group from site and saves package
+func fillGroup(ctx context.Context, j *fillBoxJob, cl api.FFService, logger log.Logger, u photocycle.SourceURL, g photocycle.PackageNew) (int, error) {
+	var gbs *api.GroupBoxes
+	var err error
+	if u.HasBoxes {
+		//load boxes from site
+		gbs, err = cl.GetBoxes(ctx, g.ID)
+		if err != nil || gbs == nil || len(gbs.Boxes) == 0 {
+			//boxes not filled or some error
+			if err != nil {
+				level.Error(logger).Log(logging.KeyMsg, "api.GetBoxes failed", logging.KeyGroup, g.ID, logging.KeyErr, err)
+
+			}
+			//increment err counter and skip
+			if g.Attempt < 3 {
+				//maybe it's not ready
+				//try next time
+				if err == nil {
+					err = errors.New("boxes not filled")
 				}
-				group.Boxes = append(group.Boxes, bg)
+				failPackage(ctx, j, logger, g, err)
+				return groupFailed, err
 			}
 		}
-		//save here to give some gap between api calls
-		//persist && del
-		err = j.repo.PackageAddWithBoxes(ctx, []*photocycle.Package{group})
-		if err != nil {
-			j.logger.Log("error", fmt.Sprintf("source %d; group %d; repository.PackageAddWithBoxes error: %s", g.Source, g.ID, err.Error()))
-		} else {
-			filled = append(filled, group)
+	}
+
+	//get group (raw)
+	raw, err := cl.GetGroup(ctx, g.ID)
+	if err != nil {
+		level.Error(logger).Log(logging.KeyMsg, "api.GetGroup failed", logging.KeyGroup, g.ID, logging.KeyErr, err)
+		failPackage(ctx, j, logger, g, err)
+		return groupFailed, err
+	}
+	group, warnings, err := j.builder.BuildPackage(g.Source, raw)
+	if err != nil {
+		level.Error(logger).Log(logging.KeyMsg, "api.BuildPackage failed", logging.KeyGroup, g.ID, logging.KeyErr, err)
+		failPackage(ctx, j, logger, g, err)
+		return groupFailed, err
+	}
+	for _, w := range warnings {
+		level.Warn(logger).Log(logging.KeyMsg, w.Message, logging.KeyGroup, g.ID, "code", w.Code)
+	}
+	if api.HasWarning(warnings, api.WarnDeliveryUnmapped) {
+		if err = j.repo.AddDeliveryUnmapped(ctx, g.Source, group.NativeDeliveryID, g.ID); err != nil {
+			level.Error(logger).Log(logging.KeyMsg, "repository.AddDeliveryUnmapped failed", logging.KeyGroup, g.ID, logging.KeyErr, err)
+		}
+		if j.strict {
+			//wait for mapping
+			holdPackage(ctx, j, logger, g, fmt.Sprintf("delivery %d not mapped", group.NativeDeliveryID))
+			return groupHeld, nil
 		}
-		//filled = append(filled, group)
 	}
-	j.logger.Log("result", fmt.Sprintf("Groups found %d, added %d", len(grps), len(filled)))
-	/*
-			//persist && del processed
-			err = j.repo.PackageAddWithBoxes(ctx, filled)
-			if err != nil {
-				err = fmt.Errorf("repository.PackageAddWithBoxes error: %s", err.Error())
-			} else {
-				j.logger.Log("result", fmt.Sprintf("Groups found %d, added %d", len(grps), len(filled)))
-			}
-		return err
-	*/
-	return nil
+
+	//fill boxes from get_group_boxes, otherwise keep boxes built from group payload
+	api.ApplyBoxes(group, gbs)
+	//check box items orders
+	if err = j.builder.CheckOrders(ctx, group); err != nil {
+		level.Error(logger).Log(logging.KeyMsg, "CheckOrders failed", logging.KeyGroup, g.ID, logging.KeyErr, err)
+		failPackage(ctx, j, logger, g, err)
+		return groupFailed, err
+	}
+	for _, i := range group.Issues {
+		level.Warn(logger).Log(logging.KeyMsg, i.Issue, logging.KeyGroup, g.ID, "box", i.BoxID, logging.KeyOrder, i.OrderID)
+	}
+	//save here to give some gap between api calls
+	//persist && del
+	created, changes, err := SavePackage(ctx, j.repo, group)
+	if err != nil {
+		level.Error(logger).Log(logging.KeyMsg, "SavePackage failed", logging.KeyGroup, g.ID, logging.KeyErr, err)
+		failPackage(ctx, j, logger, g, err)
+		return groupFailed, err
+	}
+	if !created {
+		level.Info(logger).Log(logging.KeyMsg, "existing package updated", logging.KeyGroup, g.ID, "changes", len(changes))
+	}
+	return groupAdded, nil
+}
+
+//SavePackage adds new package or updates existing one if site changed it.
+//returns changes of existing package
+func SavePackage(ctx context.Context, repo photocycle.Repository, p *photocycle.Package) (created bool, changes []photocycle.PackageChange, err error) {
+	old, err := repo.LoadPackage(ctx, p.Source, p.ID)
+	if err == sql.ErrNoRows {
+		return true, nil, repo.PackageAddWithBoxes(ctx, []*photocycle.Package{p})
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	changes = photocycle.DiffPackage(old, p)
+	return false, changes, repo.PackageUpdate(ctx, p, changes)
+}
+
+//holdPackage postpones package without counting attempt
+func holdPackage(ctx context.Context, j *fillBoxJob, logger log.Logger, g photocycle.PackageNew, reason string) {
+	j.retry.hold(&g, reason, time.Now())
+	if err := j.repo.NewPackageUpdate(ctx, g); err != nil {
+		level.Error(logger).Log(logging.KeyMsg, "repository.NewPackageUpdate failed", logging.KeySource, g.Source, logging.KeyGroup, g.ID, logging.KeyErr, err)
+	}
+}
+
+//failPackage registers failed attempt, package became dead after max attempts
+func failPackage(ctx context.Context, j *fillBoxJob, logger log.Logger, g photocycle.PackageNew, err error) {
+	j.retry.fail(&g, err, time.Now())
+	if g.Dead {
+		level.Error(logger).Log(logging.KeyMsg, "package is dead", logging.KeySource, g.Source, logging.KeyGroup, g.ID, "attempts", g.Attempt, logging.KeyErr, g.LastError)
+		j.alert(notify.KindDeadPackage, g.Source, fmt.Sprintf("group %d is dead after %d attempts, last error: %s", g.ID, g.Attempt, g.LastError))
+	}
+	if err := j.repo.NewPackageUpdate(ctx, g); err != nil {
+		level.Error(logger).Log(logging.KeyMsg, "repository.NewPackageUpdate failed", logging.KeySource, g.Source, logging.KeyGroup, g.ID, logging.KeyErr, err)
+	}
 }
@@ -0,0 +1,216 @@
+package job
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/egorka-gh/photocycle"
+	"github.com/egorka-gh/photocycle/infrastructure/api"
+	log "github.com/go-kit/kit/log"
+)
+
+//stubRepo implements used photocycle.Repository methods, others panic
+type stubRepo struct {
+	photocycle.Repository
+	mu       sync.Mutex
+	sources  []photocycle.SourceURL
+	packages []photocycle.PackageNew
+	added    []*photocycle.Package
+	updated  []photocycle.PackageNew
+	orders   map[string]int
+	unmapped []int
+}
+
+func (r *stubRepo) GetSourceUrls(ctx context.Context) ([]photocycle.SourceURL, error) {
+	return r.sources, nil
+}
+
+func (r *stubRepo) GetNewPackages(ctx context.Context) ([]photocycle.PackageNew, error) {
+	return r.packages, nil
+}
+
+func (r *stubRepo) NewPackageUpdate(ctx context.Context, g photocycle.PackageNew) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.updated = append(r.updated, g)
+	return nil
+}
+
+func (r *stubRepo) PackageAddWithBoxes(ctx context.Context, packages []*photocycle.Package) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.added = append(r.added, packages...)
+	return nil
+}
+
+func (r *stubRepo) LoadPackage(ctx context.Context, source, id int) (*photocycle.Package, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (r *stubRepo) GetOrderStates(ctx context.Context, ids []string) (map[string]int, error) {
+	res := make(map[string]int)
+	for _, id := range ids {
+		if s, ok := r.orders[id]; ok {
+			res[id] = s
+		}
+	}
+	return res, nil
+}
+
+func (r *stubRepo) AddDeliveryUnmapped(ctx context.Context, source, nativeID, packageID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unmapped = append(r.unmapped, packageID)
+	return nil
+}
+
+func (r *stubRepo) GetJSONMaps(ctx context.Context) (map[int][]photocycle.JSONMap, error) {
+	return map[int][]photocycle.JSONMap{
+		5: {{Family: 5, JSONKey: "id", Field: "id"}},
+		6: {},
+	}, nil
+}
+
+func (r *stubRepo) GetDeliveryMaps(ctx context.Context) (map[int]map[int]photocycle.DeliveryTypeMapping, error) {
+	return map[int]map[int]photocycle.DeliveryTypeMapping{}, nil
+}
+
+//stubSite serves group api, records requested groups
+type stubSite struct {
+	mu    sync.Mutex
+	delay time.Duration
+	calls []int
+}
+
+func (s *stubSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(s.delay)
+	r.ParseForm()
+	id, _ := strconv.Atoi(r.Form.Get("args[number]"))
+	s.mu.Lock()
+	s.calls = append(s.calls, id)
+	s.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{"id": id}})
+}
+
+func TestFillBoxesBySource(t *testing.T) {
+	slow := &stubSite{delay: 200 * time.Millisecond}
+	fast := &stubSite{}
+	slowSrv := httptest.NewServer(slow)
+	defer slowSrv.Close()
+	fastSrv := httptest.NewServer(fast)
+	defer fastSrv.Close()
+
+	rep := &stubRepo{
+		sources: []photocycle.SourceURL{
+			{ID: 1, URL: slowSrv.URL + "/"},
+			{ID: 2, URL: fastSrv.URL + "/"},
+		},
+		packages: []photocycle.PackageNew{
+			{Source: 1, ID: 11}, {Source: 2, ID: 21}, {Source: 1, ID: 12}, {Source: 2, ID: 22}, {Source: 1, ID: 13},
+		},
+	}
+	b, err := api.CreateBuilder(rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &fillBoxJob{baseJob: baseJob{repo: rep, logger: log.NewNopLogger(), creds: Credentials{GroupKey: "test"}}, mapsLoader: mapsLoader{builder: b}, workers: 2, retry: newRetryPolicy(RetryConfig{})}
+
+	start := time.Now()
+	if err := fillBoxes(context.Background(), j, j.logger); err != nil {
+		t.Fatalf("fillBoxes error %q", err.Error())
+	}
+	if len(rep.added) != 5 {
+		t.Errorf("Expected 5 packages added, got %d", len(rep.added))
+	}
+	//sources run in parallel, so total time is about slow source time
+	if d := time.Since(start); d > 900*time.Millisecond {
+		t.Errorf("Expected sources to run in parallel, took %v", d)
+	}
+	//groups of one source are requested in order
+	if want := []int{11, 12, 13}; !equalInts(slow.calls, want) {
+		t.Errorf("Expected slow source calls %v, got %v", want, slow.calls)
+	}
+	if want := []int{21, 22}; !equalInts(fast.calls, want) {
+		t.Errorf("Expected fast source calls %v, got %v", want, fast.calls)
+	}
+}
+
+func TestFillBoxesStrictDelivery(t *testing.T) {
+	srv := httptest.NewServer(&stubSite{})
+	defer srv.Close()
+	rep := &stubRepo{
+		sources:  []photocycle.SourceURL{{ID: 1, URL: srv.URL + "/"}},
+		packages: []photocycle.PackageNew{{Source: 1, ID: 11, Attempt: 2}},
+	}
+	b, err := api.CreateBuilder(rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &fillBoxJob{baseJob: baseJob{repo: rep, logger: log.NewNopLogger(), creds: Credentials{GroupKey: "test"}}, mapsLoader: mapsLoader{builder: b}, workers: 1, retry: newRetryPolicy(RetryConfig{}), strict: true}
+	if err := fillBoxes(context.Background(), j, j.logger); err != nil {
+		t.Fatalf("fillBoxes error %q", err.Error())
+	}
+	if len(rep.added) != 0 {
+		t.Errorf("Expected package to be held, got %d added", len(rep.added))
+	}
+	if len(rep.unmapped) != 1 || rep.unmapped[0] != 11 {
+		t.Errorf("Expected unmapped delivery registered for 11, got %v", rep.unmapped)
+	}
+	if len(rep.updated) != 1 || rep.updated[0].Attempt != 2 || rep.updated[0].Dead {
+		t.Errorf("Expected package held without attempt, got %+v", rep.updated)
+	}
+}
+
+//panicRepo panics on save of source 1 packages
+type panicRepo struct {
+	stubRepo
+}
+
+func (r *panicRepo) PackageAddWithBoxes(ctx context.Context, packages []*photocycle.Package) error {
+	if packages[0].Source == 1 {
+		panic("boom")
+	}
+	return r.stubRepo.PackageAddWithBoxes(ctx, packages)
+}
+
+func TestFillBoxesSourcePanic(t *testing.T) {
+	srv := httptest.NewServer(&stubSite{})
+	defer srv.Close()
+	rep := &panicRepo{stubRepo{
+		sources:  []photocycle.SourceURL{{ID: 1, URL: srv.URL + "/"}, {ID: 2, URL: srv.URL + "/"}},
+		packages: []photocycle.PackageNew{{Source: 1, ID: 11}, {Source: 2, ID: 21}, {Source: 2, ID: 22}},
+	}}
+	b, err := api.CreateBuilder(rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &fillBoxJob{baseJob: baseJob{repo: rep, logger: log.NewNopLogger(), creds: Credentials{GroupKey: "test"}}, mapsLoader: mapsLoader{builder: b}, workers: 2, retry: newRetryPolicy(RetryConfig{})}
+	err = fillBoxes(context.Background(), j, j.logger)
+	pe, ok := err.(panicError)
+	if !ok || pe.value != "boom" || pe.stack == "" {
+		t.Fatalf("expected source panic error, got %v", err)
+	}
+	//other source is processed
+	if len(rep.added) != 2 || rep.added[0].Source != 2 {
+		t.Errorf("expected source 2 packages added, got %d", len(rep.added))
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
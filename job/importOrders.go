@@ -0,0 +1,196 @@
+package job
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/egorka-gh/photocycle"
+	"github.com/egorka-gh/photocycle/infrastructure/api"
+	"github.com/egorka-gh/photocycle/logging"
+	log "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+//importJob imports orders structure from sites
+type importJob struct {
+	baseJob
+	mapsLoader
+	//max groups per source per run
+	batch int
+	//requeue orders left in intermediate states on first run
+	requeue bool
+}
+
+//stateTimeout limits state writes done after job context is canceled
+const stateTimeout = 10 * time.Second
+
+//importStates are intermediate states of base order while it is imported
+var importStates = []int{photocycle.StateCheckWeb, photocycle.StateLoadStructure}
+
+func initImport(j *importJob, c ImportConfig, mapsReload int) error {
+	if err := j.initMaps(j.repo, mapsReload); err != nil {
+		return fmt.Errorf("initImport error: %s", err.Error())
+	}
+	j.batch = c.Batch
+	if j.batch <= 0 {
+		j.batch = 10
+	}
+	j.requeue = true
+	return nil
+}
+
+//requeueOrders returns base orders left in intermediate states by interrupted run to StateLoadWaite,
+//runs under job lock so orders of other instance are not affected
+func requeueOrders(ctx context.Context, j *importJob, logger log.Logger, su []photocycle.SourceURL) {
+	cnt := 0
+	for _, u := range su {
+		for _, st := range importStates {
+			for ctx.Err() == nil {
+				base, err := j.repo.LoadBaseOrderByState(ctx, u.ID, st)
+				if err == sql.ErrNoRows {
+					break
+				}
+				if err != nil {
+					level.Error(logger).Log(logging.KeyMsg, "repository.LoadBaseOrderByState failed", logging.KeySource, u.ID, logging.KeyErr, err)
+					break
+				}
+				if err = j.repo.SetOrderState(ctx, base.ID, photocycle.StateLoadWaite); err != nil {
+					level.Error(logger).Log(logging.KeyMsg, "repository.SetOrderState failed", logging.KeyOrder, base.ID, logging.KeyErr, err)
+					break
+				}
+				if err = j.repo.LogState(ctx, base.ID, photocycle.StateLoadWaite, "Повторная загрузка после прерывания"); err != nil {
+					level.Error(logger).Log(logging.KeyMsg, "repository.LogState failed", logging.KeyOrder, base.ID, logging.KeyErr, err)
+				}
+				cnt++
+			}
+		}
+	}
+	if cnt > 0 {
+		level.Info(logger).Log(logging.KeyMsg, "requeued interrupted orders", "count", cnt)
+	}
+}
+
+//importOrders loads structure of base orders (id ends with @) in state StateLoadWaite,
+//base order is group placeholder, group orders are created from site group
+func importOrders(ctx context.Context, j *importJob, logger log.Logger) error {
+	reloadMaps(ctx, &j.mapsLoader, logger)
+	su, err := j.repo.GetSourceUrls(ctx)
+	if err != nil {
+		return fmt.Errorf("repository.GetSourceUrls error: %s", err.Error())
+	}
+	if j.requeue {
+		requeueOrders(ctx, j, logger, su)
+		j.requeue = ctx.Err() != nil
+	}
+	for _, u := range su {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		slog := log.With(logger, logging.KeySource, u.ID)
+		cl, err := api.NewClient(&http.Client{Timeout: time.Second * 40}, u.URL, u.AppKey, j.creds.GroupKey)
+		if err != nil {
+			level.Error(slog).Log(logging.KeyMsg, "api.NewClient failed", logging.KeyErr, err)
+			continue
+		}
+		done, failed := 0, 0
+		for i := 0; i < j.batch; i++ {
+			if ctx.Err() != nil || !cl.Active() || j.checkLock(ctx, slog) != nil {
+				break
+			}
+			base, err := j.repo.LoadBaseOrderByState(ctx, u.ID, photocycle.StateLoadWaite)
+			if err == sql.ErrNoRows {
+				break
+			}
+			if err != nil {
+				level.Error(slog).Log(logging.KeyMsg, "repository.LoadBaseOrderByState failed", logging.KeyErr, err)
+				break
+			}
+			gctx, glog, span := startItem(ctx, slog, "import group", logging.KeySource, base.Source, logging.KeyGroup, base.GroupID)
+			err = importGroup(gctx, j, glog, cl, base)
+			span.End(err)
+			if err != nil {
+				level.Error(glog).Log(logging.KeyMsg, "import failed", logging.KeyOrder, base.ID, logging.KeyGroup, base.GroupID, logging.KeyErr, err)
+				failed++
+				continue
+			}
+			done++
+		}
+		if done > 0 || failed > 0 {
+			level.Info(slog).Log(logging.KeyMsg, "result", "imported", done, "failed", failed)
+		}
+	}
+	return ctx.Err()
+}
+
+//importGroup loads group structure from site, fills group orders and starts them
+func importGroup(ctx context.Context, j *importJob, logger log.Logger, cl api.FFService, base photocycle.Order) error {
+	setState(ctx, j, logger, base.ID, photocycle.StateCheckWeb, "Загрузка группы с сайта")
+	raw, err := cl.GetGroup(ctx, base.GroupID)
+	if err != nil {
+		return setError(ctx, j, logger, base.ID, photocycle.StateErrWeb, fmt.Errorf("api.GetGroup error: %s", err.Error()))
+	}
+
+	setState(ctx, j, logger, base.ID, photocycle.StateLoadStructure, "Загрузка структуры")
+	orders, warnings, err := j.builder.BuildOrders(ctx, base.Source, base.GroupID, raw)
+	if err != nil {
+		return setError(ctx, j, logger, base.ID, photocycle.StateErrStructureLoad, fmt.Errorf("api.BuildOrders error: %s", err.Error()))
+	}
+	for _, w := range warnings {
+		if err := j.repo.LogState(ctx, base.ID, photocycle.StateLoadStructure, w.Message); err != nil {
+			level.Error(logger).Log(logging.KeyMsg, "repository.LogState failed", logging.KeyOrder, base.ID, logging.KeyErr, err)
+		}
+	}
+	if len(orders) == 0 {
+		return setError(ctx, j, logger, base.ID, photocycle.StateErrStructureLoad, errors.New("group has no orders"))
+	}
+	for i := range orders {
+		if orders[i].ClientID == 0 {
+			orders[i].ClientID = base.ClientID
+		}
+		if orders[i].Production == 0 {
+			orders[i].Production = base.Production
+		}
+	}
+
+	//remove orders of previous attempt
+	if err = j.repo.ClearGroup(ctx, base.Source, base.GroupID, base.ID); err != nil {
+		return setError(ctx, j, logger, base.ID, photocycle.StateErrLoad, fmt.Errorf("repository.ClearGroup error: %s", err.Error()))
+	}
+	if err = j.repo.FillOrders(ctx, orders); err != nil {
+		return setError(ctx, j, logger, base.ID, photocycle.StateErrLoad, fmt.Errorf("repository.FillOrders error: %s", err.Error()))
+	}
+	if err = j.repo.StartOrders(ctx, base.Source, base.GroupID, base.ID); err != nil {
+		//don't leave not started orders, even if ctx is canceled
+		dctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+		if gerr := j.repo.SetGroupState(dctx, base.Source, photocycle.StateErrLoad, base.GroupID, base.ID); gerr != nil {
+			level.Error(logger).Log(logging.KeyMsg, "repository.SetGroupState failed", logging.KeyGroup, base.GroupID, logging.KeyErr, gerr)
+		}
+		cancel()
+		return setError(ctx, j, logger, base.ID, photocycle.StateErrLoad, fmt.Errorf("repository.StartOrders error: %s", err.Error()))
+	}
+	setState(ctx, j, logger, base.ID, photocycle.StateLoadComplite, fmt.Sprintf("Загружено заказов %d", len(orders)))
+	return nil
+}
+
+//setState sets order state and logs it
+func setState(ctx context.Context, j *importJob, logger log.Logger, orderID string, state int, message string) {
+	if err := j.repo.SetOrderState(ctx, orderID, state); err != nil {
+		level.Error(logger).Log(logging.KeyMsg, "repository.SetOrderState failed", logging.KeyOrder, orderID, logging.KeyErr, err)
+	}
+	if err := j.repo.LogState(ctx, orderID, state, message); err != nil {
+		level.Error(logger).Log(logging.KeyMsg, "repository.LogState failed", logging.KeyOrder, orderID, logging.KeyErr, err)
+	}
+}
+
+//setError sets order error state, returns err
+//state is written with detached context, so canceled run doesn't leave order in intermediate state
+func setError(ctx context.Context, j *importJob, logger log.Logger, orderID string, state int, err error) error {
+	dctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+	defer cancel()
+	setState(dctx, j, logger, orderID, state, err.Error())
+	return err
+}
@@ -0,0 +1,137 @@
+package job
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/egorka-gh/photocycle"
+	"github.com/egorka-gh/photocycle/infrastructure/api"
+	log "github.com/go-kit/kit/log"
+)
+
+//importRepo records order states
+type importRepo struct {
+	stubRepo
+	base     []photocycle.Order
+	stuck    []photocycle.Order
+	states   []int
+	filled   []photocycle.Order
+	startErr error
+}
+
+func (r *importRepo) LoadBaseOrderByState(ctx context.Context, source, state int) (photocycle.Order, error) {
+	if state != photocycle.StateLoadWaite {
+		for i, o := range r.stuck {
+			if o.State == state {
+				r.stuck = append(r.stuck[:i], r.stuck[i+1:]...)
+				return o, nil
+			}
+		}
+		return photocycle.Order{}, sql.ErrNoRows
+	}
+	if len(r.base) == 0 {
+		return photocycle.Order{}, sql.ErrNoRows
+	}
+	o := r.base[0]
+	r.base = r.base[1:]
+	return o, nil
+}
+
+func (r *importRepo) SetOrderState(ctx context.Context, orderID string, state int) error {
+	r.states = append(r.states, state)
+	return nil
+}
+
+func (r *importRepo) LogState(ctx context.Context, orderID string, state int, message string) error {
+	return nil
+}
+
+func (r *importRepo) ClearGroup(ctx context.Context, source, group int, keepID string) error {
+	return nil
+}
+
+func (r *importRepo) SetGroupState(ctx context.Context, source, state, group int, keepID string) error {
+	return nil
+}
+
+func (r *importRepo) FillOrders(ctx context.Context, orders []photocycle.Order) error {
+	r.filled = append(r.filled, orders...)
+	return nil
+}
+
+func (r *importRepo) StartOrders(ctx context.Context, source, group int, skipID string) error {
+	return r.startErr
+}
+
+func (r *importRepo) LoadAlias(ctx context.Context, alias string) (photocycle.Alias, error) {
+	return photocycle.Alias{}, sql.ErrNoRows
+}
+
+func (r *importRepo) GetJSONMaps(ctx context.Context) (map[int][]photocycle.JSONMap, error) {
+	return map[int][]photocycle.JSONMap{
+		9: {{JSONKey: "id", Field: "src_id"}},
+	}, nil
+}
+
+func TestImportOrders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{
+			"orders": []interface{}{map[string]interface{}{"id": 1.0}, map[string]interface{}{"id": 2.0}},
+		}})
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		startErr error
+		states   []int
+	}{
+		{nil, []int{photocycle.StateCheckWeb, photocycle.StateLoadStructure, photocycle.StateLoadComplite}},
+		{errors.New("start error"), []int{photocycle.StateCheckWeb, photocycle.StateLoadStructure, photocycle.StateErrLoad}},
+	}
+	for _, c := range cases {
+		rep := &importRepo{
+			stubRepo: stubRepo{sources: []photocycle.SourceURL{{ID: 8, URL: srv.URL + "/"}}},
+			base:     []photocycle.Order{{ID: "8_100@", Source: 8, GroupID: 100, ClientID: 5}},
+			startErr: c.startErr,
+		}
+		b, err := api.CreateBuilder(rep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j := &importJob{baseJob: baseJob{repo: rep, logger: log.NewNopLogger(), creds: Credentials{GroupKey: "test"}}, mapsLoader: mapsLoader{builder: b}, batch: 10}
+		if err := importOrders(context.Background(), j, j.logger); err != nil {
+			t.Fatalf("importOrders error %q", err.Error())
+		}
+		if !equalInts(rep.states, c.states) {
+			t.Errorf("expected states %v, got %v", c.states, rep.states)
+		}
+		if len(rep.filled) != 2 || rep.filled[0].ID != "8_1" || rep.filled[0].ClientID != 5 {
+			t.Errorf("unexpected orders %+v", rep.filled)
+		}
+	}
+}
+
+func TestImportRequeue(t *testing.T) {
+	rep := &importRepo{
+		stubRepo: stubRepo{sources: []photocycle.SourceURL{{ID: 8, URL: "http://localhost/"}}},
+		stuck: []photocycle.Order{
+			{ID: "8_100@", Source: 8, GroupID: 100, State: photocycle.StateCheckWeb},
+			{ID: "8_101@", Source: 8, GroupID: 101, State: photocycle.StateLoadStructure},
+		},
+	}
+	j := &importJob{baseJob: baseJob{repo: rep, logger: log.NewNopLogger(), creds: Credentials{GroupKey: "test"}}, batch: 10, requeue: true}
+	if err := importOrders(context.Background(), j, j.logger); err != nil {
+		t.Fatalf("importOrders error %q", err.Error())
+	}
+	if expect := []int{photocycle.StateLoadWaite, photocycle.StateLoadWaite}; !equalInts(rep.states, expect) {
+		t.Errorf("expected states %v, got %v", expect, rep.states)
+	}
+	if j.requeue {
+		t.Error("requeue expected to run once")
+	}
+}
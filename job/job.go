@@ -3,24 +3,59 @@ package job
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"runtime/debug"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/egorka-gh/photocycle"
 	"github.com/egorka-gh/photocycle/infrastructure/api"
+	"github.com/egorka-gh/photocycle/logging"
+	"github.com/egorka-gh/photocycle/notify"
+	"github.com/egorka-gh/photocycle/tracing"
 	log "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 )
 
-//NewRuner creates Runer
-func NewRuner(interval int, repo photocycle.Repository, logger log.Logger, jobs ...Job) Runer {
+//ErrLocked job is running by other instance
+var ErrLocked = errors.New("job is running by other instance")
+
+//ErrLockLost job database lock is lost while job runs (lock connection is broken), run is aborted
+var ErrLockLost = errors.New("job lock is lost")
+
+//lockCheck interval of job lock check while job runs
+var lockCheck = 30 * time.Second
+
+//Credentials jobs secrets, caller reads them from config, env or secret files
+type Credentials struct {
+	//GroupKey site group api key
+	GroupKey string
+	//EFI Fiery api settings
+	EFI api.EFIConfig
+}
+
+//NewRuner creates Runer, notifier gets jobs failures (can be nil)
+func NewRuner(c RunConfig, repo photocycle.Repository, logger log.Logger, notifier notify.Sender, creds Credentials, jobs ...Job) Runer {
+	interval := c.Interval
 	if interval < 3 {
 		interval = 3
 	}
+	if notifier == nil {
+		notifier = notify.Nop
+	}
 	r := baseRuner{
-		interval: interval,
-		repo:     repo,
-		logger:   logger,
-		jobs:     jobs,
+		interval:   interval,
+		repo:       repo,
+		logger:     logger,
+		notifier:   notifier,
+		creds:      creds,
+		lock:       c.Lock,
+		jobs:       jobs,
+		backoffMax: time.Minute * time.Duration(c.BackoffMax),
 	}
 	return &r
 }
@@ -28,60 +63,341 @@ func NewRuner(interval int, repo photocycle.Repository, logger log.Logger, jobs
 //Job job to do
 type Job interface {
 	Init() error
-	Do(ctx context.Context)
+	//Do runs job, returns error if run failed (runner backs off failing job)
+	Do(ctx context.Context) error
+}
+
+//Reloader job that can reload its settings from database on demand
+type Reloader interface {
+	//Reload requests reload, job reloads on next run
+	Reload()
 }
 
 //FillBox creates FillBox job
-func FillBox() Job {
-	return &baseJob{
+func FillBox(c FillBoxConfig) Job {
+	j := &fillBoxJob{}
+	j.baseJob = baseJob{
 		name:     "FillBox",
-		initFunc: initFillBoxes,
-		doFunc:   fillBoxes,
+		initFunc: func() error { return initFillBoxes(j, c) },
+		doFunc:   func(ctx context.Context, logger log.Logger) error { return fillBoxes(ctx, j, logger) },
+	}
+	return j
+}
+
+//Netprint creates job to sync netprint boxes for all netprint sources
+func Netprint(c NetprintConfig) Job {
+	j := &baseJob{name: "Netprint"}
+	j.initFunc = func() error { return initNetprint(j, c) }
+	j.doFunc = func(ctx context.Context, logger log.Logger) error { return syncNetprint(ctx, j, logger, c.Offset) }
+	return j
+}
+
+//Import creates job to import orders structure from sites, mapsReload is shared with FillBox
+func Import(c ImportConfig, mapsReload int) Job {
+	j := &importJob{}
+	j.baseJob = baseJob{
+		name:     "Import",
+		initFunc: func() error { return initImport(j, c, mapsReload) },
+		doFunc:   func(ctx context.Context, logger log.Logger) error { return importOrders(ctx, j, logger) },
+	}
+	return j
+}
+
+//WebSync creates job to cancel groups canceled on sites
+func WebSync(c WebSyncConfig) Job {
+	j := &webSyncJob{}
+	j.baseJob = baseJob{
+		name:     "WebSync",
+		initFunc: func() error { return initWebSync(j, c) },
+		doFunc:   func(ctx context.Context, logger log.Logger) error { return webSync(ctx, j, logger) },
+	}
+	return j
+}
+
+//StatusPush creates job to push production states to sites
+func StatusPush(c StatusPushConfig) Job {
+	j := &statusPushJob{}
+	j.baseJob = baseJob{
+		name:     "StatusPush",
+		initFunc: func() error { return initStatusPush(j, c) },
+		doFunc:   func(ctx context.Context, logger log.Logger) error { return statusPush(ctx, j, logger) },
+	}
+	return j
+}
+
+//Stale creates job to detect groups stuck in state
+func Stale(c StaleConfig) Job {
+	j := &staleJob{}
+	j.baseJob = baseJob{
+		name:     "Stale",
+		initFunc: func() error { return initStale(j, c) },
+		doFunc:   func(ctx context.Context, logger log.Logger) error { return checkStale(ctx, j, logger) },
 	}
+	return j
 }
 
 //PrintedEFI creates job to check in EFI if posted printgroups are printed
-func PrintedEFI() Job {
-	return &baseJob{
+func PrintedEFI(c PrintedEFIConfig) Job {
+	j := &printedEFIJob{}
+	j.baseJob = baseJob{
 		name:     "PrintedEFI",
-		initFunc: initCheckPrinted,
-		doFunc:   checkPrinted,
+		initFunc: func() error { return initCheckPrinted(j, c) },
+		doFunc:   func(ctx context.Context, logger log.Logger) error { return checkPrinted(ctx, j, logger) },
 	}
+	return j
 }
 
+var registry = map[string]func(c Config) Job{
+	"fillbox":    func(c Config) Job { return FillBox(c.FillBox) },
+	"import":     func(c Config) Job { return Import(c.Import, c.FillBox.MapsReload) },
+	"netprint":   func(c Config) Job { return Netprint(c.Netprint) },
+	"printedefi": func(c Config) Job { return PrintedEFI(c.EFI) },
+	"stale":      func(c Config) Job { return Stale(c.Stale) },
+	"statuspush": func(c Config) Job { return StatusPush(c.StatusPush) },
+	"websync":    func(c Config) Job { return WebSync(c.WebSync) },
+}
+
+//ByName creates job by name (case insensitive)
+func ByName(name string, c Config) (Job, error) {
+	f, ok := registry[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown job %q, valid jobs: %s", name, strings.Join(Names(), ", "))
+	}
+	return f(c), nil
+}
+
+//Names returns known job names
+func Names() []string {
+	res := make([]string, 0, len(registry))
+	for n := range registry {
+		res = append(res, n)
+	}
+	sort.Strings(res)
+	return res
+}
+
+//RunOnce inits and runs job once, ignores job interval
+func RunOnce(ctx context.Context, repo photocycle.Repository, logger log.Logger, c RunConfig, creds Credentials, job Job) error {
+	setup(job, repo, logger, notify.Nop, creds, c.Lock)
+	if err := job.Init(); err != nil {
+		return err
+	}
+	if b, ok := job.(baser); ok {
+		j := b.base()
+		ctx, logger := j.startRun(ctx)
+		return j.run(ctx, logger)
+	}
+	return job.Do(ctx)
+}
+
+//setup injects runner dependencies into job
+func setup(job Job, repo photocycle.Repository, logger log.Logger, notifier notify.Sender, creds Credentials, lock bool) {
+	if b, ok := job.(baser); ok {
+		j := b.base()
+		j.repo = repo
+		j.logger = logger
+		j.notify = notifier
+		j.creds = creds
+		j.lock = lock
+	}
+}
+
+//baser is implemented by jobs built on baseJob
+type baser interface {
+	base() *baseJob
+}
+
+//baseJob common job part, job settings are kept by job own type that embeds baseJob
 type baseJob struct {
 	name     string
 	repo     photocycle.Repository
 	logger   log.Logger
-	builder  *api.Builder
-	initFunc func(j *baseJob) error
-	doFunc   func(ctx context.Context, j *baseJob) error
-	debug    bool
+	notify   notify.Sender
+	creds    Credentials
+	initFunc func() error
+	doFunc   func(ctx context.Context, logger log.Logger) error
+	//min interval between runs, 0 - run on each runner tick
+	interval time.Duration
+	lastRun  time.Time
+	//lock runs job under database lock
+	lock bool
+	//guard watches lock while job runs
+	guard *lockGuard
+}
+
+func (j *baseJob) base() *baseJob {
+	return j
 }
 
 func (j *baseJob) Init() error {
 	if j.logger == nil {
 		j.logger = log.NewNopLogger()
 	}
-	j.logger = log.With(j.logger, "job", j.name)
+	j.logger = log.With(j.logger, logging.KeyJob, j.name)
 	if j.initFunc != nil {
-		return j.initFunc(j)
+		return j.initFunc()
 	}
 	return nil
 }
 
-func (j *baseJob) Do(ctx context.Context) {
-	if j.doFunc != nil {
-		err := j.doFunc(ctx, j)
+//alert sends event to notifier
+func (j *baseJob) alert(kind string, source int, message string) {
+	if j.notify == nil {
+		return
+	}
+	j.notify.Send(notify.Event{Kind: kind, Job: j.name, Source: source, Message: message})
+}
+
+func (j *baseJob) Do(ctx context.Context) error {
+	if j.interval > 0 && time.Since(j.lastRun) < j.interval {
+		//not yet
+		return nil
+	}
+	j.lastRun = time.Now()
+	ctx, logger := j.startRun(ctx)
+	err := j.run(ctx, logger)
+	if err == ErrLocked {
+		level.Debug(logger).Log(logging.KeyMsg, "skip, job is running by other instance")
+		return nil
+	}
+	if _, ok := err.(panicError); ok {
+		//runner logs stack and notifies
+		return err
+	}
+	if err != nil && err != ctx.Err() {
+		level.Error(logger).Log(logging.KeyMsg, "job failed", logging.KeyErr, err)
+		j.alert(notify.KindJobError, 0, err.Error())
+		return err
+	}
+	return nil
+}
+
+//Name returns job name
+func (j *baseJob) Name() string {
+	return j.name
+}
+
+//startRun creates run id, run id goes to log lines, api requests and spans.
+//returns run context and run logger, job logger is not changed
+func (j *baseJob) startRun(ctx context.Context) (context.Context, log.Logger) {
+	ctx = tracing.WithRun(ctx, tracing.NewID())
+	return ctx, tracing.Logger(ctx, j.logger)
+}
+
+//run runs doFunc, if lock is on job runs under database lock,
+//so several instances don't run same job at the same time
+func (j *baseJob) run(ctx context.Context, logger log.Logger) error {
+	if j.doFunc == nil {
+		return nil
+	}
+	if j.lock {
+		l, err := j.repo.TryLock(ctx, "job."+j.name)
 		if err != nil {
-			j.logger.Log("Error", err)
+			return fmt.Errorf("repository.TryLock error: %s", err.Error())
 		}
+		if l == nil {
+			return ErrLocked
+		}
+		defer func() {
+			if err := l.Release(); err != nil {
+				level.Warn(logger).Log(logging.KeyMsg, "lock release failed", logging.KeyErr, err)
+			}
+		}()
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		j.guard = &lockGuard{lock: l, cancel: cancel}
+		done := make(chan struct{})
+		go func(ctx context.Context, g *lockGuard) {
+			g.watch(ctx, logger, lockCheck)
+			close(done)
+		}(ctx, j.guard)
+		defer func() {
+			cancel()
+			<-done
+			j.guard = nil
+		}()
 	}
+	ctx, span := tracing.StartSpan(ctx, "job "+j.name)
+	err := j.doFunc(ctx, logger)
+	if j.guard.isLost() {
+		err = ErrLockLost
+	}
+	span.End(err)
+	return err
+}
+
+//checkLock checks job lock before side effect, run is canceled if lock is lost
+func (j *baseJob) checkLock(ctx context.Context, logger log.Logger) error {
+	return j.guard.check(ctx, logger)
+}
+
+//lockGuard watches job lock while job runs, cancels run if lock is lost,
+//so job doesn't run concurrently with other instance that got the lock
+type lockGuard struct {
+	lock   photocycle.Lock
+	cancel context.CancelFunc
+	lost   int32
+}
+
+//check checks lock is held, nil guard (job runs without lock) is always held
+func (g *lockGuard) check(ctx context.Context, logger log.Logger) error {
+	if g == nil {
+		return nil
+	}
+	ok, err := g.lock.IsHeld(ctx)
+	if err == nil && ok {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if atomic.CompareAndSwapInt32(&g.lost, 0, 1) {
+		level.Error(logger).Log(logging.KeyMsg, "job lock is lost, run is canceled", logging.KeyErr, err)
+	}
+	g.cancel()
+	return ErrLockLost
+}
+
+//watch checks lock by interval till ctx is done or lock is lost
+func (g *lockGuard) watch(ctx context.Context, logger log.Logger, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if g.check(ctx, logger) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (g *lockGuard) isLost() bool {
+	return g != nil && atomic.LoadInt32(&g.lost) == 1
+}
+
+//newItem creates work item id of job run, returns item context and logger
+func newItem(ctx context.Context, logger log.Logger) (context.Context, log.Logger) {
+	id := tracing.NewID()
+	return tracing.WithItem(ctx, id), log.With(logger, logging.KeyItem, id)
+}
+
+//startItem creates work item and starts its span
+func startItem(ctx context.Context, logger log.Logger, name string, attrs ...interface{}) (context.Context, log.Logger, *tracing.Span) {
+	ctx, logger = newItem(ctx, logger)
+	ctx, span := tracing.StartSpan(ctx, name, attrs...)
+	return ctx, logger, span
 }
 
 //Runer job runer
 type Runer interface {
 	Run(quit chan struct{}) error
+	//Reload requests settings reload for jobs that support it
+	Reload()
+	//Heartbeat last time runner scheduled or finished job
+	Heartbeat() time.Time
 }
 
 //Runer job runer implementation
@@ -89,7 +405,41 @@ type baseRuner struct {
 	interval int
 	repo     photocycle.Repository
 	logger   log.Logger
-	jobs     []Job
+	notifier notify.Sender
+	creds    Credentials
+	//lock runs jobs under database lock
+	lock bool
+	jobs []Job
+	//max backoff of failing job
+	backoffMax time.Duration
+	//failures state by job index
+	failures []jobFailures
+	//heartbeat unix nano
+	heartbeat int64
+}
+
+//jobFailures consecutive failures of job
+type jobFailures struct {
+	count   int
+	skipTil time.Time
+}
+
+//Reload requests settings reload for jobs that support it
+func (r *baseRuner) Reload() {
+	for _, job := range r.jobs {
+		if rj, ok := job.(Reloader); ok {
+			rj.Reload()
+		}
+	}
+}
+
+//Heartbeat implements Runer
+func (r *baseRuner) Heartbeat() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&r.heartbeat))
+}
+
+func (r *baseRuner) beat() {
+	atomic.StoreInt64(&r.heartbeat, time.Now().UnixNano())
 }
 
 //Run runs jobs periodicaly, blocks caller till get quit
@@ -101,58 +451,171 @@ func (r *baseRuner) Run(quit chan struct{}) error {
 	if r.logger == nil {
 		r.logger = log.NewNopLogger()
 	}
-	r.logger = log.With(r.logger, "actor", "runner")
-	r.logger.Log("event", "Starting")
+	if r.notifier == nil {
+		r.notifier = notify.Nop
+	}
+	logger := log.With(r.logger, logging.KeyComponent, "runner")
+	level.Info(logger).Log(logging.KeyMsg, "starting")
 	//init jobs
-	r.logger.Log("event", "Init jobs")
+	level.Info(logger).Log(logging.KeyMsg, "init jobs")
 	for _, job := range r.jobs {
-		if j, ok := job.(*baseJob); ok {
-			j.repo = r.repo
-			j.logger = r.logger
-		}
+		setup(job, r.repo, r.logger, r.notifier, r.creds, r.lock)
 		if err := job.Init(); err != nil {
 			return err
 		}
 	}
+	r.failures = make([]jobFailures, len(r.jobs))
+	r.beat()
 
-	var timer *time.Timer
 	mainCtx, mainCancel := context.WithCancel(context.Background())
 	defer mainCancel()
-	start := make(chan int, 1)
-	defer close(start)
+	//timer is owned by this loop, jobs goroutine reports by done
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	done := make(chan struct{}, 1)
 	var wg sync.WaitGroup
-	loop := true
 
-	start <- 1
-	for loop {
+	for {
 		select {
-		case <-start:
-			ctx, cancel := context.WithCancel(mainCtx)
+		case <-timer.C:
+			r.beat()
+			level.Debug(logger).Log(logging.KeyMsg, "starting jobs")
 			wg.Add(1)
-			r.logger.Log("event", "Starting jobs")
 			go func() {
 				defer wg.Done()
-				defer cancel()
+				//always report, so timer is rearmed even if something goes wrong
+				defer func() { done <- struct{}{} }()
 				//run sequentially
-				for _, job := range r.jobs {
-					job.Do(ctx)
-					if ctx.Err() != nil {
+				for i := range r.jobs {
+					r.do(mainCtx, logger, i)
+					if mainCtx.Err() != nil {
 						//contex canceled
 						return
 					}
 				}
-				timer = time.AfterFunc(time.Minute*time.Duration(r.interval), func() { start <- 1 })
 			}()
+		case <-done:
+			r.beat()
+			timer.Reset(time.Minute * time.Duration(r.interval))
 		case <-quit:
-			if timer != nil {
-				timer.Stop()
-			}
 			mainCancel()
-			loop = false
-			r.logger.Log("event", "Stop")
+			level.Info(logger).Log(logging.KeyMsg, "stop")
 			wg.Wait()
+			return nil
 		}
 	}
+}
 
-	return nil
+//do runs job, recovers job panic, skips failing job by exponential backoff
+func (r *baseRuner) do(ctx context.Context, logger log.Logger, i int) {
+	job := r.jobs[i]
+	f := &r.failures[i]
+	if time.Now().Before(f.skipTil) {
+		return
+	}
+	r.beat()
+	defer r.beat()
+	err := safeDo(ctx, job)
+	if pe, ok := err.(panicError); ok {
+		level.Error(logger).Log(logging.KeyMsg, "job panic", logging.KeyJob, jobName(job), logging.KeyErr, pe.value, "stack", pe.stack)
+		r.notifier.Send(notify.Event{Kind: notify.KindJobError, Job: jobName(job), Message: fmt.Sprintf("panic: %v", pe.value)})
+	}
+	if err == nil || ctx.Err() != nil {
+		f.count = 0
+		f.skipTil = time.Time{}
+		return
+	}
+	f.count++
+	if f.count == 1 {
+		return
+	}
+	delay := r.backoff(f.count)
+	f.skipTil = time.Now().Add(delay)
+	level.Warn(logger).Log(logging.KeyMsg, "job keeps failing, backoff", logging.KeyJob, jobName(job), "failures", f.count, "skip", delay.String())
+}
+
+//backoff delay after failures, runner interval doubles on each failure
+func (r *baseRuner) backoff(failures int) time.Duration {
+	max := r.backoffMax
+	if max <= 0 {
+		max = time.Hour
+	}
+	d := time.Minute * time.Duration(r.interval)
+	for n := 2; n < failures && d < max; n++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+//panicError recovered job panic
+type panicError struct {
+	value interface{}
+	stack string
+}
+
+func (e panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+//newPanicError creates panicError, call from deferred recover
+func newPanicError(v interface{}) panicError {
+	return panicError{value: v, stack: string(debug.Stack())}
+}
+
+//safeDo runs job.Do, panic is returned as panicError
+func safeDo(ctx context.Context, job Job) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = newPanicError(v)
+		}
+	}()
+	return job.Do(ctx)
+}
+
+func jobName(job Job) string {
+	if n, ok := job.(interface{ Name() string }); ok {
+		return n.Name()
+	}
+	return fmt.Sprintf("%T", job)
+}
+
+//Watchdog reports (log and notifier) if runner doesn't schedule jobs longer than limit,
+//optionaly touches heartbeat file for external monitoring, blocks caller till get quit
+func Watchdog(r Runer, limit time.Duration, heartbeatFile string, logger log.Logger, notifier notify.Sender, quit chan struct{}) error {
+	if notifier == nil {
+		notifier = notify.Nop
+	}
+	logger = log.With(logger, logging.KeyComponent, "watchdog")
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	stalled := false
+	for {
+		select {
+		case <-t.C:
+			hb := r.Heartbeat()
+			if time.Since(hb) > limit {
+				if !stalled {
+					msg := fmt.Sprintf("runner stopped scheduling, last heartbeat %s", hb.Format("2006-01-02 15:04:05"))
+					level.Error(logger).Log(logging.KeyMsg, msg)
+					notifier.Send(notify.Event{Kind: notify.KindWatchdog, Message: msg})
+				}
+				stalled = true
+				continue
+			}
+			if stalled {
+				level.Info(logger).Log(logging.KeyMsg, "runner is alive again")
+			}
+			stalled = false
+			if heartbeatFile != "" {
+				if err := ioutil.WriteFile(heartbeatFile, []byte(hb.Format(time.RFC3339)), 0644); err != nil {
+					level.Warn(logger).Log(logging.KeyMsg, "heartbeat file write failed", logging.KeyErr, err)
+				}
+			}
+		case <-quit:
+			return nil
+		}
+	}
 }
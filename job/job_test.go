@@ -4,9 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/egorka-gh/photocycle"
+	"github.com/egorka-gh/photocycle/notify"
+	log "github.com/go-kit/kit/log"
 )
 
 type jb struct {
@@ -18,7 +23,7 @@ func (j *jb) Init() error {
 	return j.initErr
 }
 
-func (j *jb) Do(ctx context.Context) {
+func (j *jb) Do(ctx context.Context) error {
 	defer func() {
 		if j.doFunc != nil {
 			j.doFunc()
@@ -28,9 +33,9 @@ func (j *jb) Do(ctx context.Context) {
 	timer := time.NewTimer(1 * time.Second)
 	select {
 	case <-timer.C:
-		return
+		return nil
 	case <-ctx.Done():
-		return
+		return nil
 	}
 }
 
@@ -78,3 +83,185 @@ func TestGroupBoxes(t *testing.T) {
 	}
 
 }
+
+//lockRepo holds locks in memory like GET_LOCK of one server
+type lockRepo struct {
+	stubRepo
+	held map[string]bool
+}
+
+type memLock struct {
+	r    *lockRepo
+	name string
+}
+
+func (l *memLock) IsHeld(ctx context.Context) (bool, error) {
+	l.r.mu.Lock()
+	defer l.r.mu.Unlock()
+	return l.r.held[l.name], nil
+}
+
+func (l *memLock) Release() error {
+	l.r.mu.Lock()
+	defer l.r.mu.Unlock()
+	delete(l.r.held, l.name)
+	return nil
+}
+
+func (r *lockRepo) TryLock(ctx context.Context, name string) (photocycle.Lock, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.held[name] {
+		return nil, nil
+	}
+	r.held[name] = true
+	return &memLock{r: r, name: name}, nil
+}
+
+func TestJobLock(t *testing.T) {
+	rep := &lockRepo{held: make(map[string]bool)}
+	runs := 0
+	var other photocycle.Lock
+	j := &baseJob{name: "fillbox", lock: true, repo: rep, logger: log.NewNopLogger(), doFunc: func(ctx context.Context, logger log.Logger) error {
+		runs++
+		return nil
+	}}
+
+	if err := j.run(context.Background(), j.logger); err != nil || runs != 1 {
+		t.Fatalf("expected run, got err %v, runs %d", err, runs)
+	}
+	if len(rep.held) != 0 {
+		t.Fatalf("expected lock released, held %v", rep.held)
+	}
+
+	//other instance holds lock
+	other, _ = rep.TryLock(context.Background(), "job.fillbox")
+	if err := j.run(context.Background(), j.logger); err != ErrLocked || runs != 1 {
+		t.Fatalf("expected ErrLocked, got err %v, runs %d", err, runs)
+	}
+	//other instance died
+	other.Release()
+	if err := j.run(context.Background(), j.logger); err != nil || runs != 2 {
+		t.Fatalf("expected run after release, got err %v, runs %d", err, runs)
+	}
+
+	//lock connection lost while job runs
+	j.doFunc = func(ctx context.Context, logger log.Logger) error {
+		runs++
+		rep.mu.Lock()
+		delete(rep.held, "job.fillbox")
+		rep.mu.Unlock()
+		if err := j.checkLock(ctx, logger); err != ErrLockLost {
+			t.Errorf("expected ErrLockLost, got %v", err)
+		}
+		if ctx.Err() == nil {
+			t.Error("expected run canceled")
+		}
+		return ctx.Err()
+	}
+	if err := j.run(context.Background(), j.logger); err != ErrLockLost || runs != 3 {
+		t.Fatalf("expected ErrLockLost, got err %v, runs %d", err, runs)
+	}
+	if j.guard != nil {
+		t.Error("expected guard reset after run")
+	}
+}
+
+//funcJob runs func
+type funcJob struct {
+	do func() error
+}
+
+func (j *funcJob) Init() error { return nil }
+
+func (j *funcJob) Do(ctx context.Context) error { return j.do() }
+
+//memSender collects events
+type memSender struct {
+	events []notify.Event
+}
+
+func (s *memSender) Send(e notify.Event) { s.events = append(s.events, e) }
+
+func TestRunerPanic(t *testing.T) {
+	var cnt uint64
+	panicJob := &funcJob{do: func() error { panic("boom") }}
+	okJob := &funcJob{do: func() error {
+		atomic.AddUint64(&cnt, 1)
+		return nil
+	}}
+	n := &memSender{}
+	r := &baseRuner{interval: 1, jobs: []Job{panicJob, okJob}, notifier: n}
+	q := make(chan struct{})
+	time.AfterFunc(time.Second, func() { close(q) })
+	if err := r.Run(q); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadUint64(&cnt) != 1 {
+		t.Errorf("expected job after panic runs once, got %d", cnt)
+	}
+	if len(n.events) != 1 || !strings.Contains(n.events[0].Message, "boom") {
+		t.Errorf("expected panic event, got %v", n.events)
+	}
+	if time.Since(r.Heartbeat()) > 3*time.Second {
+		t.Errorf("expected fresh heartbeat, got %v", r.Heartbeat())
+	}
+}
+
+func TestRunerBackoff(t *testing.T) {
+	fail := true
+	runs := 0
+	j := &funcJob{do: func() error {
+		runs++
+		if fail {
+			return errors.New("fail")
+		}
+		return nil
+	}}
+	r := &baseRuner{interval: 3, jobs: []Job{j}, notifier: notify.Nop, backoffMax: 10 * time.Minute}
+	r.failures = make([]jobFailures, 1)
+	logger := log.NewNopLogger()
+	ctx := context.Background()
+
+	//first failure, no backoff
+	r.do(ctx, logger, 0)
+	r.do(ctx, logger, 0)
+	if runs != 2 || r.failures[0].count != 2 || r.failures[0].skipTil.IsZero() {
+		t.Fatalf("expected backoff after second failure, runs %d, state %+v", runs, r.failures[0])
+	}
+	//skipped while backoff
+	r.do(ctx, logger, 0)
+	if runs != 2 {
+		t.Fatalf("expected job skipped, runs %d", runs)
+	}
+	//backoff expired, success resets
+	fail = false
+	r.failures[0].skipTil = time.Now().Add(-time.Second)
+	r.do(ctx, logger, 0)
+	if runs != 3 || r.failures[0].count != 0 {
+		t.Fatalf("expected reset after success, runs %d, state %+v", runs, r.failures[0])
+	}
+
+	for failures, want := range map[int]time.Duration{2: 3 * time.Minute, 3: 6 * time.Minute, 4: 10 * time.Minute, 10: 10 * time.Minute} {
+		if d := r.backoff(failures); d != want {
+			t.Errorf("failures %d: expected backoff %v, got %v", failures, want, d)
+		}
+	}
+}
+
+func TestJobTypes(t *testing.T) {
+	for _, n := range Names() {
+		j, err := ByName(n, Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := j.(baser); !ok {
+			t.Errorf("%s: expected job built on baseJob", n)
+		}
+		//only jobs that use site maps reload
+		_, reload := j.(Reloader)
+		if want := n == "fillbox" || n == "import"; reload != want {
+			t.Errorf("%s: expected Reloader %v, got %v", n, want, reload)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/egorka-gh/photocycle/infrastructure/api"
+	"github.com/egorka-gh/photocycle/logging"
+	"github.com/egorka-gh/photocycle/netprint"
+	"github.com/egorka-gh/photocycle/notify"
+	log "github.com/go-kit/kit/log"
+)
+
+func initNetprint(j *baseJob, c NetprintConfig) error {
+	//netprint boxes are filled slowly, so don't call site on each runner tick
+	j.interval = time.Minute * time.Duration(c.Interval)
+	return nil
+}
+
+//syncNetprint syncs netprint boxes, offset in hours
+func syncNetprint(ctx context.Context, j *baseJob, logger log.Logger, offset int) error {
+	su, err := j.repo.GetNetprintSources(ctx)
+	if err != nil {
+		return fmt.Errorf("repository.GetNetprintSources error: %s", err.Error())
+	}
+	for _, u := range su {
+		//check cancel
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c := &http.Client{
+			Timeout: time.Second * 40,
+		}
+		cl, err := api.NewClient(c, u.URL, u.AppKey, "")
+		if err != nil {
+			return err
+		}
+		m := netprint.New(u.ID, offset, cl, j.repo, log.With(logger, logging.KeySource, u.ID))
+		if err := m.Sync(ctx); err != nil {
+			j.alert(notify.KindJobError, u.ID, fmt.Sprintf("netprint sync error: %s", err.Error()))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package job
+
+import (
+	"time"
+
+	"github.com/egorka-gh/photocycle"
+)
+
+//retryPolicy failure policy for package_new
+//next attempt delay grows exponentially (base, 2*base, 4*base ...) up to max,
+//package became dead after maxAttempts
+type retryPolicy struct {
+	maxAttempts int
+	base        time.Duration
+	max         time.Duration
+}
+
+//newRetryPolicy creates policy by settings, not set values are defaulted
+func newRetryPolicy(c RetryConfig) retryPolicy {
+	p := retryPolicy{
+		maxAttempts: c.MaxAttempts,
+		base:        time.Minute * time.Duration(c.RetryDelay),
+		max:         time.Minute * time.Duration(c.RetryMaxDelay),
+	}
+	if p.maxAttempts <= 0 {
+		p.maxAttempts = 10
+	}
+	if p.base <= 0 {
+		p.base = 5 * time.Minute
+	}
+	if p.max < p.base {
+		p.max = 24 * time.Hour
+	}
+	return p
+}
+
+//fail registers failed attempt
+func (p retryPolicy) fail(g *photocycle.PackageNew, err error, now time.Time) {
+	g.Attempt++
+	if err != nil {
+		g.LastError = err.Error()
+	}
+	g.NextAttempt, g.Dead = p.next(g.Attempt, now)
+}
+
+//next returns next attempt time and dead flag after attempt failed
+func (p retryPolicy) next(attempt int, now time.Time) (time.Time, bool) {
+	return now.Add(p.delay(attempt)), attempt >= p.maxAttempts
+}
+
+//hold postpones package without counting attempt, package never became dead by hold
+func (p retryPolicy) hold(g *photocycle.PackageNew, reason string, now time.Time) {
+	g.LastError = reason
+	g.NextAttempt = now.Add(p.base)
+}
+
+//delay returns delay before next attempt
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := p.base
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if d >= p.max {
+			return p.max
+		}
+	}
+	return d
+}
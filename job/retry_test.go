@@ -0,0 +1,31 @@
+package job
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/egorka-gh/photocycle"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	p := retryPolicy{maxAttempts: 4, base: time.Minute, max: 3 * time.Minute}
+	now := time.Now()
+	g := photocycle.PackageNew{}
+	delays := []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute}
+	for i, d := range delays {
+		p.fail(&g, errors.New("some error"), now)
+		if g.Attempt != i+1 {
+			t.Errorf("Expected attempt %d, got %d", i+1, g.Attempt)
+		}
+		if got := g.NextAttempt.Sub(now); got != d {
+			t.Errorf("Attempt %d: expected delay %v, got %v", g.Attempt, d, got)
+		}
+		if g.LastError != "some error" {
+			t.Errorf("Expected last error to be saved, got %q", g.LastError)
+		}
+		if dead := g.Attempt >= 4; g.Dead != dead {
+			t.Errorf("Attempt %d: expected dead %v, got %v", g.Attempt, dead, g.Dead)
+		}
+	}
+}
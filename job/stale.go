@@ -0,0 +1,107 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/egorka-gh/photocycle"
+	"github.com/egorka-gh/photocycle/logging"
+	"github.com/egorka-gh/photocycle/notify"
+	log "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+//staleJob detects groups stuck in state
+type staleJob struct {
+	baseJob
+	//max time in state by state
+	sla map[int]time.Duration
+}
+
+func initStale(j *staleJob, c StaleConfig) error {
+	j.interval = time.Minute * time.Duration(c.Interval)
+	//state: max minutes in state
+	j.sla = make(map[int]time.Duration)
+	for k, v := range c.SLA {
+		state, err := strconv.Atoi(k)
+		if err != nil {
+			return fmt.Errorf("initStale error: wrong state %q in stale.sla", k)
+		}
+		j.sla[state] = time.Minute * time.Duration(v)
+	}
+	return nil
+}
+
+//alertKey dedup key of state alert
+func alertKey(source, group, state int) string {
+	return fmt.Sprintf("%d/%d/%d", source, group, state)
+}
+
+//checkStale flags active groups that stay in state longer than state SLA,
+//group state is min state of group orders, alert is resolved when group leaves state
+func checkStale(ctx context.Context, j *staleJob, logger log.Logger) error {
+	if len(j.sla) == 0 {
+		return nil
+	}
+	active, err := j.repo.GetActiveAlerts(ctx)
+	if err != nil {
+		return fmt.Errorf("repository.GetActiveAlerts error: %s", err.Error())
+	}
+	su, err := j.repo.GetSourceUrls(ctx)
+	if err != nil {
+		return fmt.Errorf("repository.GetSourceUrls error: %s", err.Error())
+	}
+	now := time.Now()
+	stuck := make(map[string]photocycle.StateAlert)
+	checked := make(map[int]bool)
+	for _, u := range su {
+		grps, err := j.repo.GetCurrentOrders(ctx, u.ID)
+		if err != nil {
+			level.Error(logger).Log(logging.KeyMsg, "repository.GetCurrentOrders failed", logging.KeySource, u.ID, logging.KeyErr, err)
+			continue
+		}
+		checked[u.ID] = true
+		for _, g := range grps {
+			sla, ok := j.sla[g.ChildState]
+			if !ok || now.Sub(g.StateDate) <= sla {
+				continue
+			}
+			stuck[alertKey(u.ID, g.GroupID, g.ChildState)] = photocycle.StateAlert{Source: u.ID, GroupID: g.GroupID, State: g.ChildState, StateDate: g.StateDate}
+		}
+	}
+
+	resolved := make([]int, 0)
+	for _, a := range active {
+		k := alertKey(a.Source, a.GroupID, a.State)
+		if _, ok := stuck[k]; ok {
+			//already alerted
+			delete(stuck, k)
+			continue
+		}
+		if checked[a.Source] {
+			resolved = append(resolved, a.ID)
+		}
+	}
+	added := make([]photocycle.StateAlert, 0, len(stuck))
+	for _, a := range stuck {
+		added = append(added, a)
+	}
+	//notify only saved alerts, alert already saved by other instance is skipped
+	added, err = j.repo.AddAlerts(ctx, added)
+	for _, a := range added {
+		level.Warn(logger).Log(logging.KeyMsg, "group stuck in state", logging.KeySource, a.Source, logging.KeyGroup, a.GroupID, "state", a.State, "since", a.StateDate.Format("2006-01-02 15:04"))
+		j.alert(notify.KindStuckGroup, a.Source, fmt.Sprintf("group %d stuck in state %d since %s", a.GroupID, a.State, a.StateDate.Format("2006-01-02 15:04")))
+	}
+	if err != nil {
+		return fmt.Errorf("repository.AddAlerts error: %s", err.Error())
+	}
+	if err = j.repo.ResolveAlerts(ctx, resolved); err != nil {
+		return fmt.Errorf("repository.ResolveAlerts error: %s", err.Error())
+	}
+	if len(added) > 0 || len(resolved) > 0 {
+		level.Info(logger).Log(logging.KeyMsg, "result", "added", len(added), "resolved", len(resolved))
+	}
+	return nil
+}
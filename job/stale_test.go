@@ -0,0 +1,74 @@
+package job
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/egorka-gh/photocycle"
+	log "github.com/go-kit/kit/log"
+)
+
+//alertRepo serves active groups and alerts
+type alertRepo struct {
+	stubRepo
+	groups   []photocycle.GroupState
+	active   []photocycle.StateAlert
+	added    []photocycle.StateAlert
+	resolved []int
+}
+
+func (r *alertRepo) GetCurrentOrders(ctx context.Context, source int) ([]photocycle.GroupState, error) {
+	return r.groups, nil
+}
+
+func (r *alertRepo) GetActiveAlerts(ctx context.Context) ([]photocycle.StateAlert, error) {
+	return r.active, nil
+}
+
+func (r *alertRepo) AddAlerts(ctx context.Context, alerts []photocycle.StateAlert) ([]photocycle.StateAlert, error) {
+	r.added = append(r.added, alerts...)
+	return alerts, nil
+}
+
+func (r *alertRepo) ResolveAlerts(ctx context.Context, ids []int) error {
+	r.resolved = append(r.resolved, ids...)
+	return nil
+}
+
+func TestCheckStale(t *testing.T) {
+	now := time.Now()
+	rep := &alertRepo{
+		stubRepo: stubRepo{sources: []photocycle.SourceURL{{ID: 8}}},
+		groups: []photocycle.GroupState{
+			//stuck, new alert
+			{GroupID: 1, ChildState: photocycle.StateLoadLock, StateDate: now.Add(-time.Hour)},
+			//stuck, already alerted
+			{GroupID: 2, ChildState: photocycle.StatePrint, StateDate: now.Add(-72 * time.Hour)},
+			//in time
+			{GroupID: 3, ChildState: photocycle.StateLoadLock, StateDate: now.Add(-time.Minute)},
+			//no sla
+			{GroupID: 4, ChildState: photocycle.StateLoadWaite, StateDate: now.Add(-72 * time.Hour)},
+		},
+		active: []photocycle.StateAlert{
+			{ID: 10, Source: 8, GroupID: 2, State: photocycle.StatePrint},
+			//group left state
+			{ID: 11, Source: 8, GroupID: 3, State: photocycle.StatePrint},
+			//source not checked
+			{ID: 12, Source: 9, GroupID: 5, State: photocycle.StatePrint},
+		},
+	}
+	j := &staleJob{baseJob: baseJob{repo: rep, logger: log.NewNopLogger()}, sla: map[int]time.Duration{
+		photocycle.StateLoadLock: 30 * time.Minute,
+		photocycle.StatePrint:    48 * time.Hour,
+	}}
+	if err := checkStale(context.Background(), j, j.logger); err != nil {
+		t.Fatalf("checkStale error %q", err.Error())
+	}
+	if len(rep.added) != 1 || rep.added[0].GroupID != 1 || rep.added[0].State != photocycle.StateLoadLock {
+		t.Errorf("expected alert for group 1, got %+v", rep.added)
+	}
+	if !equalInts(rep.resolved, []int{11}) {
+		t.Errorf("expected alert 11 resolved, got %v", rep.resolved)
+	}
+}
@@ -0,0 +1,98 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/egorka-gh/photocycle/infrastructure/api"
+	"github.com/egorka-gh/photocycle/logging"
+	log "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+//statusPushJob pushes production states to sites
+type statusPushJob struct {
+	baseJob
+	retry retryPolicy
+	//max statuses per run
+	batch int
+}
+
+func initStatusPush(j *statusPushJob, c StatusPushConfig) error {
+	j.retry = newRetryPolicy(c.RetryConfig)
+	j.batch = c.Batch
+	if j.batch <= 0 {
+		j.batch = 100
+	}
+	return nil
+}
+
+//statusPush delivers status_outbox to sites
+func statusPush(ctx context.Context, j *statusPushJob, logger log.Logger) error {
+	items, err := j.repo.GetStatusOutbox(ctx, j.batch)
+	if err != nil {
+		return fmt.Errorf("repository.GetStatusOutbox error: %s", err.Error())
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	su, err := j.repo.GetSourceUrls(ctx)
+	if err != nil {
+		return fmt.Errorf("repository.GetSourceUrls error: %s", err.Error())
+	}
+	clients := make(map[int]api.FFService)
+	for _, u := range su {
+		cl, err := api.NewClient(&http.Client{Timeout: time.Second * 40}, u.URL, u.AppKey, "")
+		if err != nil {
+			level.Error(logger).Log(logging.KeyMsg, "api.NewClient failed", logging.KeySource, u.ID, logging.KeyErr, err)
+			continue
+		}
+		clients[u.ID] = cl
+	}
+
+	sent, failed, held := 0, 0, 0
+	for _, p := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		pctx, plog := newItem(ctx, logger)
+		cl, ok := clients[p.Source]
+		if !ok || !cl.Active() {
+			//no client or broken, postpone without counting attempt, so it doesn't block batch
+			held++
+			p.LastError = "source client is not active"
+			p.NextAttempt = time.Now().Add(j.retry.delay(1))
+			if err := j.repo.StatusOutboxUpdate(pctx, p); err != nil {
+				level.Error(plog).Log(logging.KeyMsg, "repository.StatusOutboxUpdate failed", logging.KeySource, p.Source, "entity", p.Entity, "entity_id", p.EntityID, logging.KeyErr, err)
+			}
+			continue
+		}
+		err := cl.PushStatus(pctx, api.StatusUpdate{
+			GroupID: p.GroupID,
+			OrderID: p.SourceID,
+			Status:  p.SiteStatus,
+			Key:     p.IdemKey,
+		})
+		if err != nil {
+			failed++
+			p.Attempt++
+			p.LastError = err.Error()
+			p.NextAttempt, p.Dead = j.retry.next(p.Attempt, time.Now())
+			level.Error(plog).Log(logging.KeyMsg, "api.PushStatus failed", logging.KeySource, p.Source, "entity", p.Entity, "entity_id", p.EntityID, "state", p.State, logging.KeyErr, err)
+			if p.Dead {
+				level.Error(plog).Log(logging.KeyMsg, "push is dead", logging.KeySource, p.Source, "entity", p.Entity, "entity_id", p.EntityID, "state", p.State, "attempts", p.Attempt)
+			}
+		} else {
+			sent++
+			p.Sent = true
+			p.LastError = ""
+		}
+		if err := j.repo.StatusOutboxUpdate(pctx, p); err != nil {
+			level.Error(plog).Log(logging.KeyMsg, "repository.StatusOutboxUpdate failed", logging.KeySource, p.Source, "entity", p.Entity, "entity_id", p.EntityID, logging.KeyErr, err)
+		}
+	}
+	level.Info(logger).Log(logging.KeyMsg, "result", "found", len(items), "sent", sent, "failed", failed, "held", held)
+	return nil
+}
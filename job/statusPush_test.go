@@ -0,0 +1,70 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/egorka-gh/photocycle"
+	log "github.com/go-kit/kit/log"
+)
+
+//outboxRepo serves status outbox, records updates
+type outboxRepo struct {
+	stubRepo
+	outbox []photocycle.StatusPush
+	saved  []photocycle.StatusPush
+}
+
+func (r *outboxRepo) GetStatusOutbox(ctx context.Context, limit int) ([]photocycle.StatusPush, error) {
+	return r.outbox, nil
+}
+
+func (r *outboxRepo) StatusOutboxUpdate(ctx context.Context, p photocycle.StatusPush) error {
+	r.saved = append(r.saved, p)
+	return nil
+}
+
+func TestStatusPush(t *testing.T) {
+	keys := make([]string, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		//site rejects order status
+		ok := r.Form.Get("order_id") == ""
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": ok})
+	}))
+	defer srv.Close()
+
+	rep := &outboxRepo{
+		stubRepo: stubRepo{sources: []photocycle.SourceURL{{ID: 8, URL: srv.URL + "/"}}},
+		outbox: []photocycle.StatusPush{
+			{ID: 1, Source: 8, Entity: photocycle.PushPackage, EntityID: "100", GroupID: 100, State: 465, SiteStatus: 80, IdemKey: "package:8:100:465"},
+			{ID: 2, Source: 8, Entity: photocycle.PushOrder, EntityID: "8_501", GroupID: 100, SourceID: "501", State: 300, SiteStatus: 60, IdemKey: "order:8_501:300", Attempt: 1},
+			{ID: 3, Source: 9, Entity: photocycle.PushPackage, EntityID: "200", GroupID: 200, State: 465, SiteStatus: 80, IdemKey: "package:9:200:465"},
+		},
+	}
+	j := &statusPushJob{baseJob: baseJob{repo: rep, logger: log.NewNopLogger()}, retry: retryPolicy{maxAttempts: 2, base: time.Minute, max: time.Hour}, batch: 10}
+	if err := statusPush(context.Background(), j, j.logger); err != nil {
+		t.Fatalf("statusPush error %q", err.Error())
+	}
+	if len(keys) != 2 || keys[0] != "package:8:100:465" {
+		t.Errorf("unexpected pushes %v", keys)
+	}
+	//source 9 has no client, postponed without attempt
+	if len(rep.saved) != 3 {
+		t.Fatalf("expected 3 updates, got %d", len(rep.saved))
+	}
+	if !rep.saved[0].Sent {
+		t.Errorf("expected package status sent %+v", rep.saved[0])
+	}
+	if o := rep.saved[1]; o.Sent || o.Attempt != 2 || !o.Dead || o.LastError == "" {
+		t.Errorf("expected order status dead after 2 attempts %+v", o)
+	}
+	if h := rep.saved[2]; h.Sent || h.Attempt != 0 || h.Dead || !h.NextAttempt.After(time.Now()) {
+		t.Errorf("expected status without client postponed %+v", h)
+	}
+}
@@ -0,0 +1,115 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/egorka-gh/photocycle"
+	"github.com/egorka-gh/photocycle/infrastructure/api"
+	"github.com/egorka-gh/photocycle/logging"
+	log "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+//webSyncJob cancels groups canceled on sites
+type webSyncJob struct {
+	baseJob
+	builder *api.Builder
+	//site statuses of canceled groups
+	canceled map[int]bool
+}
+
+func initWebSync(j *webSyncJob, c WebSyncConfig) error {
+	j.canceled = make(map[int]bool)
+	for _, s := range c.Canceled {
+		j.canceled[s] = true
+	}
+	if len(j.canceled) == 0 {
+		return errors.New("initWebSync error: site canceled statuses (webSync.canceled) not set")
+	}
+	b, err := api.CreateBuilder(j.repo)
+	if err != nil {
+		return fmt.Errorf("initWebSync error: %s", err.Error())
+	}
+	j.builder = b
+	j.interval = time.Minute * time.Duration(c.Interval)
+	return nil
+}
+
+//webSync checks site status of active groups,
+//cancels groups canceled on site, reports groups unknown to site
+func webSync(ctx context.Context, j *webSyncJob, logger log.Logger) error {
+	su, err := j.repo.GetSourceUrls(ctx)
+	if err != nil {
+		return fmt.Errorf("repository.GetSourceUrls error: %s", err.Error())
+	}
+	for _, u := range su {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		syncSource(ctx, j, logger, u)
+	}
+	return ctx.Err()
+}
+
+func syncSource(ctx context.Context, j *webSyncJob, logger log.Logger, u photocycle.SourceURL) {
+	logger = log.With(logger, logging.KeySource, u.ID)
+	grps, err := j.repo.GetCurrentOrders(ctx, u.ID)
+	if err != nil {
+		level.Error(logger).Log(logging.KeyMsg, "repository.GetCurrentOrders failed", logging.KeyErr, err)
+		return
+	}
+	if len(grps) == 0 {
+		return
+	}
+	cl, err := api.NewClient(&http.Client{Timeout: time.Second * 40}, u.URL, u.AppKey, j.creds.GroupKey)
+	if err != nil {
+		level.Error(logger).Log(logging.KeyMsg, "api.NewClient failed", logging.KeyErr, err)
+		return
+	}
+	checked, canceled := 0, 0
+	unknown := make([]string, 0)
+	for _, g := range grps {
+		if ctx.Err() != nil || !cl.Active() {
+			break
+		}
+		gctx, glog := newItem(ctx, logger)
+		raw, err := cl.GetGroup(gctx, g.GroupID)
+		if err == api.ErrNotFound {
+			unknown = append(unknown, fmt.Sprintf("%d", g.GroupID))
+			continue
+		}
+		if err != nil {
+			level.Error(glog).Log(logging.KeyMsg, "api.GetGroup failed", logging.KeyGroup, g.GroupID, logging.KeyErr, err)
+			continue
+		}
+		checked++
+		p, _, err := j.builder.BuildPackage(u.ID, raw)
+		if err != nil {
+			level.Error(glog).Log(logging.KeyMsg, "api.BuildPackage failed", logging.KeyGroup, g.GroupID, logging.KeyErr, err)
+			continue
+		}
+		if !j.canceled[p.SrcState] {
+			continue
+		}
+		if j.checkLock(gctx, glog) != nil {
+			break
+		}
+		msg := fmt.Sprintf("Отменен на сайте, статус %d %s", p.SrcState, p.SrcStateName)
+		n, err := j.repo.CancelGroup(gctx, u.ID, g.GroupID, photocycle.StateCanceledWeb, msg)
+		if err != nil {
+			level.Error(glog).Log(logging.KeyMsg, "repository.CancelGroup failed", logging.KeyGroup, g.GroupID, logging.KeyErr, err)
+			continue
+		}
+		level.Info(glog).Log(logging.KeyMsg, "group canceled on site", logging.KeyGroup, g.GroupID, "orders", n)
+		canceled++
+	}
+	if len(unknown) > 0 {
+		level.Warn(logger).Log(logging.KeyMsg, "groups active but unknown to site", "groups", strings.Join(unknown, ", "))
+	}
+	level.Info(logger).Log(logging.KeyMsg, "result", "active", len(grps), "checked", checked, "canceled", canceled, "unknown", len(unknown))
+}
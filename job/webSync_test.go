@@ -0,0 +1,72 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/egorka-gh/photocycle"
+	"github.com/egorka-gh/photocycle/infrastructure/api"
+	log "github.com/go-kit/kit/log"
+)
+
+//syncRepo serves active groups, records canceled
+type syncRepo struct {
+	stubRepo
+	groups   []photocycle.GroupState
+	canceled []int
+}
+
+func (r *syncRepo) GetCurrentOrders(ctx context.Context, source int) ([]photocycle.GroupState, error) {
+	return r.groups, nil
+}
+
+func (r *syncRepo) CancelGroup(ctx context.Context, source, group, state int, message string) (int, error) {
+	r.canceled = append(r.canceled, group)
+	return 1, nil
+}
+
+func (r *syncRepo) GetJSONMaps(ctx context.Context) (map[int][]photocycle.JSONMap, error) {
+	return map[int][]photocycle.JSONMap{
+		5: {
+			{JSONKey: "id", Field: "id"},
+			{JSONKey: "status", Field: "src_state"},
+		},
+		6: {},
+	}, nil
+}
+
+func TestWebSync(t *testing.T) {
+	//group status on site, 0 - unknown group
+	site := map[string]int{"1": 50, "2": 0, "3": 20}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		id := r.Form.Get("args[number]")
+		var res interface{}
+		if s := site[id]; s != 0 {
+			n, _ := strconv.Atoi(id)
+			res = map[string]interface{}{"id": n, "status": s}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": res})
+	}))
+	defer srv.Close()
+
+	rep := &syncRepo{
+		stubRepo: stubRepo{sources: []photocycle.SourceURL{{ID: 8, URL: srv.URL + "/"}}},
+		groups:   []photocycle.GroupState{{GroupID: 1}, {GroupID: 2}, {GroupID: 3}},
+	}
+	b, err := api.CreateBuilder(rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &webSyncJob{baseJob: baseJob{repo: rep, logger: log.NewNopLogger(), creds: Credentials{GroupKey: "test"}}, builder: b, canceled: map[int]bool{50: true}}
+	if err := webSync(context.Background(), j, j.logger); err != nil {
+		t.Fatalf("webSync error %q", err.Error())
+	}
+	if !equalInts(rep.canceled, []int{1}) {
+		t.Errorf("expected group 1 canceled, got %v", rep.canceled)
+	}
+}
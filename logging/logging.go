@@ -0,0 +1,133 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	log "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+//log keys schema
+const (
+	//KeyComponent service component (runner, notify, netprint)
+	KeyComponent = "component"
+	//KeyJob job name, also used as component
+	KeyJob = "job"
+	//KeyRun job run id
+	KeyRun = "run"
+	//KeyItem work item id (group, order etc) inside job run
+	KeyItem = "item"
+	//KeySource site id
+	KeySource = "source"
+	//KeyGroup site group id
+	KeyGroup = "group"
+	//KeyOrder order id
+	KeyOrder = "order"
+	//KeyPrintgroup print group id
+	KeyPrintgroup = "printgroup"
+	//KeyMethod repository method
+	KeyMethod = "method"
+	//KeyMsg message
+	KeyMsg = "msg"
+	//KeyErr error
+	KeyErr = "err"
+)
+
+//levels rank
+const (
+	rankDebug = iota
+	rankInfo
+	rankWarn
+	rankError
+)
+
+//Config logger settings
+type Config struct {
+	//Format logfmt (default) or json
+	Format string
+	//Level default level (debug, info, warn, error), default info
+	Level string
+	//Levels level by component or job name (case insensitive)
+	Levels map[string]string
+}
+
+//New creates leveled logger, records below component level are dropped,
+//records without level are always written
+func New(w io.Writer, cfg Config) (log.Logger, error) {
+	var next log.Logger
+	switch strings.ToLower(cfg.Format) {
+	case "", "logfmt":
+		next = log.NewLogfmtLogger(w)
+	case "json":
+		next = log.NewJSONLogger(w)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+	next = log.NewSyncLogger(next)
+
+	f := &filter{next: next, levels: make(map[string]int)}
+	var err error
+	if f.min, err = parseLevel(cfg.Level); err != nil {
+		return nil, err
+	}
+	for c, l := range cfg.Levels {
+		if f.levels[strings.ToLower(c)], err = parseLevel(l); err != nil {
+			return nil, fmt.Errorf("component %s: %s", c, err.Error())
+		}
+	}
+	logger := log.With(f, "ts", log.DefaultTimestamp)
+	logger = log.With(logger, "caller", log.DefaultCaller)
+	return logger, nil
+}
+
+func parseLevel(l string) (int, error) {
+	switch strings.ToLower(l) {
+	case "debug":
+		return rankDebug, nil
+	case "", "info":
+		return rankInfo, nil
+	case "warn", "warning":
+		return rankWarn, nil
+	case "error":
+		return rankError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", l)
+}
+
+//filter drops records by level of component (job or component key),
+//levels keys are lower case (viper lowercases config keys, jobs are logged as FillBox)
+type filter struct {
+	next   log.Logger
+	min    int
+	levels map[string]int
+}
+
+func (f *filter) Log(keyvals ...interface{}) error {
+	rank := -1
+	component := ""
+	for i := 0; i < len(keyvals)-1; i += 2 {
+		switch keyvals[i] {
+		case level.Key():
+			if v, ok := keyvals[i+1].(level.Value); ok {
+				rank, _ = parseLevel(v.String())
+			}
+		case KeyJob, KeyComponent:
+			if s, ok := keyvals[i+1].(string); ok {
+				component = s
+			}
+		}
+	}
+	if rank < 0 {
+		return f.next.Log(keyvals...)
+	}
+	min, ok := f.levels[strings.ToLower(component)]
+	if !ok {
+		min = f.min
+	}
+	if rank < min {
+		return nil
+	}
+	return f.next.Log(keyvals...)
+}
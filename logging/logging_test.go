@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	log "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Config{Level: "warn", Levels: map[string]string{"fillbox": "debug", "Notify": "error"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := log.With(logger, KeyComponent, "runner")
+	fillbox := log.With(logger, KeyJob, "FillBox")
+	notify := log.With(logger, KeyComponent, "notify")
+
+	level.Info(runner).Log(KeyMsg, "runner info")
+	level.Warn(runner).Log(KeyMsg, "runner warn")
+	level.Debug(fillbox).Log(KeyMsg, "fillbox debug")
+	level.Warn(notify).Log(KeyMsg, "notify warn")
+	level.Error(notify).Log(KeyMsg, "notify error")
+	runner.Log(KeyMsg, "no level")
+
+	out := buf.String()
+	for _, s := range []string{"runner warn", "fillbox debug", "notify error", "no level"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected %q in output:\n%s", s, out)
+		}
+	}
+	for _, s := range []string{"runner info", "notify warn"} {
+		if strings.Contains(out, s) {
+			t.Errorf("unexpected %q in output:\n%s", s, out)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Config{Format: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	level.Info(log.With(logger, KeyJob, "import")).Log(KeyMsg, "result", KeyGroup, 42)
+	var rec map[string]interface{}
+	if err = json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("expected json record, got %q: %s", buf.String(), err.Error())
+	}
+	if rec["level"] != "info" || rec[KeyJob] != "import" || rec[KeyGroup] != float64(42) {
+		t.Errorf("unexpected record %v", rec)
+	}
+	if _, ok := rec["caller"]; !ok {
+		t.Errorf("expected caller in record %v", rec)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, Config{Format: "xml"}); err == nil {
+		t.Error("expected format error")
+	}
+	if _, err := New(&bytes.Buffer{}, Config{Levels: map[string]string{"runner": "verbose"}}); err == nil {
+		t.Error("expected level error")
+	}
+}
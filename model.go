@@ -3,6 +3,7 @@ package photocycle
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"time"
 )
 
@@ -12,6 +13,9 @@ type Repository interface {
 	GetLastNetprintSync(ctx context.Context, source int) (int64, error)
 	SetLastNetprintSync(ctx context.Context, source int, tstamp int64) error
 	AddNetprints(ctx context.Context, netprints []GroupNetprint) error
+	GetNetprintSources(ctx context.Context) ([]SourceURL, error)
+	GetNetprints(ctx context.Context, source int, groups []int) ([]GroupNetprint, error)
+	SetNetprints(ctx context.Context, netprints []GroupNetprint) error
 
 	//common
 	//ListSource(ctx context.Context, source string) ([]Source, error)
@@ -19,7 +23,13 @@ type Repository interface {
 	GetSourceUrls(ctx context.Context) ([]SourceURL, error)
 	GetNewPackages(ctx context.Context) ([]PackageNew, error)
 	NewPackageUpdate(ctx context.Context, g PackageNew) error
+	GetDeadPackages(ctx context.Context) ([]PackageNew, error)
+	RetryDeadPackage(ctx context.Context, source, id int) error
+	DiscardDeadPackage(ctx context.Context, source, id int) error
 	PackageAddWithBoxes(ctx context.Context, packages []*Package) error
+	GetOrderStates(ctx context.Context, ids []string) (map[string]int, error)
+	LoadPackage(ctx context.Context, source, id int) (*Package, error)
+	PackageUpdate(ctx context.Context, p *Package, changes []PackageChange) error
 
 	CreateOrder(ctx context.Context, o Order) error
 	LoadOrder(ctx context.Context, id string) (Order, error)
@@ -37,13 +47,38 @@ type Repository interface {
 	StartOrders(ctx context.Context, source, group int, skipID string) error
 	CountCurrentOrders(ctx context.Context, source int) (int, error)
 	GetCurrentOrders(ctx context.Context, source int) ([]GroupState, error)
+	//GetStatusOutbox loads not sent site status updates ready to push
+	GetStatusOutbox(ctx context.Context, limit int) ([]StatusPush, error)
+	//StatusOutboxUpdate saves push attempt result
+	StatusOutboxUpdate(ctx context.Context, p StatusPush) error
+	//GetActiveAlerts loads not resolved state alerts
+	GetActiveAlerts(ctx context.Context) ([]StateAlert, error)
+	//AddAlerts saves new alerts, skips alerts already active, returns saved alerts
+	AddAlerts(ctx context.Context, alerts []StateAlert) ([]StateAlert, error)
+	ResolveAlerts(ctx context.Context, ids []int) error
+	//CancelGroup sets active orders of group to state and logs it, returns count of canceled orders
+	CancelGroup(ctx context.Context, source, group, state int, message string) (int, error)
 	GetJSONMaps(ctx context.Context) (map[int][]JSONMap, error)
 	GetDeliveryMaps(ctx context.Context) (map[int]map[int]DeliveryTypeMapping, error)
+	//AddDeliveryUnmapped registers package with site delivery id missing in delivery_type_dictionary
+	AddDeliveryUnmapped(ctx context.Context, source, nativeID, packageID int) error
+	//GetDeliveryUnmapped lists site delivery ids still missing in delivery_type_dictionary
+	GetDeliveryUnmapped(ctx context.Context) ([]DeliveryUnmapped, error)
 	GetPrintPostedEFI(ctx context.Context) ([]PrintPostedEFI, error)
 	SetPrintedEFI(ctx context.Context, printgroupID string) error
+	//TryLock gets named database lock without waiting, returns nil Lock if lock is held by other connection.
+	//lock is held till Release or connection loss (instance dies)
+	TryLock(ctx context.Context, name string) (Lock, error)
 	Close()
 }
 
+//Lock database lock
+type Lock interface {
+	//IsHeld checks lock is still held, lock is lost if its connection is lost
+	IsHeld(ctx context.Context) (bool, error)
+	Release() error
+}
+
 //GroupNetprint represents the group_netprint db object
 type GroupNetprint struct {
 	Source     int       `json:"source" db:"source"`
@@ -157,12 +192,16 @@ type PrintGroupFile struct {
 
 //PackageNew represents the new mail package (package to create in cycle database)
 type PackageNew struct {
-	ID       int       `json:"id" db:"id"`
-	Source   int       `json:"source" db:"source"`
-	ClientID int       `json:"client_id" db:"client_id"`
-	Created  time.Time `db:"created"`
-	Attempt  int       `db:"attempt"`
-	Boxes    []PackageBox
+	ID          int       `json:"id" db:"id"`
+	Source      int       `json:"source" db:"source"`
+	ClientID    int       `json:"client_id" db:"client_id"`
+	Created     time.Time `db:"created"`
+	Attempt     int       `db:"attempt"`
+	NextAttempt time.Time `db:"next_attempt"`
+	LastError   string    `db:"last_error"`
+	//Dead package is out of processing after max attempts
+	Dead  bool `db:"dead"`
+	Boxes []PackageBox
 }
 
 //DeliveryTypeMapping represents the delivery_type_dictionary
@@ -173,6 +212,57 @@ type DeliveryTypeMapping struct {
 	SetSend      bool `json:"set_send" db:"set_send"`
 }
 
+//StateAlert represents state_alert, group stuck in state longer than SLA
+type StateAlert struct {
+	ID        int       `json:"id" db:"id"`
+	Source    int       `json:"source" db:"source"`
+	GroupID   int       `json:"group_id" db:"group_id"`
+	State     int       `json:"state" db:"state"`
+	StateDate time.Time `json:"state_date" db:"state_date"`
+	Created   time.Time `json:"created" db:"created"`
+}
+
+//StatusPush represents status_outbox, state to push to site
+type StatusPush struct {
+	ID       int    `db:"id"`
+	Source   int    `db:"source"`
+	Entity   string `db:"entity"`
+	EntityID string `db:"entity_id"`
+	GroupID  int    `db:"group_id"`
+	//SourceID site order id (order entity)
+	SourceID   string `db:"src_id"`
+	State      int    `db:"state"`
+	SiteStatus int    `db:"site_status"`
+	//IdemKey idempotency key, site ignores repeated push with same key
+	IdemKey     string    `db:"idem_key"`
+	Created     time.Time `db:"created"`
+	Attempt     int       `db:"attempt"`
+	NextAttempt time.Time `db:"next_attempt"`
+	LastError   string    `db:"last_error"`
+	Sent        bool      `db:"-"`
+	Dead        bool      `db:"dead"`
+}
+
+//status push entities
+const (
+	//PushOrder order state
+	PushOrder = "order"
+	//PushPackage package (group) state
+	PushPackage = "package"
+)
+
+//DeliveryUnmapped site delivery id without delivery_type_dictionary mapping
+type DeliveryUnmapped struct {
+	Source   int `json:"source" db:"source"`
+	NativeID int `json:"native_id" db:"native_id"`
+	//Packages count of packages with this delivery id
+	Packages int `json:"packages" db:"packages"`
+	//Sample some of packages ids, comma separated
+	Sample    string    `json:"sample" db:"sample"`
+	FirstSeen time.Time `json:"first_seen" db:"first_seen"`
+	LastSeen  time.Time `json:"last_seen" db:"last_seen"`
+}
+
 //Package represents the  mail package (order group)
 type Package struct {
 	ID               int       `json:"id" db:"id"`
@@ -192,6 +282,18 @@ type Package struct {
 	Boxes            []PackageBox
 	Properties       []PackageProperty
 	Barcodes         []PackageBarcode
+	Issues           []PackageItemIssue
+}
+
+//CountOrders counts distinct orders in package boxes
+func (p *Package) CountOrders() int {
+	m := make(map[string]bool)
+	for _, b := range p.Boxes {
+		for _, i := range b.Items {
+			m[i.OrderID] = true
+		}
+	}
+	return len(m)
 }
 
 //PackageProperty represents the package property
@@ -237,6 +339,24 @@ type PackageBoxItem struct {
 	To      int    `json:"item_to" db:"item_to"`
 }
 
+//PackageItemIssue represents box item problem (order unknown or canceled)
+type PackageItemIssue struct {
+	Source    int    `json:"source" db:"source"`
+	PackageID int    `json:"package_id" db:"package_id"`
+	BoxID     string `json:"box_id" db:"box_id"`
+	OrderID   string `json:"order_id" db:"order_id"`
+	Issue     string `json:"issue" db:"issue"`
+	State     int    `json:"state" db:"state"`
+}
+
+//package box item issues
+const (
+	//IssueOrderUnknown order not found in orders
+	IssueOrderUnknown = "unknown"
+	//IssueOrderCanceled order is canceled
+	IssueOrderCanceled = "canceled"
+)
+
 //SourceURL dto to get url for api calls
 type SourceURL struct {
 	ID       int    `db:"id"`
@@ -255,6 +375,8 @@ type JSONMap struct {
 	Field     string `db:"field"`
 	FieldName string `db:"field_name"`
 	IsList    bool   `db:"list"`
+	//Transform declarative value transform (json), see api builder
+	Transform string `db:"transform"`
 }
 
 //Date is time.Time, used to Marshal/Unmarshal custom date format (dd.mm.yyyy)
@@ -269,6 +391,10 @@ func (d *Date) UnmarshalJSON(b []byte) error {
 	var s string
 	json.Unmarshal(b, &s)
 	t, err := time.Parse("02.01.2006", s)
+	if err != nil {
+		//transformed date
+		t, err = time.Parse(time.RFC3339, s)
+	}
 	if err == nil {
 		*d = Date(t)
 	}
@@ -282,6 +408,19 @@ func (d *Date) MarshalJSON() ([]byte, error) {
 	return j, err
 }
 
+//Scan implements sql.Scanner (parseTime=true)
+func (d *Date) Scan(v interface{}) error {
+	switch t := v.(type) {
+	case nil:
+		*d = Date(time.Time{})
+	case time.Time:
+		*d = Date(t)
+	default:
+		return fmt.Errorf("can't scan %T to Date", v)
+	}
+	return nil
+}
+
 func (d Date) format(s string) string {
 	t := time.Time(d)
 	return t.Format(s)
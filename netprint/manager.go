@@ -2,14 +2,18 @@ package netprint
 
 import (
 	"context"
-	"sync"
 	"time"
 
 	"github.com/egorka-gh/photocycle"
 	"github.com/egorka-gh/photocycle/infrastructure/api"
+	"github.com/egorka-gh/photocycle/logging"
 	log "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 )
 
+//DefaultStatuses group statuses (site) to fetch netprint boxes
+var DefaultStatuses = []int{30, 40}
+
 //New creates new sync manager
 func New(source, offset int, client api.FFService, repo photocycle.Repository, logger log.Logger) *Manager {
 	if offset < 0 {
@@ -34,56 +38,27 @@ type Manager struct {
 	logger log.Logger
 }
 
-//Run calls sync periodicaly, blocks caller till get quit
-func (m *Manager) Run(interval int, quit chan struct{}) {
-	var timer *time.Timer
-	min := 10
-	if interval < min {
-		interval = min
-	}
-	mainCtx, mainCancel := context.WithCancel(context.Background())
-	defer mainCancel()
-	start := make(chan int, 1)
-	defer close(start)
-	var wg sync.WaitGroup
-	loop := true
-
-	start <- 1
-	for loop {
-		select {
-		case <-start:
-			ctx, cancel := context.WithCancel(mainCtx)
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				defer cancel()
-				m.Sync(ctx)
-				timer = time.AfterFunc(time.Minute*time.Duration(interval), func() { start <- 1 })
-			}()
-		case <-quit:
-			if timer != nil {
-				timer.Stop()
-			}
-			mainCancel()
-			loop = false
-			wg.Wait()
-		}
-	}
-
+//RescanResult result of rescan, boxes splited by compare with database
+type RescanResult struct {
+	Source    int
+	Groups    int
+	Added     []photocycle.GroupNetprint
+	Updated   []photocycle.GroupNetprint
+	Unchanged []photocycle.GroupNetprint
 }
 
-//Sync fetch and save new boxes.
+//Sync fetch and save new boxes, errors are logged and returned.
 //boxes are filled with 10-20 min gap (after group get 30 state), so sync uses some offset in hours
-func (m *Manager) Sync(ctx context.Context) {
+func (m *Manager) Sync(ctx context.Context) error {
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	m.logger.Log("event", "start")
+	level.Info(m.logger).Log(logging.KeyMsg, "sync start")
 	//last sync tstamp
 	lastSyncts, err := m.repo.GetLastNetprintSync(ctx, m.source)
 	if err != nil {
-		m.logger.Log("Error", err.Error())
-		return
+		level.Error(m.logger).Log(logging.KeyMsg, "sync failed", logging.KeyErr, err)
+		return err
 	}
 	if lastSyncts == 0 {
 		lastSyncts = time.Now().Unix()
@@ -93,19 +68,84 @@ func (m *Manager) Sync(ctx context.Context) {
 	//current sync timestamp
 	syncts := time.Now().Unix()
 	//fetch
-	groups, err := m.client.GetNPGroups(ctx, []int{30, 40}, t.Unix())
+	nps, groups, err := m.Fetch(ctx, t, time.Time{}, DefaultStatuses)
+	if err != nil {
+		level.Error(m.logger).Log(logging.KeyMsg, "sync failed", logging.KeyErr, err)
+		return err
+	}
+
+	if groups == 0 {
+		level.Info(m.logger).Log(logging.KeyMsg, "sync end", "groups", 0)
+		return nil
+	}
+	defer level.Info(m.logger).Log(logging.KeyMsg, "sync end", "groups", groups, "boxes", countBoxes(nps))
+	//persists
+	err = m.repo.AddNetprints(context.Background(), nps)
+	if err != nil {
+		level.Error(m.logger).Log(logging.KeyMsg, "sync failed", logging.KeyErr, err)
+		return err
+	}
+	//fix fetch timestamp
+	err = m.repo.SetLastNetprintSync(ctx, m.source, syncts)
+	if err != nil {
+		level.Error(m.logger).Log(logging.KeyMsg, "sync failed", logging.KeyErr, err)
+	}
+	return err
+}
+
+//Rescan fetch boxes for groups created in period from - to and compare them with database.
+//if dryRun is false, new and changed boxes are saved
+func (m *Manager) Rescan(ctx context.Context, from, to time.Time, statuses []int, dryRun bool) (RescanResult, error) {
+	res := RescanResult{Source: m.source}
+	nps, groups, err := m.Fetch(ctx, from, to, statuses)
+	if err != nil {
+		return res, err
+	}
+	res.Groups = groups
+	if len(nps) == 0 {
+		return res, nil
+	}
+	ids := make([]int, 0, groups)
+	seen := make(map[int]bool)
+	for _, np := range nps {
+		if !seen[np.GroupID] {
+			seen[np.GroupID] = true
+			ids = append(ids, np.GroupID)
+		}
+	}
+	existing, err := m.repo.GetNetprints(ctx, m.source, ids)
 	if err != nil {
-		m.logger.Log("Error", err.Error())
-		return
+		return res, err
+	}
+	res.Added, res.Updated, res.Unchanged = Diff(existing, nps)
+	if dryRun {
+		return res, nil
 	}
+	changed := make([]photocycle.GroupNetprint, 0, len(res.Added)+len(res.Updated))
+	changed = append(changed, res.Added...)
+	changed = append(changed, res.Updated...)
+	err = m.repo.SetNetprints(ctx, changed)
+	return res, err
+}
 
-	if len(groups) == 0 {
-		m.logger.Log("event", "end", "groups", "0")
-		return
+//Fetch loads netprint boxes from site for groups in statuses created after from.
+//if to is not zero, groups created after to are skipped.
+//returns boxes and number of fetched groups
+func (m *Manager) Fetch(ctx context.Context, from, to time.Time, statuses []int) ([]photocycle.GroupNetprint, int, error) {
+	if len(statuses) == 0 {
+		statuses = DefaultStatuses
+	}
+	groups, err := m.client.GetNPGroups(ctx, statuses, from.Unix())
+	if err != nil {
+		return nil, 0, err
 	}
 	nps := make([]photocycle.GroupNetprint, 0, len(groups))
-	boxCount := 0
+	cnt := 0
 	for _, group := range groups {
+		if !to.IsZero() && group.CreatedTS > to.Unix() {
+			continue
+		}
+		cnt++
 		if !group.Npfactory {
 			continue
 		}
@@ -115,7 +155,6 @@ func (m *Manager) Sync(ctx context.Context) {
 				continue
 			}
 			hasBoxes = true
-			boxCount++
 			nps = append(nps, photocycle.GroupNetprint{
 				BoxNumber:  box.BoxNumber,
 				GroupID:    group.ID,
@@ -129,22 +168,52 @@ func (m *Manager) Sync(ctx context.Context) {
 			nps = append(nps, photocycle.GroupNetprint{
 				BoxNumber:  0,
 				GroupID:    group.ID,
-				NetprintID: "notprocessed",
+				NetprintID: notProcessed,
 				Source:     m.source,
 				State:      0,
 			})
 		}
 	}
-	defer m.logger.Log("event", "end", "groups", len(groups), "boxes", boxCount)
-	//persists
-	err = m.repo.AddNetprints(context.Background(), nps)
-	if err != nil {
-		m.logger.Log("Error", err.Error())
-		return
+	return nps, cnt, nil
+}
+
+//Diff splits fetched boxes to added, updated (state or box number changed) and unchanged
+//compared by source, group & netprint id
+func Diff(existing, fetched []photocycle.GroupNetprint) (added, updated, unchanged []photocycle.GroupNetprint) {
+	type key struct {
+		source  int
+		group   int
+		netprit string
 	}
-	//fix fetch timestamp
-	err = m.repo.SetLastNetprintSync(ctx, m.source, syncts)
-	if err != nil {
-		m.logger.Log("Error", err.Error())
+	m := make(map[key]photocycle.GroupNetprint, len(existing))
+	for _, e := range existing {
+		m[key{e.Source, e.GroupID, e.NetprintID}] = e
+	}
+	added = make([]photocycle.GroupNetprint, 0)
+	updated = make([]photocycle.GroupNetprint, 0)
+	unchanged = make([]photocycle.GroupNetprint, 0)
+	for _, f := range fetched {
+		e, ok := m[key{f.Source, f.GroupID, f.NetprintID}]
+		switch {
+		case !ok:
+			added = append(added, f)
+		case e.State != f.State || e.BoxNumber != f.BoxNumber:
+			updated = append(updated, f)
+		default:
+			unchanged = append(unchanged, f)
+		}
+	}
+	return added, updated, unchanged
+}
+
+const notProcessed = "notprocessed"
+
+func countBoxes(nps []photocycle.GroupNetprint) int {
+	cnt := 0
+	for _, np := range nps {
+		if np.NetprintID != notProcessed {
+			cnt++
+		}
 	}
+	return cnt
 }
@@ -0,0 +1,29 @@
+package netprint
+
+import (
+	"testing"
+
+	"github.com/egorka-gh/photocycle"
+)
+
+func TestDiff(t *testing.T) {
+	existing := []photocycle.GroupNetprint{
+		{Source: 11, GroupID: 1, NetprintID: "a", State: 30, BoxNumber: 1},
+		{Source: 11, GroupID: 1, NetprintID: "b", State: 30, BoxNumber: 2},
+	}
+	fetched := []photocycle.GroupNetprint{
+		{Source: 11, GroupID: 1, NetprintID: "a", State: 30, BoxNumber: 1},
+		{Source: 11, GroupID: 1, NetprintID: "b", State: 40, BoxNumber: 2},
+		{Source: 11, GroupID: 2, NetprintID: "c", State: 30, BoxNumber: 1},
+	}
+	added, updated, unchanged := Diff(existing, fetched)
+	if len(added) != 1 || added[0].NetprintID != "c" {
+		t.Errorf("Expected added [c], got %v", added)
+	}
+	if len(updated) != 1 || updated[0].NetprintID != "b" {
+		t.Errorf("Expected updated [b], got %v", updated)
+	}
+	if len(unchanged) != 1 || unchanged[0].NetprintID != "a" {
+		t.Errorf("Expected unchanged [a], got %v", unchanged)
+	}
+}
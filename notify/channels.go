@@ -0,0 +1,199 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//ChannelConfig channel settings, used fields depend on type (smtp, webhook, telegram)
+type ChannelConfig struct {
+	Type string `mapstructure:"type"`
+	//smtp
+	Host string   `mapstructure:"host"`
+	Port int      `mapstructure:"port"`
+	User string   `mapstructure:"user"`
+	Pass string   `mapstructure:"pass"`
+	From string   `mapstructure:"from"`
+	To   []string `mapstructure:"to"`
+	//webhook
+	URL string `mapstructure:"url"`
+	//telegram
+	Token string `mapstructure:"token"`
+	Chat  string `mapstructure:"chat"`
+}
+
+//NewChannel creates Notifier by config type
+func NewChannel(c ChannelConfig) (Notifier, error) {
+	hc := &http.Client{Timeout: 20 * time.Second}
+	switch c.Type {
+	case "smtp":
+		if c.Host == "" || c.From == "" || len(c.To) == 0 {
+			return nil, fmt.Errorf("smtp channel: host, from and to are required")
+		}
+		if c.Port == 0 {
+			c.Port = 25
+		}
+		return &SMTP{Host: c.Host, Port: c.Port, User: c.User, Pass: c.Pass, From: c.From, To: c.To}, nil
+	case "webhook":
+		if c.URL == "" {
+			return nil, fmt.Errorf("webhook channel: url is required")
+		}
+		return &Webhook{URL: c.URL, Client: hc}, nil
+	case "telegram":
+		if c.Token == "" || c.Chat == "" {
+			return nil, fmt.Errorf("telegram channel: token and chat are required")
+		}
+		return &Telegram{Token: c.Token, Chat: c.Chat, Client: hc}, nil
+	}
+	return nil, fmt.Errorf("unknown channel type %q", c.Type)
+}
+
+//SMTP sends email
+type SMTP struct {
+	Host string
+	Port int
+	User string
+	Pass string
+	From string
+	To   []string
+}
+
+//smtpTimeout limits smtp session (dial and send)
+const smtpTimeout = 30 * time.Second
+
+//Notify implements Notifier, same as smtp.SendMail but bounded by ctx and smtpTimeout
+func (s *SMTP) Notify(ctx context.Context, subject, body string) error {
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(s.Host, strconv.Itoa(s.Port)))
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	if err = conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+			return err
+		}
+	}
+	if s.User != "" {
+		if err = c.Auth(smtp.PlainAuth("", s.User, s.Pass, s.Host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(s.From); err != nil {
+		return err
+	}
+	for _, to := range s.To {
+		if err = c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(s.message(subject, body)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+//message builds email
+func (s *SMTP) message(subject, body string) []byte {
+	var sb strings.Builder
+	sb.WriteString("From: " + s.From + "\r\n")
+	sb.WriteString("To: " + strings.Join(s.To, ", ") + "\r\n")
+	sb.WriteString("Subject: " + subject + "\r\n")
+	sb.WriteString("MIME-Version: 1.0\r\n")
+	sb.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	sb.WriteString("\r\n")
+	sb.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(sb.String())
+}
+
+//Webhook posts json {"subject": "", "text": ""}
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+//Notify implements Notifier
+func (w *Webhook) Notify(ctx context.Context, subject, body string) error {
+	return postJSON(ctx, w.Client, w.URL, map[string]string{"subject": subject, "text": body})
+}
+
+//Telegram sends message by bot api
+type Telegram struct {
+	Token  string
+	Chat   string
+	Client *http.Client
+	//BaseURL bot api url, default https://api.telegram.org
+	BaseURL string
+}
+
+//telegram message limit
+const telegramMaxText = 4000
+
+//Notify implements Notifier
+func (t *Telegram) Notify(ctx context.Context, subject, body string) error {
+	base := t.BaseURL
+	if base == "" {
+		base = "https://api.telegram.org"
+	}
+	text := subject + "\n" + body
+	if r := []rune(text); len(r) > telegramMaxText {
+		text = string(r[:telegramMaxText])
+	}
+	err := postJSON(ctx, t.Client, fmt.Sprintf("%s/bot%s/sendMessage", base, t.Token), map[string]string{"chat_id": t.Chat, "text": text})
+	//url.Error holds request url with bot token
+	if ue, ok := err.(*url.Error); ok {
+		return fmt.Errorf("telegram sendMessage error: %s", ue.Err.Error())
+	}
+	return err
+}
+
+func postJSON(ctx context.Context, c *http.Client, url string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	rq, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	rq = rq.WithContext(ctx)
+	rq.Header.Set("Content-Type", "application/json")
+	resp, err := c.Do(rq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("http status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/egorka-gh/photocycle/logging"
+	log "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+//event kinds
+const (
+	//KindJobError job run failed
+	KindJobError = "job_error"
+	//KindBreaker site api client is broken or over calls limit
+	KindBreaker = "breaker"
+	//KindDeadPackage package is out of processing after max attempts
+	KindDeadPackage = "dead_package"
+	//KindStuckGroup group stays in state longer than SLA
+	KindStuckGroup = "stuck_group"
+	//KindWatchdog job runner stopped scheduling
+	KindWatchdog = "watchdog"
+)
+
+//Event something to notify about
+type Event struct {
+	Kind    string
+	Job     string
+	Source  int
+	Message string
+	Time    time.Time
+}
+
+func (e Event) String() string {
+	var sb strings.Builder
+	sb.WriteString("[" + e.Kind + "]")
+	if e.Job != "" {
+		sb.WriteString(" " + e.Job)
+	}
+	if e.Source != 0 {
+		sb.WriteString(fmt.Sprintf(" source %d", e.Source))
+	}
+	sb.WriteString(": " + e.Message)
+	return sb.String()
+}
+
+//Sender accepts events, never blocks on delivery
+type Sender interface {
+	Send(e Event)
+}
+
+//Notifier delivers message to channel
+type Notifier interface {
+	Notify(ctx context.Context, subject, body string) error
+}
+
+//Nop sender ignores events
+var Nop Sender = nopSender{}
+
+type nopSender struct{}
+
+func (nopSender) Send(e Event) {}
+
+//Rule routes event kinds to channel
+type Rule struct {
+	Events  []string `mapstructure:"events"`
+	Channel string   `mapstructure:"channel"`
+}
+
+//maxDigest max events listed in one message
+const maxDigest = 30
+
+//maxPending max distinct events kept per channel, rest are counted as dropped
+const maxPending = 500
+
+//queue pending events of channel, same events are folded into count
+type queue struct {
+	events  []Event
+	counts  []int
+	index   map[string]int
+	dropped int
+}
+
+func (q *queue) add(e Event) {
+	s := e.String()
+	if i, ok := q.index[s]; ok {
+		q.counts[i]++
+		return
+	}
+	if len(q.events) >= maxPending {
+		q.dropped++
+		return
+	}
+	if q.index == nil {
+		q.index = make(map[string]int)
+	}
+	q.index[s] = len(q.events)
+	q.events = append(q.events, e)
+	q.counts = append(q.counts, 1)
+}
+
+//Dispatcher routes events to channels by rules,
+//sends not more than one message per channel per interval, events are collected in digest
+type Dispatcher struct {
+	mu       sync.Mutex
+	channels map[string]Notifier
+	rules    map[string][]string
+	interval time.Duration
+	pending  map[string]*queue
+	lastSent map[string]time.Time
+	logger   log.Logger
+}
+
+//NewDispatcher creates Dispatcher, interval is min interval between messages of one channel
+func NewDispatcher(channels map[string]Notifier, rules []Rule, interval time.Duration, logger log.Logger) (*Dispatcher, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	d := &Dispatcher{
+		channels: channels,
+		rules:    make(map[string][]string),
+		interval: interval,
+		pending:  make(map[string]*queue),
+		lastSent: make(map[string]time.Time),
+		logger:   log.With(logger, logging.KeyComponent, "notify"),
+	}
+	for _, r := range rules {
+		if _, ok := channels[r.Channel]; !ok {
+			return nil, fmt.Errorf("notify rule: unknown channel %q", r.Channel)
+		}
+		for _, k := range r.Events {
+			d.rules[k] = append(d.rules[k], r.Channel)
+		}
+	}
+	return d, nil
+}
+
+//Send queues event for channels by rules
+func (d *Dispatcher) Send(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, ch := range d.rules[e.Kind] {
+		q, ok := d.pending[ch]
+		if !ok {
+			q = &queue{}
+			d.pending[ch] = q
+		}
+		q.add(e)
+	}
+}
+
+//Flush sends pending events of channels which interval is elapsed
+func (d *Dispatcher) Flush(ctx context.Context, now time.Time) {
+	d.mu.Lock()
+	ready := make(map[string]*queue)
+	for ch, q := range d.pending {
+		if len(q.events) == 0 || now.Sub(d.lastSent[ch]) < d.interval {
+			continue
+		}
+		ready[ch] = q
+		delete(d.pending, ch)
+		d.lastSent[ch] = now
+	}
+	d.mu.Unlock()
+
+	for ch, q := range ready {
+		subject, body := digest(q)
+		if err := d.channels[ch].Notify(ctx, subject, body); err != nil {
+			level.Error(d.logger).Log(logging.KeyMsg, "notify failed", "channel", ch, logging.KeyErr, err)
+		}
+	}
+}
+
+//flushTimeout limits one flush, so stop is not blocked by dead channel
+const flushTimeout = time.Minute
+
+//Run flushes events periodically till stop
+func (d *Dispatcher) Run(stop chan struct{}) error {
+	t := time.NewTicker(30 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			d.flushTimeout(now)
+		case <-stop:
+			//last chance
+			d.flushTimeout(time.Now().Add(d.interval))
+			return nil
+		}
+	}
+}
+
+func (d *Dispatcher) flushTimeout(now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	d.Flush(ctx, now)
+}
+
+//digest builds one message from queued events
+func digest(q *queue) (string, string) {
+	kinds := make(map[string]int)
+	for i, e := range q.events {
+		kinds[e.Kind] += q.counts[i]
+	}
+	names := make([]string, 0, len(kinds))
+	for k, n := range kinds {
+		names = append(names, fmt.Sprintf("%s %d", k, n))
+	}
+	sort.Strings(names)
+	subject := fmt.Sprintf("photocycle: %s", strings.Join(names, ", "))
+
+	var sb strings.Builder
+	for i, e := range q.events {
+		if i == maxDigest {
+			sb.WriteString(fmt.Sprintf("... и еще %d\n", len(q.events)-maxDigest))
+			break
+		}
+		sb.WriteString(e.String())
+		if q.counts[i] > 1 {
+			sb.WriteString(fmt.Sprintf(" (x%d)", q.counts[i]))
+		}
+		sb.WriteString("\n")
+	}
+	if q.dropped > 0 {
+		sb.WriteString(fmt.Sprintf("пропущено событий %d\n", q.dropped))
+	}
+	return subject, sb.String()
+}
@@ -0,0 +1,175 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//memNotifier collects messages
+type memNotifier struct {
+	subjects []string
+	bodies   []string
+}
+
+func (m *memNotifier) Notify(ctx context.Context, subject, body string) error {
+	m.subjects = append(m.subjects, subject)
+	m.bodies = append(m.bodies, body)
+	return nil
+}
+
+func TestDispatcher(t *testing.T) {
+	admin, ops := &memNotifier{}, &memNotifier{}
+	rules := []Rule{
+		{Events: []string{KindJobError, KindDeadPackage}, Channel: "admin"},
+		{Events: []string{KindStuckGroup}, Channel: "ops"},
+	}
+	if _, err := NewDispatcher(map[string]Notifier{"admin": admin}, rules, time.Minute, nil); err == nil {
+		t.Fatal("expected unknown channel error")
+	}
+	d, err := NewDispatcher(map[string]Notifier{"admin": admin, "ops": ops}, rules, 10*time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	d.Send(Event{Kind: KindJobError, Job: "fillbox", Message: "db is down"})
+	d.Send(Event{Kind: KindJobError, Job: "fillbox", Message: "db is down"})
+	d.Send(Event{Kind: KindDeadPackage, Job: "fillbox", Source: 2, Message: "group 7 is dead"})
+	d.Send(Event{Kind: KindBreaker, Job: "fillbox", Source: 2, Message: "not routed"})
+	d.Flush(context.Background(), now)
+
+	if len(admin.subjects) != 1 || len(ops.subjects) != 0 {
+		t.Fatalf("expected one admin message, got admin %d, ops %d", len(admin.subjects), len(ops.subjects))
+	}
+	if admin.subjects[0] != "photocycle: dead_package 1, job_error 2" {
+		t.Errorf("unexpected subject %q", admin.subjects[0])
+	}
+	if !strings.Contains(admin.bodies[0], "[job_error] fillbox: db is down (x2)") {
+		t.Errorf("expected counted event in body, got %q", admin.bodies[0])
+	}
+	if !strings.Contains(admin.bodies[0], "[dead_package] fillbox source 2: group 7 is dead") {
+		t.Errorf("expected dead package in body, got %q", admin.bodies[0])
+	}
+
+	//rate limit, events are kept till interval elapsed
+	d.Send(Event{Kind: KindJobError, Job: "import", Message: "timeout"})
+	d.Send(Event{Kind: KindStuckGroup, Source: 1, Message: "group 5 stuck"})
+	d.Flush(context.Background(), now.Add(time.Minute))
+	if len(admin.subjects) != 1 || len(ops.subjects) != 1 {
+		t.Fatalf("expected admin limited and ops sent, got admin %d, ops %d", len(admin.subjects), len(ops.subjects))
+	}
+	d.Flush(context.Background(), now.Add(11*time.Minute))
+	if len(admin.subjects) != 2 {
+		t.Fatalf("expected second admin message, got %d", len(admin.subjects))
+	}
+	if !strings.Contains(admin.bodies[1], "import: timeout") {
+		t.Errorf("expected pending event in digest, got %q", admin.bodies[1])
+	}
+}
+
+func TestDigestLimit(t *testing.T) {
+	q := &queue{}
+	for i := 0; i < maxDigest+5; i++ {
+		q.add(Event{Kind: KindStuckGroup, Source: i + 1, Message: "stuck"})
+	}
+	_, body := digest(q)
+	if n := strings.Count(body, "\n"); n != maxDigest+1 {
+		t.Errorf("expected %d lines, got %d", maxDigest+1, n)
+	}
+	if !strings.Contains(body, "... и еще 5") {
+		t.Errorf("expected rest counter, got %q", body)
+	}
+
+	//same events are folded, distinct events over maxPending are dropped
+	q = &queue{}
+	for i := 0; i < maxPending+10; i++ {
+		q.add(Event{Kind: KindJobError, Job: "fillbox", Message: "db is down"})
+		q.add(Event{Kind: KindStuckGroup, Source: i + 1, Message: "stuck"})
+	}
+	if len(q.events) != maxPending || q.counts[0] != maxPending+10 || q.dropped != 11 {
+		t.Errorf("expected %d events, first counted %d, dropped 11, got %d, %d, %d", maxPending, maxPending+10, len(q.events), q.counts[0], q.dropped)
+	}
+	subject, body := digest(q)
+	if !strings.Contains(subject, fmt.Sprintf("job_error %d", maxPending+10)) || !strings.Contains(body, "пропущено событий 11") {
+		t.Errorf("unexpected digest %q %q", subject, body)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	var got map[string]string
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		got = nil
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	n, err := NewChannel(ChannelConfig{Type: "webhook", URL: srv.URL + "/hook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = n.Notify(context.Background(), "subj", "text"); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/hook" || got["subject"] != "subj" || got["text"] != "text" {
+		t.Errorf("unexpected webhook request %s %v", path, got)
+	}
+
+	tg := &Telegram{Token: "tkn", Chat: "42", Client: srv.Client(), BaseURL: srv.URL}
+	if err = tg.Notify(context.Background(), "subj", strings.Repeat("я", telegramMaxText)); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/bottkn/sendMessage" || got["chat_id"] != "42" {
+		t.Errorf("unexpected telegram request %s %v", path, got)
+	}
+	if l := len([]rune(got["text"])); l != telegramMaxText {
+		t.Errorf("expected text cut to %d, got %d", telegramMaxText, l)
+	}
+
+	srv.Close()
+	if err = tg.Notify(context.Background(), "subj", "text"); err == nil || strings.Contains(err.Error(), "tkn") {
+		t.Errorf("expected error without token, got %v", err)
+	}
+
+	if _, err = NewChannel(ChannelConfig{Type: "smtp", Host: "localhost"}); err == nil {
+		t.Error("expected smtp config error")
+	}
+	if _, err = NewChannel(ChannelConfig{Type: "icq"}); err == nil {
+		t.Error("expected unknown type error")
+	}
+}
+
+func TestSMTPTimeout(t *testing.T) {
+	//server accepts connection and never greets
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			defer c.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+	s := &SMTP{Host: "127.0.0.1", Port: addr.Port, From: "a@b.c", To: []string{"d@e.f"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err = s.Notify(ctx, "subj", "text"); err == nil {
+		t.Fatal("expected timeout error")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("expected notify bounded by ctx, took %s", d)
+	}
+}
@@ -0,0 +1,9 @@
+-- netprint boxes sync flag, used by cycle Netprint job
+ALTER TABLE sources
+  ADD COLUMN netprint TINYINT(1) NOT NULL DEFAULT 0;
+
+-- keep sources that were served by separate Netprint_<id> services
+UPDATE sources s
+  INNER JOIN sources_sync ss ON s.id = ss.id
+  SET s.netprint = 1
+  WHERE ss.np_sync_tstamp > 0;
@@ -0,0 +1,6 @@
+-- package_new failure policy: next attempt, last error, dead-letter state
+ALTER TABLE package_new
+  ADD COLUMN next_attempt DATETIME NULL DEFAULT NULL,
+  ADD COLUMN last_error VARCHAR(250) NOT NULL DEFAULT '',
+  ADD COLUMN dead TINYINT(1) NOT NULL DEFAULT 0,
+  ADD INDEX package_new_dead_next (dead, next_attempt);
@@ -0,0 +1,24 @@
+-- package boxes from group payload (sites without get_group_boxes)
+-- family 7 - box, keys relative to group boxes[] element
+-- family 8 - box item, keys relative to box orders[] element
+INSERT IGNORE INTO attr_type (id, attr_fml, field, list, name) VALUES
+  (701, 7, 'box_id', 0, 'ID коробки'),
+  (702, 7, 'box_num', 0, 'Номер коробки'),
+  (703, 7, 'barcode', 0, 'Штрихкод коробки'),
+  (704, 7, 'price', 0, 'Стоимость коробки'),
+  (705, 7, 'weight', 0, 'Вес коробки'),
+  (801, 8, 'order_id', 0, 'ID заказа'),
+  (802, 8, 'alias', 0, 'Алиас'),
+  (803, 8, 'type', 0, 'Тип'),
+  (804, 8, 'item_from', 0, 'С'),
+  (805, 8, 'item_to', 0, 'По');
+
+INSERT IGNORE INTO attr_json_map (src_type, attr_type, json_key) VALUES
+  (4, 702, 'number'),
+  (4, 703, 'barcode'),
+  (4, 705, 'weight'),
+  (4, 801, 'id'),
+  (4, 802, 'alias'),
+  (4, 803, 'type'),
+  (4, 804, 'order_items_from'),
+  (4, 805, 'order_items_to');
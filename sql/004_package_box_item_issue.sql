@@ -0,0 +1,11 @@
+-- box items with unknown or canceled orders, for OTK
+CREATE TABLE IF NOT EXISTS package_box_item_issue (
+  source INT NOT NULL,
+  package_id INT NOT NULL,
+  box_id VARCHAR(50) NOT NULL,
+  order_id VARCHAR(50) NOT NULL,
+  issue VARCHAR(20) NOT NULL,
+  state INT NOT NULL DEFAULT 0,
+  created DATETIME NOT NULL,
+  PRIMARY KEY (source, package_id, box_id, order_id)
+);
@@ -0,0 +1,14 @@
+-- package changes made by site after package was created
+CREATE TABLE IF NOT EXISTS package_change_log (
+  id INT NOT NULL AUTO_INCREMENT,
+  source INT NOT NULL,
+  package_id INT NOT NULL,
+  entity VARCHAR(20) NOT NULL,
+  item_key VARCHAR(50) NOT NULL DEFAULT '',
+  field VARCHAR(100) NOT NULL DEFAULT '',
+  old_value VARCHAR(250) NOT NULL DEFAULT '',
+  new_value VARCHAR(250) NOT NULL DEFAULT '',
+  created DATETIME NOT NULL,
+  PRIMARY KEY (id),
+  KEY package_change_log_package (source, package_id)
+);
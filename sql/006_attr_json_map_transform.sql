@@ -0,0 +1,9 @@
+-- declarative value transforms for json map (see infrastructure/api/transform.go)
+ALTER TABLE attr_json_map
+  ADD COLUMN transform VARCHAR(1000) NOT NULL DEFAULT '';
+
+-- replaces hardcoded debt_sum default in builder
+UPDATE attr_json_map jm
+  INNER JOIN attr_type at ON jm.attr_type = at.id
+  SET jm.transform = '{"default": "0"}'
+  WHERE at.attr_fml = 6 AND at.field = 'debt_sum' AND jm.transform = '';
@@ -0,0 +1,9 @@
+-- packages with site delivery id missing in delivery_type_dictionary
+CREATE TABLE IF NOT EXISTS delivery_unmapped (
+  source INT NOT NULL,
+  native_id INT NOT NULL,
+  package_id INT NOT NULL,
+  first_seen DATETIME NOT NULL,
+  last_seen DATETIME NOT NULL,
+  PRIMARY KEY (source, native_id, package_id)
+);
@@ -0,0 +1,62 @@
+-- orders from group payload
+-- family 9 - order, keys relative to group orders[] element
+-- family 10 - order extra info, keys relative to order element
+-- family 11 - print group, keys relative to order items[] element
+-- family 12 - print group file, keys relative to item files[] element
+-- list rows (list = 1) set path of list elements, date fields need date transform
+INSERT IGNORE INTO attr_type (id, attr_fml, field, list, name) VALUES
+  (900, 9, 'orders', 1, 'Заказы группы'),
+  (901, 9, 'src_id', 0, 'ID заказа на сайте'),
+  (902, 9, 'src_date', 0, 'Дата заказа'),
+  (903, 9, 'ftp_folder', 0, 'Папка FTP'),
+  (904, 9, 'fotos_num', 0, 'Кол-во файлов'),
+  (905, 9, 'client_id', 0, 'ID клиента'),
+  (906, 9, 'production', 0, 'Производство'),
+  (1001, 10, 'calc_alias', 0, 'Алиас'),
+  (1002, 10, 'calc_title', 0, 'Наименование'),
+  (1003, 10, 'format', 0, 'Формат'),
+  (1004, 10, 'cover', 0, 'Обложка'),
+  (1005, 10, 'cover_material', 0, 'Материал обложки'),
+  (1006, 10, 'paper', 0, 'Бумага'),
+  (1007, 10, 'endpaper', 0, 'Форзац'),
+  (1008, 10, 'interlayer', 0, 'Прослойка'),
+  (1009, 10, 'corner_type', 0, 'Углы'),
+  (1010, 10, 'kaptal', 0, 'Каптал'),
+  (1011, 10, 'books', 0, 'Кол-во книг'),
+  (1012, 10, 'sheets', 0, 'Кол-во разворотов'),
+  (1013, 10, 'weight', 0, 'Вес'),
+  (1014, 10, 'remark', 0, 'Комментарий'),
+  (1100, 11, 'items', 1, 'Группы печати заказа'),
+  (1101, 11, 'alias', 0, 'Алиас'),
+  (1102, 11, 'path', 0, 'Папка'),
+  (1103, 11, 'width', 0, 'Ширина'),
+  (1104, 11, 'height', 0, 'Длина'),
+  (1105, 11, 'paper', 0, 'Бумага'),
+  (1106, 11, 'book_part', 0, 'Часть книги'),
+  (1107, 11, 'book_num', 0, 'Кол-во книг'),
+  (1108, 11, 'sheet_num', 0, 'Кол-во разворотов'),
+  (1109, 11, 'is_pdf', 0, 'PDF'),
+  (1110, 11, 'is_duplex', 0, 'Дуплекс'),
+  (1111, 11, 'prints', 0, 'Кол-во отпечатков'),
+  (1200, 12, 'files', 1, 'Файлы группы печати'),
+  (1201, 12, 'file_name', 0, 'Файл'),
+  (1202, 12, 'prt_qty', 0, 'Кол-во'),
+  (1203, 12, 'book_num', 0, 'Книга'),
+  (1204, 12, 'page_num', 0, 'Страница'),
+  (1205, 12, 'caption', 0, 'Подпись'),
+  (1206, 12, 'book_part', 0, 'Часть книги');
+
+INSERT IGNORE INTO attr_json_map (src_type, attr_type, json_key, transform) VALUES
+  (4, 900, 'orders[*]', ''),
+  (4, 901, 'id', ''),
+  (4, 902, 'created', '{"date":"2006-01-02 15:04:05"}'),
+  (4, 903, 'ftp_folder', ''),
+  (4, 1001, 'alias', ''),
+  (4, 1002, 'title', ''),
+  (4, 1100, 'items[*]', ''),
+  (4, 1101, 'alias', ''),
+  (4, 1103, 'width', ''),
+  (4, 1104, 'height', ''),
+  (4, 1200, 'files[*]', ''),
+  (4, 1201, 'name', ''),
+  (4, 1202, 'qty', '');
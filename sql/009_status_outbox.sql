@@ -0,0 +1,61 @@
+-- push production states back to sites
+-- status_push_map - photocycle state to site status by source, entity: 'order' or 'package'
+CREATE TABLE IF NOT EXISTS status_push_map (
+  source INT NOT NULL,
+  entity VARCHAR(10) NOT NULL,
+  state INT NOT NULL,
+  site_status INT NOT NULL,
+  PRIMARY KEY (source, entity, state)
+);
+
+-- transactional outbox, filled by triggers in the same transaction as state change
+-- idem_key - idempotency key sent to site, one row per entity state
+CREATE TABLE IF NOT EXISTS status_outbox (
+  id INT NOT NULL AUTO_INCREMENT,
+  source INT NOT NULL,
+  entity VARCHAR(10) NOT NULL,
+  entity_id VARCHAR(50) NOT NULL,
+  group_id INT NOT NULL DEFAULT 0,
+  src_id VARCHAR(50) NOT NULL DEFAULT '',
+  state INT NOT NULL,
+  site_status INT NOT NULL,
+  idem_key VARCHAR(100) NOT NULL,
+  created DATETIME NOT NULL,
+  attempt INT NOT NULL DEFAULT 0,
+  next_attempt DATETIME NULL DEFAULT NULL,
+  last_error VARCHAR(250) NOT NULL DEFAULT '',
+  sent DATETIME NULL DEFAULT NULL,
+  dead TINYINT(1) NOT NULL DEFAULT 0,
+  PRIMARY KEY (id),
+  UNIQUE KEY status_outbox_idem (idem_key),
+  KEY status_outbox_pending (sent, dead, next_attempt)
+);
+
+DELIMITER $$
+
+DROP TRIGGER IF EXISTS tr_orders_status_outbox$$
+CREATE TRIGGER tr_orders_status_outbox AFTER UPDATE ON orders FOR EACH ROW
+BEGIN
+  IF NEW.state != OLD.state THEN
+    INSERT IGNORE INTO status_outbox (source, entity, entity_id, group_id, src_id, state, site_status, idem_key, created)
+      SELECT NEW.source, 'order', NEW.id, NEW.group_id, NEW.src_id, NEW.state, m.site_status, CONCAT('order:', NEW.id, ':', NEW.state), NOW()
+        FROM status_push_map m
+        WHERE m.source = NEW.source AND m.entity = 'order' AND m.state = NEW.state;
+  END IF;
+END$$
+
+DROP TRIGGER IF EXISTS tr_package_status_outbox$$
+CREATE TRIGGER tr_package_status_outbox AFTER UPDATE ON package FOR EACH ROW
+BEGIN
+  IF NEW.state != OLD.state THEN
+    INSERT IGNORE INTO status_outbox (source, entity, entity_id, group_id, src_id, state, site_status, idem_key, created)
+      SELECT NEW.source, 'package', NEW.id, NEW.id, '', NEW.state, m.site_status, CONCAT('package:', NEW.source, ':', NEW.id, ':', NEW.state), NOW()
+        FROM status_push_map m
+        WHERE m.source = NEW.source AND m.entity = 'package' AND m.state = NEW.state;
+  END IF;
+END$$
+
+DELIMITER ;
+
+-- sample mapping, site codes must be checked for each source
+-- INSERT INTO status_push_map (source, entity, state, site_status) VALUES (1, 'order', 300, 60), (1, 'package', 460, 70), (1, 'package', 465, 80);
@@ -0,0 +1,13 @@
+-- groups stuck in state longer than SLA
+-- active alert has resolved IS NULL, one active alert per source, group, state
+CREATE TABLE IF NOT EXISTS state_alert (
+  id INT NOT NULL AUTO_INCREMENT,
+  source INT NOT NULL,
+  group_id INT NOT NULL,
+  state INT NOT NULL,
+  state_date DATETIME NOT NULL,
+  created DATETIME NOT NULL,
+  resolved DATETIME NULL DEFAULT NULL,
+  PRIMARY KEY (id),
+  KEY state_alert_active (resolved, source, group_id)
+);
@@ -0,0 +1,11 @@
+-- one active alert per source, group, state
+-- active is 1 for not resolved alert and NULL for resolved, so resolved alerts don't collide in unique key
+-- resolve duplicated active alerts, keep last one
+UPDATE state_alert a
+  JOIN state_alert b ON b.source = a.source AND b.group_id = a.group_id AND b.state = a.state AND b.id > a.id AND b.resolved IS NULL
+  SET a.resolved = NOW()
+  WHERE a.resolved IS NULL;
+
+ALTER TABLE state_alert
+  ADD COLUMN active TINYINT AS (IF(resolved IS NULL, 1, NULL)) STORED,
+  ADD UNIQUE KEY state_alert_active_uk (source, group_id, state, active);
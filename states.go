@@ -165,3 +165,12 @@ const (
 	//StateSkiped represent photocycle state
 	StateSkiped = 520 //Пропущен
 )
+
+//IsCanceled checks if state is one of canceled states
+func IsCanceled(state int) bool {
+	switch state {
+	case StateCanceledWeb, StateCanceled, StateCanceledPHCycle, StateCanceledPoduction:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,235 @@
+package tracing
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//SpanData finished span
+type SpanData struct {
+	TraceID  string                 `json:"trace_id"`
+	SpanID   string                 `json:"span_id"`
+	ParentID string                 `json:"parent_id,omitempty"`
+	ItemID   string                 `json:"item_id,omitempty"`
+	Name     string                 `json:"name"`
+	Start    time.Time              `json:"start"`
+	End      time.Time              `json:"end"`
+	Duration float64                `json:"duration_ms"`
+	Attrs    map[string]interface{} `json:"attrs,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+}
+
+//Exporter writes finished spans
+type Exporter interface {
+	Export(s SpanData)
+	Close() error
+}
+
+var exporter atomic.Value
+
+type exporterHolder struct{ e Exporter }
+
+//SetExporter sets global span exporter, nil disables spans
+func SetExporter(e Exporter) {
+	exporter.Store(exporterHolder{e})
+}
+
+func currentExporter() Exporter {
+	h, _ := exporter.Load().(exporterHolder)
+	return h.e
+}
+
+//Span running span, nil span is valid and does nothing
+type Span struct {
+	data SpanData
+	e    Exporter
+}
+
+//StartSpan starts span if exporter is set, span trace id is run id.
+//attrs are key value pairs
+func StartSpan(ctx context.Context, name string, attrs ...interface{}) (context.Context, *Span) {
+	e := currentExporter()
+	if e == nil {
+		return ctx, nil
+	}
+	s := &Span{
+		e: e,
+		data: SpanData{
+			TraceID: RunID(ctx),
+			SpanID:  NewID(),
+			ItemID:  ItemID(ctx),
+			Name:    name,
+			Start:   time.Now(),
+		},
+	}
+	if p, ok := ctx.Value(spanKey).(*Span); ok && p != nil {
+		s.data.ParentID = p.data.SpanID
+	}
+	for i := 0; i < len(attrs)-1; i += 2 {
+		s.SetAttr(fmt.Sprint(attrs[i]), attrs[i+1])
+	}
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+//SetAttr sets span attribute
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if s.data.Attrs == nil {
+		s.data.Attrs = make(map[string]interface{})
+	}
+	s.data.Attrs[key] = value
+}
+
+//End finishes and exports span
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.data.End = time.Now()
+	s.data.Duration = float64(s.data.End.Sub(s.data.Start).Microseconds()) / 1000
+	if err != nil {
+		s.data.Error = err.Error()
+	}
+	s.e.Export(s.data)
+}
+
+//fileExporter writes spans as json lines
+type fileExporter struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+//NewFileExporter creates exporter that appends spans to file as json lines
+func NewFileExporter(path string) (Exporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileExporter{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (e *fileExporter) Export(s SpanData) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.w.Write(b)
+	e.w.WriteByte('\n')
+	//root span (job run) ends run
+	if s.ParentID == "" {
+		e.w.Flush()
+	}
+}
+
+func (e *fileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.w.Flush()
+	return e.f.Close()
+}
+
+//collectorExporter posts spans batches to collector as json array
+type collectorExporter struct {
+	url    string
+	client *http.Client
+	spans  chan SpanData
+	done   chan struct{}
+	//failed posts
+	errors int64
+}
+
+//collector batch settings
+const (
+	collectorBatch    = 100
+	collectorInterval = 5 * time.Second
+)
+
+//NewCollectorExporter creates exporter that posts spans to collector url,
+//spans are dropped if collector is slow
+func NewCollectorExporter(url string, client *http.Client) Exporter {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	e := &collectorExporter{
+		url:    url,
+		client: client,
+		spans:  make(chan SpanData, collectorBatch*10),
+		done:   make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *collectorExporter) Export(s SpanData) {
+	select {
+	case e.spans <- s:
+	default:
+		//drop
+	}
+}
+
+func (e *collectorExporter) Close() error {
+	close(e.spans)
+	<-e.done
+	if n := atomic.LoadInt64(&e.errors); n > 0 {
+		return fmt.Errorf("collector posts failed %d", n)
+	}
+	return nil
+}
+
+func (e *collectorExporter) run() {
+	defer close(e.done)
+	t := time.NewTicker(collectorInterval)
+	defer t.Stop()
+	batch := make([]SpanData, 0, collectorBatch)
+	for {
+		select {
+		case s, ok := <-e.spans:
+			if !ok {
+				e.post(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= collectorBatch {
+				e.post(batch)
+				batch = batch[:0]
+			}
+		case <-t.C:
+			e.post(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (e *collectorExporter) post(batch []SpanData) {
+	if len(batch) == 0 {
+		return
+	}
+	b, err := json.Marshal(batch)
+	if err != nil {
+		atomic.AddInt64(&e.errors, 1)
+		return
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		atomic.AddInt64(&e.errors, 1)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		atomic.AddInt64(&e.errors, 1)
+	}
+}
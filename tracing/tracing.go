@@ -0,0 +1,83 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/egorka-gh/photocycle/logging"
+	log "github.com/go-kit/kit/log"
+)
+
+//http headers
+const (
+	//HeaderRun job run id
+	HeaderRun = "X-Run-ID"
+	//HeaderItem work item id
+	HeaderItem = "X-Request-ID"
+)
+
+type ctxKey int
+
+const (
+	runKey ctxKey = iota
+	itemKey
+	spanKey
+)
+
+//NewID creates random id (16 hex chars)
+func NewID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//WithRun returns context with job run id
+func WithRun(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, runKey, id)
+}
+
+//RunID returns job run id from context or empty string
+func RunID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	s, _ := ctx.Value(runKey).(string)
+	return s
+}
+
+//WithItem returns context with work item id (group, order, status push etc)
+func WithItem(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, itemKey, id)
+}
+
+//ItemID returns work item id from context or empty string
+func ItemID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	s, _ := ctx.Value(itemKey).(string)
+	return s
+}
+
+//Logger adds context ids to logger
+func Logger(ctx context.Context, logger log.Logger) log.Logger {
+	if id := RunID(ctx); id != "" {
+		logger = log.With(logger, logging.KeyRun, id)
+	}
+	if id := ItemID(ctx); id != "" {
+		logger = log.With(logger, logging.KeyItem, id)
+	}
+	return logger
+}
+
+//SetHeaders sets context ids to request headers
+func SetHeaders(ctx context.Context, h http.Header) {
+	if id := RunID(ctx); id != "" {
+		h.Set(HeaderRun, id)
+	}
+	if id := ItemID(ctx); id != "" {
+		h.Set(HeaderItem, id)
+	}
+}
@@ -0,0 +1,131 @@
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+//memExporter collects spans
+type memExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (e *memExporter) Export(s SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+func (e *memExporter) Close() error { return nil }
+
+func TestSpans(t *testing.T) {
+	//no exporter, no spans
+	SetExporter(nil)
+	ctx, span := StartSpan(context.Background(), "off")
+	if span != nil {
+		t.Fatal("expected nil span without exporter")
+	}
+	span.SetAttr("k", 1)
+	span.End(nil)
+
+	e := &memExporter{}
+	SetExporter(e)
+	defer SetExporter(nil)
+
+	ctx = WithRun(context.Background(), "run1")
+	ctx, root := StartSpan(ctx, "job fillbox")
+	ictx := WithItem(ctx, "item1")
+	ictx, item := StartSpan(ictx, "group", "group", 42)
+	_, call := StartSpan(ictx, "api fk:get_group_boxes")
+	call.End(context.DeadlineExceeded)
+	item.End(nil)
+	root.End(nil)
+
+	if len(e.spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(e.spans))
+	}
+	c, i, r := e.spans[0], e.spans[1], e.spans[2]
+	if r.ParentID != "" || i.ParentID != r.SpanID || c.ParentID != i.SpanID {
+		t.Errorf("wrong parents: root %q, item %q->%q, call %q->%q", r.ParentID, i.ParentID, r.SpanID, c.ParentID, i.SpanID)
+	}
+	if r.TraceID != "run1" || c.TraceID != "run1" || c.ItemID != "item1" || r.ItemID != "" {
+		t.Errorf("wrong ids %+v", e.spans)
+	}
+	if c.Error == "" || i.Attrs["group"] != 42 {
+		t.Errorf("expected call error and item attr, got %+v %+v", c, i)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	h := http.Header{}
+	SetHeaders(context.Background(), h)
+	if len(h) != 0 {
+		t.Errorf("expected no headers, got %v", h)
+	}
+	SetHeaders(WithItem(WithRun(context.Background(), "r"), "i"), h)
+	if h.Get(HeaderRun) != "r" || h.Get(HeaderItem) != "i" {
+		t.Errorf("unexpected headers %v", h)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "trace.json")
+	e, err := NewFileExporter(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Export(SpanData{TraceID: "r", SpanID: "s2", ParentID: "s1", Name: "child"})
+	e.Export(SpanData{TraceID: "r", SpanID: "s1", Name: "root"})
+	if err = e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	names := make([]string, 0)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var s SpanData
+		if err = json.Unmarshal(sc.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, s.Name)
+	}
+	if len(names) != 2 || names[0] != "child" || names[1] != "root" {
+		t.Errorf("unexpected spans %v", names)
+	}
+}
+
+func TestCollectorExporter(t *testing.T) {
+	var mu sync.Mutex
+	got := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []SpanData
+		json.NewDecoder(r.Body).Decode(&batch)
+		mu.Lock()
+		got += len(batch)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	e := NewCollectorExporter(srv.URL, srv.Client())
+	for i := 0; i < collectorBatch+5; i++ {
+		e.Export(SpanData{TraceID: "r", SpanID: NewID(), Name: "span"})
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got != collectorBatch+5 {
+		t.Errorf("expected %d spans posted, got %d", collectorBatch+5, got)
+	}
+}